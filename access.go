@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeAccess says who may call a route. Routes that are not public need a
+// valid access token; ownership of the booking or user a route acts on is
+// checked by its handler.
+type routeAccess struct {
+	public     bool
+	permission Permission // required on top of the login, if set
+	stepUp     bool       // the second factor must have been passed recently
+}
+
+var (
+	publicRoute        = routeAccess{public: true}
+	authenticatedRoute = routeAccess{}
+)
+
+// requires returns the access of a route that needs perm
+func requires(perm Permission) routeAccess {
+	return routeAccess{permission: perm}
+}
+
+// stepUp returns access with a recent second factor required on top, for
+// destructive actions
+func stepUp(access routeAccess) routeAccess {
+	access.stepUp = true
+	return access
+}
+
+// routeTable registers routes together with their access, so that no route
+// can be added without saying who may call it
+type routeTable struct {
+	server *Server
+	router *gin.Engine
+	routes map[string]tableRoute // by "<method> <path>"
+}
+
+type tableRoute struct {
+	method, path string
+	access       routeAccess
+}
+
+func newRouteTable(s *Server, router *gin.Engine) *routeTable {
+	return &routeTable{server: s, router: router, routes: make(map[string]tableRoute)}
+}
+
+// handle registers handler behind the middleware its access asks for
+func (t *routeTable) handle(method, path string, access routeAccess, handler gin.HandlerFunc) {
+	var chain []gin.HandlerFunc
+	if !access.public {
+		chain = append(chain, t.server.verifyJWT())
+	}
+	if access.permission != "" {
+		chain = append(chain, t.server.requirePermission(access.permission))
+	}
+	if access.stepUp {
+		chain = append(chain, t.server.requireStepUp())
+	}
+	chain = append(chain, handler)
+	t.router.Handle(method, path, chain...)
+	t.routes[method+" "+path] = tableRoute{method: method, path: path, access: access}
+}
+
+// check fails when a route on the router was registered without an access
+// rule
+func (t *routeTable) check() error {
+	for _, info := range t.router.Routes() {
+		if _, ok := t.routes[info.Method+" "+info.Path]; !ok {
+			return fmt.Errorf("route %s %s has no access rule", info.Method, info.Path)
+		}
+	}
+	return nil
+}
+
+// callerName names the caller in audit records such as booking history
+func callerName(c *gin.Context) string {
+	if key, ok := c.Get("apiKey"); ok {
+		return "api key " + key.(APIKey).Name
+	}
+	return c.GetString("decodedEmail")
+}
+
+// authorizeEmail checks that the caller is the user with email or holds
+// anyScope, replying with an error when they are neither
+func (s *Server) authorizeEmail(c *gin.Context, email string, anyScope Permission) bool {
+	if caller := c.GetString("decodedEmail"); caller != "" && caller == email {
+		return true
+	}
+	allowed, ok := s.callerCan(c, anyScope)
+	if !ok {
+		return false
+	}
+	if !allowed {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden access"})
+		return false
+	}
+	return true
+}
+
+// authorizeBooking checks that the caller may act on booking: its patient,
+// holders of anyScope and, for reads, the doctors of its treatment. It replies
+// with an error when they may not.
+func (s *Server) authorizeBooking(c *gin.Context, booking Booking, anyScope Permission) bool {
+	if caller := c.GetString("decodedEmail"); caller != "" && caller == booking.Email {
+		return true
+	}
+	allowed, ok := s.callerCan(c, anyScope)
+	if !ok {
+		return false
+	}
+	if allowed {
+		return true
+	}
+	if anyScope == PermBookingsReadAny {
+		treats, ok := s.callerCan(c, PermBookingsReadOwnTreat)
+		if !ok {
+			return false
+		}
+		if treats {
+			doctor, err := s.Doctors.FindByEmail(c, c.GetString("decodedEmail"))
+			if err != nil && err != ErrNotFound {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find doctor"})
+				return false
+			}
+			if err == nil && doctor.Specialty == booking.Treatment {
+				return true
+			}
+		}
+	}
+	c.JSON(http.StatusForbidden, gin.H{"error": "forbidden access"})
+	return false
+}
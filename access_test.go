@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteAccess(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+
+	// Everything a route can act on belongs to p@x.com; the requests are
+	// made by q@x.com, a patient without roles
+	booking := ts.hold("p@x.com", testSlots[0], time.Hour)
+	entry := WaitlistEntry{Email: "p@x.com", Treatment: "Teeth Cleaning", Status: WaitlistWaiting, CreatedAt: time.Now()}
+	if err := ts.Waitlist.Insert(ctx, &entry); err != nil {
+		t.Fatal(err)
+	}
+	user := User{Email: "p@x.com"}
+	if err := ts.Users.Insert(ctx, &user); err != nil {
+		t.Fatal(err)
+	}
+	id, userID := booking.ID.Hex(), user.ID.Hex()
+
+	const public = 0 // routes anyone may call are not requested
+	tests := []struct {
+		route  string // as registered
+		path   string // as requested
+		body   interface{}
+		status int // for q@x.com
+	}{
+		{"POST /contact", "", nil, public},
+		{"GET /appointmentOptions", "", nil, public},
+		{"GET /v2/appointmentOptions", "", nil, public},
+		{"GET /availability", "", nil, public},
+		{"GET /appointmentSpecialty", "", nil, public},
+		{"POST /waitlist/claim", "", nil, public},
+		{"POST /webhooks/payments", "", nil, public},
+		{"GET /.well-known/jwks.json", "", nil, public},
+		{"POST /auth/register", "", nil, public},
+		{"POST /auth/login", "", nil, public},
+		{"POST /auth/refresh", "", nil, public},
+		{"POST /auth/password-reset", "", nil, public},
+		{"POST /auth/password-reset/confirm", "", nil, public},
+		{"POST /auth/oidc/:provider", "", nil, public},
+
+		// Patients may only act on what is theirs
+		{"GET /bookings", "/bookings?email=p@x.com", nil, http.StatusForbidden},
+		{"GET /bookings/:id", "/bookings/" + id, nil, http.StatusForbidden},
+		{"POST /bookings", "/bookings", bookingRequest{testDate, "Teeth Cleaning", testSlots[1], "p@x.com"}, http.StatusForbidden},
+		{"POST /bookings/:id/cancel", "/bookings/" + id + "/cancel", nil, http.StatusForbidden},
+		{"POST /bookings/:id/reschedule", "/bookings/" + id + "/reschedule", BookingChangeRequest{AppointmentDate: testDate, Slot: testSlots[1]}, http.StatusForbidden},
+		{"GET /bookings/:id/payment", "/bookings/" + id + "/payment", nil, http.StatusForbidden},
+		{"POST /holds", "/holds", bookingRequest{testDate, "Teeth Cleaning", testSlots[1], "p@x.com"}, http.StatusForbidden},
+		{"GET /waitlist", "/waitlist?email=p@x.com", nil, http.StatusForbidden},
+		{"POST /waitlist", "/waitlist", WaitlistRequest{Email: "p@x.com", Treatment: "Teeth Cleaning", From: testDate}, http.StatusForbidden},
+		{"DELETE /waitlist/:id", "/waitlist/" + entry.ID.Hex(), nil, http.StatusForbidden},
+		{"POST /create-payment-intent", "/create-payment-intent", PaymentIntentRequest{BookingID: id}, http.StatusForbidden},
+		{"POST /payments", "/payments", Payment{TransactionID: "pi_1", Booking: PaymentBooking{ID: id}}, http.StatusForbidden},
+		{"GET /users/admin/:email", "/users/admin/p@x.com", nil, http.StatusForbidden},
+
+		// Routes acting on the caller's own account
+		{"POST /auth/logout", "/auth/logout", nil, http.StatusOK},
+		{"POST /auth/mfa/totp", "/auth/mfa/totp", nil, http.StatusOK},
+		{"POST /auth/mfa/totp/confirm", "/auth/mfa/totp/confirm", map[string]string{"code": "000000"}, http.StatusBadRequest}, // enrolled just above
+		{"POST /auth/mfa/verify", "/auth/mfa/verify", map[string]string{"code": "000000"}, http.StatusConflict},
+		{"DELETE /auth/mfa/totp", "/auth/mfa/totp", nil, http.StatusForbidden},
+		{"POST /auth/mfa/recovery-codes", "/auth/mfa/recovery-codes", nil, http.StatusForbidden},
+
+		// Staff routes
+		{"GET /payments/report", "/payments/report", nil, http.StatusForbidden},
+		{"POST /bookings/:id/status", "/bookings/" + id + "/status", BookingStatusRequest{Status: StatusCompleted}, http.StatusForbidden},
+		{"POST /bookings/:id/refund", "/bookings/" + id + "/refund", nil, http.StatusForbidden},
+		{"GET /users", "/users", nil, http.StatusForbidden},
+		{"POST /users", "/users", User{Email: "r@x.com"}, http.StatusForbidden},
+		{"PUT /users/admin/:id", "/users/admin/" + userID, nil, http.StatusForbidden},
+		{"POST /users/:id/roles", "/users/" + userID + "/roles", map[string]Role{"role": RoleSuperAdmin}, http.StatusForbidden},
+		{"DELETE /users/:id/roles/:role", "/users/" + userID + "/roles/" + string(RoleReceptionist), nil, http.StatusForbidden},
+		{"POST /users/:id/demote", "/users/" + userID + "/demote", nil, http.StatusForbidden},
+		{"DELETE /users/:id/sessions", "/users/" + userID + "/sessions", nil, http.StatusForbidden},
+		{"GET /api-keys", "/api-keys", nil, http.StatusForbidden},
+		{"POST /api-keys", "/api-keys", nil, http.StatusForbidden},
+		{"DELETE /api-keys/:id", "/api-keys/" + id, nil, http.StatusForbidden},
+		{"GET /doctors", "/doctors", nil, http.StatusForbidden},
+		{"GET /doctors/me/bookings", "/doctors/me/bookings", nil, http.StatusForbidden},
+		{"DELETE /doctors/:id", "/doctors/" + id, nil, http.StatusForbidden},
+		{"POST /doctors", "/doctors", nil, http.StatusForbidden},
+		{"PUT /doctors/:id/schedules", "/doctors/" + id + "/schedules", nil, http.StatusForbidden},
+		{"GET /blackouts", "/blackouts", nil, http.StatusForbidden},
+		{"GET /blackouts/conflicts", "/blackouts/conflicts", nil, http.StatusForbidden},
+		{"POST /blackouts", "/blackouts", nil, http.StatusForbidden},
+		{"DELETE /blackouts/:id", "/blackouts/" + id, nil, http.StatusForbidden},
+	}
+
+	// A route added without a case here fails the test
+	cases := make(map[string]bool)
+	for _, tt := range tests {
+		cases[tt.route] = true
+	}
+	for _, route := range ts.router.Routes() {
+		if !cases[route.Method+" "+route.Path] {
+			t.Errorf("route %s %s has no access case", route.Method, route.Path)
+		}
+	}
+
+	for _, tt := range tests {
+		if tt.status == public {
+			continue
+		}
+		t.Run(tt.route, func(t *testing.T) {
+			method, _, _ := strings.Cut(tt.route, " ")
+			expectStatus(t, ts.do(method, tt.path, "", tt.body), http.StatusUnauthorized)
+			expectStatus(t, ts.do(method, tt.path, "not.a.token", tt.body), http.StatusForbidden)
+			expectStatus(t, ts.do(method, tt.path, ts.login("q@x.com"), tt.body), tt.status)
+		})
+	}
+
+	if got, _ := ts.Bookings.FindByID(ctx, booking.ID); got.currentStatus() != StatusPending {
+		t.Errorf("a refused request changed the booking: %+v", got)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	apiKeyPrefix        = "gdk_"              // makes leaked keys easy to find
+	apiKeyDefaultTTL    = 90 * 24 * time.Hour // when the admin does not choose an expiry
+	apiKeyMaxTTL        = 365 * 24 * time.Hour
+	apiKeyTouchInterval = time.Minute // how often LastUsedAt is written for a busy key
+)
+
+// apiKeyScopes are the permissions an API key may be given. Managing roles,
+// sessions and other keys stays with people.
+var apiKeyScopes = map[Permission]bool{
+	PermBookingsReadAny:  true,
+	PermBookingsWriteAny: true,
+	PermPaymentsReadAny:  true,
+	PermDoctorsRead:      true,
+	PermUsersRead:        true,
+}
+
+// allows reports whether the key was given perm
+func (k APIKey) allows(perm Permission) bool {
+	for _, scope := range k.Scopes {
+		if scope == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// newAPIKey returns a key written as "gdk_<key ID>_<secret>" and the hash it
+// is stored under
+func newAPIKey(id primitive.ObjectID) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	key := apiKeyPrefix + id.Hex() + "_" + hex.EncodeToString(secret)
+	return key, hashToken(key), nil
+}
+
+// parseAPIKey returns the ID of the key a client presented
+func parseAPIKey(key string) (primitive.ObjectID, bool) {
+	idHex, _, ok := strings.Cut(strings.TrimPrefix(key, apiKeyPrefix), "_")
+	if !ok || !strings.HasPrefix(key, apiKeyPrefix) {
+		return primitive.NilObjectID, false
+	}
+	id, err := primitive.ObjectIDFromHex(idHex)
+	return id, err == nil
+}
+
+// authenticateAPIKey lets a request through verifyJWT with an API key instead
+// of an access token. The key stands in for the caller, so ownership checks
+// never match and everything it does needs one of its scopes.
+func (s *Server) authenticateAPIKey(c *gin.Context, presented string) {
+	id, ok := parseAPIKey(presented)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+		return
+	}
+	key, err := s.APIKeys.FindByID(c, id)
+	if err != nil && err != ErrNotFound {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if err == ErrNotFound || subtle.ConstantTimeCompare([]byte(key.KeyHash), []byte(hashToken(presented))) != 1 {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
+		return
+	}
+	now := time.Now()
+	if !key.active(now) {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key has expired or was revoked"})
+		return
+	}
+
+	if key.LastUsedAt == nil || now.Sub(*key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := s.APIKeys.Touch(c, key.ID, now); err != nil {
+			log.Printf("Failed to record use of API key %s: %v", key.ID.Hex(), err)
+		}
+	}
+
+	c.Set("apiKey", key)
+	c.Next()
+}
+
+// APIKeyRequest is the body accepted when creating an API key
+type APIKeyRequest struct {
+	Name      string       `json:"name"`
+	Scopes    []Permission `json:"scopes"`
+	ExpiresAt *time.Time   `json:"expiresAt"`
+}
+
+func (s *Server) handleGetAPIKeys(c *gin.Context) {
+	keys, err := s.APIKeys.List(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch API keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+// handlePostAPIKey creates an API key and returns it. The key itself is
+// never shown again.
+func (s *Server) handlePostAPIKey(c *gin.Context) {
+	var req APIKeyRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Name) == "" || len(req.Scopes) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a name and at least one scope are required"})
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !apiKeyScopes[scope] {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "scope " + string(scope) + " cannot be given to an API key"})
+			return
+		}
+	}
+
+	now := time.Now()
+	expiresAt := now.Add(apiKeyDefaultTTL)
+	if req.ExpiresAt != nil {
+		expiresAt = *req.ExpiresAt
+	}
+	if !expiresAt.After(now) || expiresAt.Sub(now) > apiKeyMaxTTL {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expiresAt must be in the next 365 days"})
+		return
+	}
+
+	key := APIKey{
+		ID:        primitive.NewObjectID(),
+		Name:      strings.TrimSpace(req.Name),
+		Scopes:    req.Scopes,
+		CreatedBy: c.GetString("decodedEmail"),
+		CreatedAt: now,
+		ExpiresAt: expiresAt,
+	}
+	secret, hash, err := newAPIKey(key.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create API key"})
+		return
+	}
+	key.KeyHash = hash
+	if err := s.APIKeys.Insert(c, &key); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert API key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"key": secret, "apiKey": key})
+}
+
+func (s *Server) handleRevokeAPIKey(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid API key ID"})
+		return
+	}
+
+	if err := s.APIKeys.Revoke(c, id, time.Now()); err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke API key"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "API key revoked"})
+}
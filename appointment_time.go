@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// appointmentDateLayout is the format AppointmentDate is stored and compared
+// in, e.g. "May 5, 2025"
+const appointmentDateLayout = "Jan 2, 2006"
+
+// appointmentDateLayouts are the formats AppointmentDate has been stored in
+// and is accepted in
+var appointmentDateLayouts = []string{
+	appointmentDateLayout,
+	"January 2, 2006",
+	"2006-01-02",
+}
+
+// slotTimeLayouts are the formats of the times in slot strings like
+// "08.00 AM - 08.30 AM"
+var slotTimeLayouts = []string{
+	"03.04 PM",
+	"3.04 PM",
+	"03:04 PM",
+	"3:04 PM",
+	"15:04",
+}
+
+// slotLayout is the format slot strings are generated in
+const slotLayout = "03.04 PM"
+
+// parseAppointmentDate returns midnight of the appointment date in loc
+func parseAppointmentDate(date string, loc *time.Location) (time.Time, error) {
+	for _, layout := range appointmentDateLayouts {
+		if day, err := time.ParseInLocation(layout, strings.TrimSpace(date), loc); err == nil {
+			return day, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognised appointment date %q", date)
+}
+
+// normalizeAppointmentDate rewrites a date given in any accepted format the
+// way it is stored, so dates can be compared as strings
+func normalizeAppointmentDate(date string) (string, error) {
+	day, err := parseAppointmentDate(date, time.UTC)
+	if err != nil {
+		return "", err
+	}
+	return day.Format(appointmentDateLayout), nil
+}
+
+// formatSlot writes the slot running between two wall clock times, e.g.
+// "08.00 AM - 08.30 AM"
+func formatSlot(start, end time.Time) string {
+	return start.Format(slotLayout) + " - " + end.Format(slotLayout)
+}
+
+// parseSlotClock parses one of the wall clock times of a slot string
+func parseSlotClock(clock string) (time.Time, bool) {
+	for _, layout := range slotTimeLayouts {
+		if t, err := time.Parse(layout, strings.TrimSpace(clock)); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// atClock returns the time on day's date, in day's location, whose wall clock
+// shows clock. A wall clock time skipped by a daylight saving change is moved
+// past the change by time.Date.
+func atClock(day, clock time.Time) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, day.Location())
+}
+
+// appointmentTimes returns when the appointment on date in slot starts and
+// ends, reading the wall clock times of the slot in loc
+func appointmentTimes(date, slot string, loc *time.Location) (time.Time, time.Time, error) {
+	day, err := parseAppointmentDate(date, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return slotTimes(day, slot)
+}
+
+// slotTimes returns when slot starts and ends on day, midnight in the
+// clinic's time zone
+func slotTimes(day time.Time, slot string) (time.Time, time.Time, error) {
+	startText, endText, _ := strings.Cut(slot, "-")
+	startClock, startOK := parseSlotClock(startText)
+	endClock, endOK := parseSlotClock(endText)
+	if !startOK || !endOK {
+		return time.Time{}, time.Time{}, fmt.Errorf("unrecognised slot %q", slot)
+	}
+	start, end := atClock(day, startClock), atClock(day, endClock)
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("slot %q does not end after it starts", slot)
+	}
+	return start, end, nil
+}
+
+// setTimes normalizes the appointment date of the booking and stores when it
+// starts and ends in UTC, reading its slot in the clinic's time zone loc
+func (b *Booking) setTimes(loc *time.Location) error {
+	date, err := normalizeAppointmentDate(b.AppointmentDate)
+	if err != nil {
+		return err
+	}
+	start, end, err := appointmentTimes(date, b.Slot, loc)
+	if err != nil {
+		return err
+	}
+	start, end = start.UTC(), end.UTC()
+	b.AppointmentDate = date
+	b.StartsAt = &start
+	b.EndsAt = &end
+	return nil
+}
+
+// startTime returns when the booked appointment starts, working it out from
+// the date and slot strings for bookings stored before times were
+func (b Booking) startTime(loc *time.Location) (time.Time, error) {
+	if b.StartsAt != nil {
+		return *b.StartsAt, nil
+	}
+	start, _, err := appointmentTimes(b.AppointmentDate, b.Slot, loc)
+	return start, err
+}
+
+// BookingView is a booking as sent to clients, with its times both in UTC and
+// on the clinic's wall clock
+type BookingView struct {
+	Booking
+	TimeZone      string
+	LocalStartsAt *time.Time `json:",omitempty"`
+	LocalEndsAt   *time.Time `json:",omitempty"`
+}
+
+// viewBooking adds the clinic's local times to a booking
+func (s *Server) viewBooking(b Booking) BookingView {
+	loc := s.config.ClinicLocation
+	view := BookingView{Booking: b, TimeZone: loc.String()}
+	if b.StartsAt != nil && b.EndsAt != nil {
+		start, end := b.StartsAt.UTC(), b.EndsAt.UTC()
+		localStart, localEnd := start.In(loc), end.In(loc)
+		view.StartsAt, view.EndsAt = &start, &end
+		view.LocalStartsAt, view.LocalEndsAt = &localStart, &localEnd
+	}
+	return view
+}
+
+// viewBookings adds the clinic's local times to bookings
+func (s *Server) viewBookings(bookings []Booking) []BookingView {
+	views := make([]BookingView, len(bookings))
+	for i, b := range bookings {
+		views[i] = s.viewBooking(b)
+	}
+	return views
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128 // bounds the work spent hashing a request
+	maxLoginAttempts  = 5   // failed logins in a row before the account is locked
+	loginLockout      = 15 * time.Minute
+	passwordResetTTL  = time.Hour
+	accessTokenTTL    = 15 * time.Minute // sessions are kept alive with refresh tokens
+)
+
+// RegisterRequest is the body accepted by the registration endpoint
+type RegisterRequest struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// LoginRequest is the body accepted by the login endpoint
+type LoginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// PasswordResetRequest asks for a reset link to be sent to Email
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+// PasswordResetConfirmation sets a new password using a reset token
+type PasswordResetConfirmation struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// checkPassword returns why password is not acceptable, or "" if it is
+func checkPassword(password string) string {
+	switch {
+	case len(password) < minPasswordLength:
+		return fmt.Sprintf("password must be at least %d characters", minPasswordLength)
+	case len(password) > maxPasswordLength:
+		return fmt.Sprintf("password must be at most %d characters", maxPasswordLength)
+	}
+	return ""
+}
+
+// tokenLeeway absorbs clock skew between us and other services checking our tokens
+const tokenLeeway = 30 * time.Second
+
+// issueAccessToken signs a short-lived token for the user of a session, who
+// currently holds roles, with the current signing key
+func (s *Server) issueAccessToken(session Session, roles []Role) (string, error) {
+	now := time.Now()
+	key, err := s.config.SigningKeys.signingKey(now)
+	if err != nil {
+		return "", err
+	}
+	claims := &Claims{
+		Email:     session.Email,
+		SessionID: session.ID.Hex(),
+		Roles:     roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.config.TokenIssuer,
+			Subject:   session.UserID.Hex(),
+			Audience:  jwt.ClaimStrings{s.config.TokenAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+		},
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
+}
+
+// parseAccessToken verifies an access token issued by issueAccessToken. Only
+// the algorithms of our keys are accepted, and each key only with its own
+// algorithm.
+func (s *Server) parseAccessToken(tokenStr string) (*Claims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods(s.config.SigningKeys.algorithms()),
+		jwt.WithIssuer(s.config.TokenIssuer),
+		jwt.WithAudience(s.config.TokenAudience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(tokenLeeway),
+	)
+	claims := &Claims{}
+	_, err := parser.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, ok := s.config.SigningKeys.verificationKey(kid, time.Now())
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", kid)
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("signing key %s does not use %s", kid, token.Method.Alg())
+		}
+		return key.private.Public(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The parser checks these when present; our tokens always carry them
+	if claims.IssuedAt == nil || claims.NotBefore == nil {
+		return nil, errors.New("token is missing iat or nbf")
+	}
+	return claims, nil
+}
+
+// hashToken returns the form reset and refresh tokens are stored and looked up in
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Server) handleRegister(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Email = strings.TrimSpace(req.Email)
+	if !strings.Contains(req.Email, "@") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a valid email is required"})
+		return
+	}
+	if problem := checkPassword(req.Password); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	_, err := s.Users.FindByEmail(c, req.Email)
+	if err == nil {
+		// Accounts created before passwords existed get one through a reset
+		c.JSON(http.StatusConflict, gin.H{"error": "an account with this email already exists"})
+		return
+	} else if err != ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+	user := User{Name: req.Name, Email: req.Email, PasswordHash: hash}
+	if err := s.Users.Insert(c, &user); err != nil {
+		if err == ErrDuplicateEmail {
+			c.JSON(http.StatusConflict, gin.H{"error": "an account with this email already exists"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert user"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"InsertedID": user.ID})
+}
+
+// handleLogin starts a session for a correct email and password. After
+// maxLoginAttempts failures in a row the account is locked for loginLockout.
+func (s *Server) handleLogin(c *gin.Context) {
+	var req LoginRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := s.Users.FindByEmail(c, strings.TrimSpace(req.Email))
+	if err != nil && err != ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
+		return
+	}
+	if err == ErrNotFound || user.PasswordHash == "" {
+		verifyPassword(dummyPasswordHash(), req.Password)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
+		return
+	}
+
+	now := time.Now()
+	if user.locked(now) {
+		c.Header("Retry-After", fmt.Sprint(int(user.LockedUntil.Sub(now).Seconds())+1))
+		c.JSON(http.StatusLocked, gin.H{"error": "account is locked after too many failed logins, try again later"})
+		return
+	}
+
+	ok, err := verifyPassword(user.PasswordHash, req.Password)
+	if err != nil {
+		log.Printf("Unreadable password hash for user %s: %v", user.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify password"})
+		return
+	}
+	if !ok {
+		failures, err := s.Users.RecordLoginFailure(c, user.ID)
+		if err == nil && failures >= maxLoginAttempts {
+			until := now.Add(loginLockout)
+			err = s.Users.SetLockout(c, user.ID, &until)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record login"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid email or password"})
+		return
+	}
+
+	if user.FailedLogins > 0 || user.LockedUntil != nil {
+		if err := s.Users.SetLockout(c, user.ID, nil); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record login"})
+			return
+		}
+	}
+
+	tokens, err := s.startSession(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// handleRequestPasswordReset sends a single-use reset link to the user. The
+// response is the same whether or not the email is registered.
+func (s *Server) handleRequestPasswordReset(c *gin.Context) {
+	var req PasswordResetRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	accepted := gin.H{"message": "if the email is registered, a reset link has been sent"}
+	user, err := s.Users.FindByEmail(c, strings.TrimSpace(req.Email))
+	if err == ErrNotFound {
+		c.JSON(http.StatusAccepted, accepted)
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create reset token"})
+		return
+	}
+	token := hex.EncodeToString(secret)
+	reset := PasswordReset{
+		UserID:    user.ID,
+		TokenHash: hashToken(token),
+		ExpiresAt: time.Now().Add(passwordResetTTL),
+	}
+	if err := s.PasswordResets.Insert(c, &reset); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create reset token"})
+		return
+	}
+
+	link := token
+	if s.config.PasswordResetURL != "" {
+		link = s.config.PasswordResetURL + "?token=" + url.QueryEscape(token)
+	}
+	body := fmt.Sprintf("Use this link within %s to choose a new password:\n%s", passwordResetTTL, link)
+	if err := s.notifier.Notify(c, user.Email, "Reset your password", body); err != nil {
+		log.Printf("Failed to send password reset to user %s: %v", user.ID.Hex(), err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to send reset link"})
+		return
+	}
+
+	c.JSON(http.StatusAccepted, accepted)
+}
+
+// handleConfirmPasswordReset sets a new password with a reset token. Using the
+// token also lifts a login lockout and signs the user out everywhere.
+func (s *Server) handleConfirmPasswordReset(c *gin.Context) {
+	var req PasswordResetConfirmation
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if problem := checkPassword(req.Password); problem != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": problem})
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	reset, err := s.PasswordResets.Consume(c, hashToken(req.Token), time.Now())
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired reset token"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check reset token"})
+		}
+		return
+	}
+
+	if err := s.Users.SetPassword(c, reset.UserID, hash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update password"})
+		return
+	}
+	if _, err := s.Sessions.RevokeAllForUser(c, reset.UserID, time.Now(), "password reset"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "password updated"})
+}
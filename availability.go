@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// removeBookedSlots strips every slot taken by active bookings or unexpired
+// holds from the matching treatment in options. Options are modified in place.
+func removeBookedSlots(options []AppointmentOption, bookings []Booking) {
+	now := time.Now()
+	booked := make(map[string][]BookedSlot)
+	for _, book := range bookings {
+		if !book.occupiesSlot(now) {
+			continue
+		}
+		booked[book.Treatment] = append(booked[book.Treatment], BookedSlot{Slot: book.Slot, DoctorID: book.DoctorID})
+	}
+
+	for i := range options {
+		options[i].Slots = freeSlots(options[i], booked[options[i].Name])
+	}
+}
+
+// freeSlots returns the slots of option not taken by booked, keeping their
+// order. A slot laid out by doctor schedules stays free while one of the
+// doctors offering it is not booked for it; bookings without a doctor, made
+// before the slot came from schedules, take up one doctor each.
+func freeSlots(option AppointmentOption, booked []BookedSlot) []string {
+	withoutDoctor := make(map[string]int)
+	busy := make(map[string]map[primitive.ObjectID]bool)
+	for _, b := range booked {
+		if b.DoctorID == nil {
+			withoutDoctor[b.Slot]++
+			continue
+		}
+		if busy[b.Slot] == nil {
+			busy[b.Slot] = make(map[primitive.ObjectID]bool)
+		}
+		busy[b.Slot][*b.DoctorID] = true
+	}
+
+	var remaining []string
+	for _, slot := range option.Slots {
+		doctors := option.doctors[slot]
+		if len(doctors) == 0 {
+			if withoutDoctor[slot] == 0 && len(busy[slot]) == 0 {
+				remaining = append(remaining, slot)
+			}
+			continue
+		}
+		free := -withoutDoctor[slot]
+		for _, id := range doctors {
+			if !busy[slot][id] {
+				free++
+			}
+		}
+		if free > 0 {
+			remaining = append(remaining, slot)
+		}
+	}
+	return remaining
+}
+
+// availableOptions returns every option with the slots still free on date,
+// a normalized appointment date: those offered that day less those booked.
+// The booked slots of every option come from one aggregation.
+func (s *Server) availableOptions(ctx context.Context, date string) ([]AppointmentOption, error) {
+	booked, err := s.AppointmentOptions.Available(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+	options := make([]AppointmentOption, len(booked))
+	for i, option := range booked {
+		options[i] = option.AppointmentOption
+	}
+	if err := s.scheduleOptions(ctx, options, date); err != nil {
+		return nil, err
+	}
+	for i, option := range booked {
+		options[i].Slots = freeSlots(options[i], option.Booked)
+	}
+	return options, nil
+}
+
+// hasSlot reports whether slot is one of the slots offered by option
+func hasSlot(option AppointmentOption, slot string) bool {
+	for _, s := range option.Slots {
+		if s == slot {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAvailabilityDays bounds the range of dates /availability covers
+const maxAvailabilityDays = 62
+
+// TreatmentAvailability is what a treatment has free on a day
+type TreatmentAvailability struct {
+	Name  string   `json:"name"`
+	Free  int      `json:"free"`
+	Slots []string `json:"slots"`
+}
+
+// DayAvailability is what every treatment has free on a day
+type DayAvailability struct {
+	Date       string                  `json:"date"`
+	Treatments []TreatmentAvailability `json:"treatments"`
+}
+
+// handleGetAvailability returns the free slots of every treatment, or of the
+// one named by the treatment query parameter, on each day from from to to.
+// Bookings, doctors and blackouts are each loaded once for the whole range.
+func (s *Server) handleGetAvailability(c *gin.Context) {
+	loc := s.config.ClinicLocation
+	first, err := parseAppointmentDate(c.Query("from"), loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "from: " + err.Error()})
+		return
+	}
+	last, err := parseAppointmentDate(c.Query("to"), loc)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to: " + err.Error()})
+		return
+	}
+	end := last.AddDate(0, 0, 1)
+	if !end.After(first) || end.After(first.AddDate(0, 0, maxAvailabilityDays)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("to must be on or after from and at most %d days after it", maxAvailabilityDays-1)})
+		return
+	}
+
+	options, err := s.AppointmentOptions.List(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment options"})
+		return
+	}
+	if treatment := c.Query("treatment"); treatment != "" {
+		options = filterDocs(options, func(o AppointmentOption) bool { return o.Name == treatment })
+		if len(options) == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "unknown treatment"})
+			return
+		}
+	}
+	doctors, err := s.Doctors.List(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch doctors"})
+		return
+	}
+	blackouts, err := s.Blackouts.List(c, first, end)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch blackouts"})
+		return
+	}
+	// Bookings are matched by their date like on /appointmentOptions, so
+	// those whose times could not be worked out still take their slot
+	var dates []string
+	for day := first; day.Before(end); day = day.AddDate(0, 0, 1) {
+		dates = append(dates, day.Format(appointmentDateLayout))
+	}
+	bookings, err := s.Bookings.FindByDates(c, dates)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bookings"})
+		return
+	}
+	bookingsByDate := make(map[string][]Booking)
+	for _, booking := range bookings {
+		bookingsByDate[booking.AppointmentDate] = append(bookingsByDate[booking.AppointmentDate], booking)
+	}
+
+	days := []DayAvailability{}
+	for day := first; day.Before(end); day = day.AddDate(0, 0, 1) {
+		date := day.Format(appointmentDateLayout)
+		dayOptions := make([]AppointmentOption, len(options))
+		for i, option := range options {
+			option.Slots = append([]string(nil), option.Slots...)
+			dayOptions[i] = option
+		}
+		applySchedules(dayOptions, doctors, blackouts, day)
+		removeClosedSlots(dayOptions, doctors, blackouts, day)
+		removeBookedSlots(dayOptions, bookingsByDate[date])
+
+		availability := DayAvailability{Date: date, Treatments: make([]TreatmentAvailability, len(dayOptions))}
+		for i, option := range dayOptions {
+			slots := option.Slots
+			if slots == nil {
+				slots = []string{}
+			}
+			availability.Treatments[i] = TreatmentAvailability{Name: option.Name, Free: len(slots), Slots: slots}
+		}
+		days = append(days, availability)
+	}
+
+	respondWithETag(c, gin.H{"timeZone": loc.String(), "days": days})
+}
+
+// respondWithETag replies with body and an ETag of its contents, or with 304
+// Not Modified when the client already has that version
+func respondWithETag(c *gin.Context, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to encode response"})
+		return
+	}
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	// Caches may keep the response but must check it is still current
+	c.Header("Cache-Control", "no-cache")
+	c.Header("ETag", etag)
+	for _, candidate := range strings.Split(c.GetHeader("If-None-Match"), ",") {
+		if candidate = strings.TrimSpace(candidate); candidate == etag || candidate == "W/"+etag || candidate == "*" {
+			c.Status(http.StatusNotModified)
+			return
+		}
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", data)
+}
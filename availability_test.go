@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestGetAvailability(t *testing.T) {
+	ts := newTestServer(t)
+	ts.book("p@x.com", testSlots[0])
+	// A booking whose times were never worked out still takes its slot
+	legacy := Booking{AppointmentDate: testDate, Treatment: "Teeth Cleaning", Slot: testSlots[2], Email: "q@x.com", Status: StatusConfirmed}
+	if err := ts.Bookings.Insert(context.Background(), &legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := ts.do("GET", "/availability?from=2099-01-04&to=2099-01-05", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	body := decodeJSON[struct{ Days []DayAvailability }](t, rec)
+	want := map[string]string{"Jan 4, 2099": fmt.Sprint(testSlots), testDate: fmt.Sprint(testSlots[1:2])}
+	if len(body.Days) != len(want) {
+		t.Fatalf("got %d days, want %d", len(body.Days), len(want))
+	}
+	for _, day := range body.Days {
+		if got := fmt.Sprint(day.Treatments[0].Slots); got != want[day.Date] {
+			t.Errorf("%s: got slots %s, want %s", day.Date, got, want[day.Date])
+		}
+	}
+
+	// Unchanged availability is not sent again
+	again := ts.do("GET", "/availability?from=2099-01-04&to=2099-01-05", "", nil)
+	if etag := again.Header().Get("ETag"); etag == "" || etag != rec.Header().Get("ETag") {
+		t.Errorf("got ETags %q and %q", rec.Header().Get("ETag"), etag)
+	}
+}
+
+// availableOptionsByLoop works out availability the way it was before the
+// aggregation: options and the bookings on date are loaded separately and
+// matched up here
+func availableOptionsByLoop(t *testing.T, s *Server, date string) []AppointmentOption {
+	t.Helper()
+	ctx := context.Background()
+	options, err := s.AppointmentOptions.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.scheduleOptions(ctx, options, date); err != nil {
+		t.Fatal(err)
+	}
+	bookings, err := s.Bookings.FindByDate(ctx, date)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeBookedSlots(options, bookings)
+	return options
+}
+
+func TestAvailableOptionsMatchesLoop(t *testing.T) {
+	rootCanal := AppointmentOption{Name: "Root Canal", Slots: []string{"10.00 AM - 11.00 AM"}, Price: 90}
+	checkAvailableOptionsMatchLoop(t, newTestServer(t, testOption(), rootCanal), rootCanal)
+}
+
+// TestMongoAvailableOptionsMatchesLoop checks the $lookup aggregation of the
+// MongoDB store against the loop on the same fixtures
+func TestMongoAvailableOptionsMatchesLoop(t *testing.T) {
+	rootCanal := AppointmentOption{Name: "Root Canal", Slots: []string{"10.00 AM - 11.00 AM"}, Price: 90}
+	checkAvailableOptionsMatchLoop(t, newMongoTestServer(t, testOption(), rootCanal), rootCanal)
+}
+
+// checkAvailableOptionsMatchLoop books, holds and blocks slots of ts, which
+// is seeded with testOption and rootCanal, and compares the availability the
+// store works out with availableOptionsByLoop
+func checkAvailableOptionsMatchLoop(t *testing.T, ts *testServer, rootCanal AppointmentOption) {
+	t.Helper()
+	ctx := context.Background()
+
+	// Teeth Cleaning is also offered by two doctors' schedules, and one of
+	// its slots is blocked
+	ts.addDoctor("ann")
+	ts.addDoctor("bob")
+	day, _ := parseAppointmentDate(testDate, ts.config.ClinicLocation)
+	start, end, _ := slotTimes(day, testSlots[1])
+	block := Blackout{Kind: BlackoutSlot, Treatment: "Teeth Cleaning", StartsAt: start, EndsAt: end}
+	if err := ts.Blackouts.Insert(ctx, &block); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, booking := range []Booking{
+		{AppointmentDate: testDate, Treatment: "Root Canal", Slot: rootCanal.Slots[0], Status: StatusConfirmed},
+		{AppointmentDate: "Jan 6, 2099", Treatment: "Root Canal", Slot: rootCanal.Slots[0], Status: StatusCancelled},
+		{AppointmentDate: "Jan 7, 2099", Treatment: "Root Canal", Slot: rootCanal.Slots[0]}, // from before statuses
+	} {
+		if err := ts.Bookings.Insert(ctx, &booking); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ts.hold("p@x.com", testSlots[0], -time.Minute)
+	expectStatus(t, ts.do("POST", "/bookings", ts.login("q@x.com"), bookingRequest{testDate, "Teeth Cleaning", testSlots[0], "q@x.com"}), http.StatusOK)
+
+	// One of the doctors is still free in the first slot
+	want := map[string][]string{"Teeth Cleaning": testSlots[:1], "Root Canal": nil}
+	if got, _ := ts.availableOptions(ctx, testDate); fmt.Sprint(optionSlots(got)) != fmt.Sprint(want) {
+		t.Fatalf("got %v on %s, want %v", optionSlots(got), testDate, want)
+	}
+	for _, date := range []string{testDate, "Jan 6, 2099", "Jan 7, 2099", "Jan 8, 2099"} {
+		t.Run(date, func(t *testing.T) {
+			aggregated, err := ts.availableOptions(ctx, date)
+			if err != nil {
+				t.Fatal(err)
+			}
+			looped := availableOptionsByLoop(t, ts.Server, date)
+			if got, want := fmt.Sprint(optionSlots(aggregated)), fmt.Sprint(optionSlots(looped)); got != want {
+				t.Errorf("aggregation gave %s, the loop %s", got, want)
+			}
+		})
+	}
+}
+
+// optionSlots maps the names of options to their slots
+func optionSlots(options []AppointmentOption) map[string][]string {
+	slots := make(map[string][]string, len(options))
+	for _, option := range options {
+		slots[option.Name] = option.Slots
+	}
+	return slots
+}
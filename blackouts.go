@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxBlackoutDays bounds holidays and leave so a typo cannot close the
+// clinic for years
+const maxBlackoutDays = 366
+
+// overlaps reports whether the blackout overlaps [start, end)
+func (b Blackout) overlaps(start, end time.Time) bool {
+	return b.StartsAt.Before(end) && start.Before(b.EndsAt)
+}
+
+// closes reports whether the blackout closes the slot of treatment running
+// from start to end for every doctor. Leave only closes the slots of one
+// doctor; see onLeave.
+func (b Blackout) closes(treatment string, start, end time.Time) bool {
+	switch b.Kind {
+	case BlackoutHoliday:
+		return b.overlaps(start, end)
+	case BlackoutSlot:
+		return b.Treatment == treatment && b.overlaps(start, end)
+	}
+	return false
+}
+
+// onLeave reports whether the doctor is on leave for any part of [start, end)
+func onLeave(blackouts []Blackout, doctorID primitive.ObjectID, start, end time.Time) bool {
+	for _, b := range blackouts {
+		if b.Kind == BlackoutLeave && b.DoctorID != nil && *b.DoctorID == doctorID && b.overlaps(start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+// treats reports whether the doctor offers treatment, as their specialty or
+// in a schedule
+func (d Doctor) treats(treatment string) bool {
+	if d.Specialty == treatment {
+		return true
+	}
+	for _, schedule := range d.Schedules {
+		if schedule.Treatment == treatment {
+			return true
+		}
+	}
+	return false
+}
+
+// removeClosedSlots strips from options the slots on day closed by a holiday
+// or a blocked slot, and those for which every doctor offering the treatment
+// is on leave. Options are modified in place.
+func removeClosedSlots(options []AppointmentOption, doctors []Doctor, blackouts []Blackout, day time.Time) {
+	for i := range options {
+		var offering []Doctor
+		for _, doctor := range doctors {
+			if doctor.treats(options[i].Name) {
+				offering = append(offering, doctor)
+			}
+		}
+
+		var open []string
+		for _, slot := range options[i].Slots {
+			start, end, err := slotTimes(day, slot)
+			if err != nil || !slotClosed(options[i].Name, start, end, offering, blackouts) {
+				open = append(open, slot)
+			}
+		}
+		options[i].Slots = open
+	}
+}
+
+// slotClosed reports whether the slot of treatment from start to end is
+// closed by blackouts, given the doctors offering the treatment
+func slotClosed(treatment string, start, end time.Time, offering []Doctor, blackouts []Blackout) bool {
+	for _, b := range blackouts {
+		if b.closes(treatment, start, end) {
+			return true
+		}
+	}
+	if len(offering) == 0 {
+		return false
+	}
+	for _, doctor := range offering {
+		if !onLeave(blackouts, doctor.ID, start, end) {
+			return false
+		}
+	}
+	return true
+}
+
+// loadDay returns midnight of date in the clinic's time zone along with the
+// doctors and the blackouts that fall on that day
+func (s *Server) loadDay(ctx context.Context, date string) (time.Time, []Doctor, []Blackout, error) {
+	day, err := parseAppointmentDate(date, s.config.ClinicLocation)
+	if err != nil {
+		return day, nil, nil, err
+	}
+	doctors, err := s.Doctors.List(ctx)
+	if err != nil {
+		return day, nil, nil, err
+	}
+	blackouts, err := s.Blackouts.List(ctx, day, day.AddDate(0, 0, 1))
+	if err != nil {
+		return day, nil, nil, err
+	}
+	return day, doctors, blackouts, nil
+}
+
+// BlackoutRequest is the body accepted when creating a blackout. Holidays and
+// leave close whole days from From to To; a slot block closes Slot on Date.
+type BlackoutRequest struct {
+	Kind      BlackoutKind `json:"kind"`
+	DoctorID  string       `json:"doctorId"`  // for leave
+	Treatment string       `json:"treatment"` // for slot blocks
+	From      string       `json:"from"`
+	To        string       `json:"to"` // defaults to From
+	Date      string       `json:"date"`
+	Slot      string       `json:"slot"`
+	Reason    string       `json:"reason"`
+}
+
+// handleGetBlackouts lists the blackouts overlapping the optional from and to dates
+func (s *Server) handleGetBlackouts(c *gin.Context) {
+	var from, to time.Time
+	if date := c.Query("from"); date != "" {
+		day, err := parseAppointmentDate(date, s.config.ClinicLocation)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		from = day
+	}
+	if date := c.Query("to"); date != "" {
+		day, err := parseAppointmentDate(date, s.config.ClinicLocation)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		to = day.AddDate(0, 0, 1)
+	}
+
+	blackouts, err := s.Blackouts.List(c, from, to)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch blackouts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, blackouts)
+}
+
+// handlePostBlackout creates a blackout and flags the active bookings that
+// fall on it, which are returned so staff can reschedule them
+func (s *Server) handlePostBlackout(c *gin.Context) {
+	var req BlackoutRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	blackout := Blackout{
+		Kind:      req.Kind,
+		Reason:    strings.TrimSpace(req.Reason),
+		CreatedBy: callerName(c),
+		CreatedAt: time.Now(),
+	}
+	var doctor Doctor
+	switch req.Kind {
+	case BlackoutHoliday, BlackoutLeave:
+		if !s.blackoutDays(c, &blackout, req.From, req.To) {
+			return
+		}
+		if req.Kind == BlackoutLeave {
+			var ok bool
+			if doctor, ok = s.findDoctor(c, req.DoctorID); !ok {
+				return
+			}
+			blackout.DoctorID = &doctor.ID
+		}
+	case BlackoutSlot:
+		if _, err := s.AppointmentOptions.FindByName(c, req.Treatment); err != nil {
+			if err == ErrNotFound {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown treatment"})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment option"})
+			}
+			return
+		}
+		start, end, err := appointmentTimes(req.Date, req.Slot, s.config.ClinicLocation)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		blackout.Treatment = req.Treatment
+		blackout.StartsAt, blackout.EndsAt = start.UTC(), end.UTC()
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "kind must be holiday, leave or slot"})
+		return
+	}
+
+	if err := s.Blackouts.Insert(c, &blackout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert blackout"})
+		return
+	}
+
+	conflicts, err := s.flagConflicts(c, blackout, doctor)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "blackout created but failed to flag conflicting bookings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"blackout": blackout, "conflicts": s.viewBookings(conflicts)})
+}
+
+// blackoutDays sets the blackout to run from midnight of from until the end
+// of to in the clinic's time zone, replying with an error when the dates are
+// not a valid range
+func (s *Server) blackoutDays(c *gin.Context, blackout *Blackout, from, to string) bool {
+	if to == "" {
+		to = from
+	}
+	first, err := parseAppointmentDate(from, s.config.ClinicLocation)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	last, err := parseAppointmentDate(to, s.config.ClinicLocation)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return false
+	}
+	end := last.AddDate(0, 0, 1)
+	if !end.After(first) || end.After(first.AddDate(0, 0, maxBlackoutDays)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "to must be on or after from and within a year of it"})
+		return false
+	}
+	blackout.StartsAt, blackout.EndsAt = first.UTC(), end.UTC()
+	return true
+}
+
+// findDoctor looks up the doctor with the given ID, replying with an error
+// when there is none
+func (s *Server) findDoctor(c *gin.Context, idHex string) (Doctor, bool) {
+	id, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid doctor ID"})
+		return Doctor{}, false
+	}
+	doctors, err := s.Doctors.List(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch doctors"})
+		return Doctor{}, false
+	}
+	for _, doctor := range doctors {
+		if doctor.ID == id {
+			return doctor, true
+		}
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "doctor not found"})
+	return Doctor{}, false
+}
+
+// flagConflicts flags and returns the active bookings the blackout falls on.
+// Leave flags the bookings of every treatment the doctor offers, as only
+// staff know whether another doctor can see the patient.
+func (s *Server) flagConflicts(ctx context.Context, blackout Blackout, doctor Doctor) ([]Booking, error) {
+	bookings, err := s.Bookings.FindBetween(ctx, blackout.StartsAt, blackout.EndsAt)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	conflicts := []Booking{}
+	var ids []primitive.ObjectID
+	for _, booking := range bookings {
+		if !booking.occupiesSlot(now) {
+			continue
+		}
+		if blackout.Kind == BlackoutSlot && booking.Treatment != blackout.Treatment {
+			continue
+		}
+		if blackout.Kind == BlackoutLeave && !doctor.treats(booking.Treatment) {
+			continue
+		}
+		booking.Conflicts = append(booking.Conflicts, blackout.ID)
+		conflicts = append(conflicts, booking)
+		ids = append(ids, booking.ID)
+	}
+	if len(ids) == 0 {
+		return conflicts, nil
+	}
+	return conflicts, s.Bookings.FlagConflict(ctx, ids, blackout.ID)
+}
+
+// handleDeleteBlackout reopens the slots of a blackout and clears the flags
+// it put on bookings
+func (s *Server) handleDeleteBlackout(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid blackout ID"})
+		return
+	}
+
+	deleted, err := s.Blackouts.Delete(c, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete blackout"})
+		return
+	}
+	if err := s.Bookings.ClearConflict(c, id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to clear conflicting bookings"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"DeletedCount": deleted})
+}
+
+// handleGetConflictedBookings lists the active bookings that fall on a
+// blackout and still need to be rescheduled
+func (s *Server) handleGetConflictedBookings(c *gin.Context) {
+	bookings, err := s.Bookings.FindConflicted(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bookings"})
+		return
+	}
+
+	now := time.Now()
+	active := []Booking{}
+	for _, booking := range bookings {
+		if booking.occupiesSlot(now) {
+			active = append(active, booking)
+		}
+	}
+
+	c.JSON(http.StatusOK, s.viewBookings(active))
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// BookingStatus is the lifecycle state of a booking
+type BookingStatus string
+
+const (
+	StatusPending     BookingStatus = "pending" // slot held during checkout
+	StatusConfirmed   BookingStatus = "confirmed"
+	StatusPaid        BookingStatus = "paid"
+	StatusCancelled   BookingStatus = "cancelled"
+	StatusRescheduled BookingStatus = "rescheduled"
+	StatusCompleted   BookingStatus = "completed"
+	StatusNoShow      BookingStatus = "no_show"
+)
+
+// activeBookingStatuses are the statuses that keep a slot occupied
+var activeBookingStatuses = []BookingStatus{
+	StatusPending, StatusConfirmed, StatusPaid, StatusRescheduled, StatusCompleted, StatusNoShow,
+}
+
+// bookingTransitions lists the statuses each status may move to. Cancelled,
+// completed and no-show bookings are final.
+var bookingTransitions = map[BookingStatus][]BookingStatus{
+	StatusPending:     {StatusConfirmed, StatusPaid, StatusCancelled},
+	StatusConfirmed:   {StatusPaid, StatusCancelled, StatusRescheduled, StatusCompleted, StatusNoShow},
+	StatusPaid:        {StatusCancelled, StatusRescheduled, StatusCompleted, StatusNoShow},
+	StatusRescheduled: {StatusPaid, StatusCancelled, StatusRescheduled, StatusCompleted, StatusNoShow},
+}
+
+// canTransition reports whether a booking may move from one status to another
+func canTransition(from, to BookingStatus) bool {
+	for _, next := range bookingTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusChange records a single transition in the life of a booking
+type StatusChange struct {
+	From   BookingStatus `bson:"from"`
+	To     BookingStatus `bson:"to"`
+	At     time.Time     `bson:"at"`
+	By     string        `bson:"by,omitempty"`
+	Reason string        `bson:"reason,omitempty"`
+}
+
+// BookingChangeRequest is the body accepted by the cancel and reschedule endpoints
+type BookingChangeRequest struct {
+	AppointmentDate string `json:"appointmentDate"`
+	Slot            string `json:"slot"`
+	Reason          string `json:"reason"`
+}
+
+func (s *Server) handleCancelBooking(c *gin.Context) {
+	booking, actor, ok := s.loadAccessibleBooking(c, PermBookingsWriteAny)
+	if !ok {
+		return
+	}
+
+	var req BookingChangeRequest
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	change, ok := newStatusChange(c, booking, StatusCancelled, actor, req.Reason)
+	if !ok {
+		return
+	}
+	if err := s.Bookings.Transition(c, booking.ID, change); err != nil {
+		respondTransitionError(c, err)
+		return
+	}
+
+	booking.Status = StatusCancelled
+	booking.StatusHistory = append(booking.StatusHistory, change)
+	s.offerFreedSlot(c, booking)
+	if !booking.Paid {
+		c.JSON(http.StatusOK, gin.H{"booking": s.viewBooking(booking)})
+		return
+	}
+
+	// The booking stays cancelled even if the refund fails; staff can retry
+	// it through the refund endpoint
+	payment, err := s.refundCancelledBooking(c, booking, actor)
+	if err != nil {
+		log.Printf("Failed to refund cancelled booking %s: %v", booking.ID.Hex(), err)
+		c.JSON(http.StatusOK, gin.H{"booking": s.viewBooking(booking), "refundError": "refund failed, staff will follow up"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"booking": s.viewBooking(booking), "payment": payment, "netAmount": payment.netAmount()})
+}
+
+func (s *Server) handleRescheduleBooking(c *gin.Context) {
+	booking, actor, ok := s.loadAccessibleBooking(c, PermBookingsWriteAny)
+	if !ok {
+		return
+	}
+
+	var req BookingChangeRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.AppointmentDate == "" || req.Slot == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "appointmentDate and slot are required"})
+		return
+	}
+
+	moved := booking
+	moved.AppointmentDate = req.AppointmentDate
+	moved.Slot = req.Slot
+	moved.Conflicts = nil // the new slot is open, so no blackout falls on it
+	option, ok := s.findBookableOption(c, &moved)
+	if !ok {
+		return
+	}
+	if moved.AppointmentDate == booking.AppointmentDate && moved.Slot == booking.Slot {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "booking is already in that slot"})
+		return
+	}
+
+	reason := req.Reason
+	if reason == "" {
+		reason = fmt.Sprintf("moved from %s %s", booking.AppointmentDate, booking.Slot)
+	}
+	change, ok := newStatusChange(c, booking, StatusRescheduled, actor, reason)
+	if !ok {
+		return
+	}
+	err := s.reserveWithDoctor(c, option, &moved, func() error { return s.Bookings.Reschedule(c, booking.ID, moved, change) })
+	if err != nil {
+		if err == ErrSlotTaken {
+			s.respondSlotTaken(c, option, moved.AppointmentDate)
+		} else {
+			respondTransitionError(c, err)
+		}
+		return
+	}
+
+	moved.Status = StatusRescheduled
+	moved.StatusHistory = append(moved.StatusHistory, change)
+	s.offerFreedSlot(c, booking)
+	c.JSON(http.StatusOK, s.viewBooking(moved))
+}
+
+// BookingStatusRequest is the body accepted by the booking status endpoint
+type BookingStatusRequest struct {
+	Status BookingStatus `json:"status"` // completed or no_show
+	Reason string        `json:"reason"`
+}
+
+// handleSetBookingStatus lets staff record how an appointment went, once it
+// has started: the patient came and was seen, or did not show up
+func (s *Server) handleSetBookingStatus(c *gin.Context) {
+	booking, actor, ok := s.loadAccessibleBooking(c, PermBookingsWriteAny)
+	if !ok {
+		return
+	}
+
+	var req BookingStatusRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Status != StatusCompleted && req.Status != StatusNoShow {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("status must be %s or %s", StatusCompleted, StatusNoShow)})
+		return
+	}
+	start, err := booking.startTime(s.config.ClinicLocation)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to work out the appointment time"})
+		return
+	}
+	if time.Now().Before(start) {
+		c.JSON(http.StatusConflict, gin.H{"error": "the appointment has not started yet"})
+		return
+	}
+
+	change, ok := newStatusChange(c, booking, req.Status, actor, req.Reason)
+	if !ok {
+		return
+	}
+	if err := s.Bookings.Transition(c, booking.ID, change); err != nil {
+		respondTransitionError(c, err)
+		return
+	}
+
+	booking.Status = req.Status
+	booking.StatusHistory = append(booking.StatusHistory, change)
+	c.JSON(http.StatusOK, gin.H{"booking": s.viewBooking(booking)})
+}
+
+// loadAccessibleBooking fetches the booking named in the URL and checks that
+// the caller may access it (see authorizeBooking). It returns the booking and
+// the name of the caller.
+func (s *Server) loadAccessibleBooking(c *gin.Context, anyScope Permission) (Booking, string, bool) {
+	objID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid booking ID"})
+		return Booking{}, "", false
+	}
+
+	booking, err := s.Bookings.FindByID(c, objID)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch booking"})
+		}
+		return Booking{}, "", false
+	}
+
+	if !s.authorizeBooking(c, booking, anyScope) {
+		return Booking{}, "", false
+	}
+	return booking, callerName(c), true
+}
+
+// newStatusChange builds the transition of booking to status, replying with
+// 409 Conflict when the state machine does not allow it
+func newStatusChange(c *gin.Context, booking Booking, to BookingStatus, by, reason string) (StatusChange, bool) {
+	from := booking.currentStatus()
+	if !canTransition(from, to) {
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("cannot move a %s booking to %s", from, to)})
+		return StatusChange{}, false
+	}
+	return StatusChange{From: from, To: to, At: time.Now(), By: by, Reason: reason}, true
+}
+
+// respondTransitionError maps a store error from a status change to a response
+func respondTransitionError(c *gin.Context, err error) {
+	switch err {
+	case ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
+	case ErrStatusChanged:
+		c.JSON(http.StatusConflict, gin.H{"error": "booking was modified, please retry"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update booking"})
+	}
+}
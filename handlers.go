@@ -1,393 +1,438 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-func handleContactPost(c *gin.Context) {
+func (s *Server) handleContactPost(c *gin.Context) {
 	var contact Contact
 	if err := c.BindJSON(&contact); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	result, err := contactCollection.InsertOne(context.Background(), contact)
-	if err != nil {
+	if err := s.Contacts.Insert(c, &contact); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert contact"})
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"InsertedID": contact.ID})
+}
+
+func (s *Server) handleGetAppointmentOptions(c *gin.Context) {
+	s.respondAvailableOptions(c, c.Query("date"))
 }
 
-func handleGetAppointmentOptions(c *gin.Context) {
+// handleGetV2AppointmentOptions serves the same availability as
+// /appointmentOptions. It used to read the date from a "data" parameter,
+// which older clients may still send.
+func (s *Server) handleGetV2AppointmentOptions(c *gin.Context) {
 	date := c.Query("date")
 	if date == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "date query parameter is required"})
-		return
+		date = c.Query("data")
 	}
+	s.respondAvailableOptions(c, date)
+}
 
-	var options []AppointmentOption
-	cursor, err := appointmentOptionsCollection.Find(context.Background(), bson.M{})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment options"})
+// respondAvailableOptions replies with every option and the slots still free on date
+func (s *Server) respondAvailableOptions(c *gin.Context, date string) {
+	if date == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date query parameter is required"})
 		return
 	}
-	if err = cursor.All(context.Background(), &options); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode appointment options"})
+	date, err := normalizeAppointmentDate(date)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer cursor.Close(context.Background())
 
-	var alreadyBooked []Booking
-	bookingQuery := bson.M{"appointmentDate": date}
-	bookingCursor, err := bookingCollactions.Find(context.Background(), bookingQuery)
+	options, err := s.availableOptions(c, date)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bookings"})
-		return
-	}
-	if err = bookingCursor.All(context.Background(), &alreadyBooked); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode bookings"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment options"})
 		return
 	}
-	defer bookingCursor.Close(context.Background())
-
-	for i := range options {
-		var bookedSlots []string
-		for _, book := range alreadyBooked {
-			if book.Treatment == options[i].Name {
-				bookedSlots = append(bookedSlots, book.Slot)
-			}
-		}
-		var remainingSlots []string
-		for _, slot := range options[i].Slots {
-			found := false
-			for _, bookedSlot := range bookedSlots {
-				if slot == bookedSlot {
-					found = true
-					break
-				}
-			}
-			if !found {
-				remainingSlots = append(remainingSlots, slot)
-			}
-		}
-		options[i].Slots = remainingSlots
-		fmt.Println(date, options[i].Name, len(remainingSlots))
-	}
 
 	c.JSON(http.StatusOK, options)
 }
 
-func handleGetV2AppointmentOptions(c *gin.Context) {
-	date := c.Query("data")
-	if date == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "data query parameter is required"})
-		return
-	}
-
-	pipeline := []bson.M{
-		{"$lookup": bson.M{
-			"from":         "bookingCollaction",
-			"localField":   "name",
-			"foreignField": "treatment",
-			"pipeline": []bson.M{
-				{"$match": bson.M{
-					"$expr": bson.M{
-						"$eq": []interface{}{"$appointmentDate", date},
-					},
-				}},
-			},
-			"as": "booked",
-		}},
-		{"$project": bson.M{
-			"name":  1,
-			"slots": 1,
-			"price": 1,
-			"booked": bson.M{
-				"$map": bson.M{
-					"input": "<span class=\"math-inline\">booked",
-					"as":    "book",
-					"in":    "</span>$book.slot",
-				},
-			},
-		}},
-		{"$project": bson.M{
-			"name":  1,
-			"price": 1,
-			"slots": bson.M{
-				"$setDifference": []interface{}{"$slots", "$booked"},
-			},
-		}},
-	}
-
-	cursor, err := appointmentOptionsCollection.Aggregate(context.Background(), pipeline)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to aggregate appointment options"})
+// handleGetBookings lists the bookings of a patient, who must be the caller
+// unless they may read any booking
+func (s *Server) handleGetBookings(c *gin.Context) {
+	email := c.Query("email")
+	if !s.authorizeEmail(c, email, PermBookingsReadAny) {
 		return
 	}
-	defer cursor.Close(context.Background())
 
-	var options []AppointmentOption
-	if err = cursor.All(context.Background(), &options); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode aggregated options"})
+	bookings, err := s.Bookings.FindByEmail(c, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bookings"})
 		return
 	}
 
-	c.JSON(http.StatusOK, options)
+	c.JSON(http.StatusOK, s.viewBookings(bookings))
 }
 
-func handleGetBookings(c *gin.Context) {
-	email := c.Query("email")
-	decodedEmail, exists := c.Get("decodedEmail")
-	if !exists {
-		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized access"})
+func (s *Server) handleGetBookingByID(c *gin.Context) {
+	booking, _, ok := s.loadAccessibleBooking(c, PermBookingsReadAny)
+	if !ok {
 		return
 	}
 
-	if email != decodedEmail {
-		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden"})
-		return
-	}
+	c.JSON(http.StatusOK, s.viewBooking(booking))
+}
 
-	var bookings []Booking
-	cursor, err := bookingCollactions.Find(context.Background(), bson.M{"email": email})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bookings"})
+// handleGetDoctorBookings lists the bookings on a date for the treatment of
+// the calling doctor
+func (s *Server) handleGetDoctorBookings(c *gin.Context) {
+	date := c.Query("date")
+	if date == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "date query parameter is required"})
 		return
 	}
-	if err = cursor.All(context.Background(), &bookings); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode bookings"})
+	date, err := normalizeAppointmentDate(date)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	defer cursor.Close(context.Background())
 
-	c.JSON(http.StatusOK, bookings)
-}
-
-func handleGetBookingByID(c *gin.Context) {
-	idStr := c.Param("id")
-	objID, err := primitive.ObjectIDFromHex(idStr)
+	doctor, err := s.Doctors.FindByEmail(c, c.GetString("decodedEmail"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid booking ID"})
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "no doctor profile for this account"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find doctor"})
+		}
 		return
 	}
 
-	var booking Booking
-	err = bookingCollactions.FindOne(context.Background(), bson.M{"_id": objID}).Decode(&booking)
+	bookings, err := s.Bookings.FindByDate(c, date)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
-		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch booking"})
-		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bookings"})
 		return
 	}
+	treated := []Booking{}
+	for _, booking := range bookings {
+		if booking.Treatment == doctor.Specialty {
+			treated = append(treated, booking)
+		}
+	}
 
-	c.JSON(http.StatusOK, booking)
+	c.JSON(http.StatusOK, s.viewBookings(treated))
 }
 
-func handlePostBooking(c *gin.Context) {
+func (s *Server) handlePostBooking(c *gin.Context) {
 	var booking Booking
 	if err := c.BindJSON(&booking); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	query := bson.M{
-		"appointmentDate": booking.AppointmentDate,
-		"email":           booking.Email,
-		"treatment":       booking.Treatment,
+	if !s.authorizeEmail(c, booking.Email, PermBookingsWriteAny) {
+		return
+	}
+
+	booking.resetManagedFields()
+	booking.Status = StatusConfirmed
+
+	option, ok := s.findBookableOption(c, &booking)
+	if !ok {
+		return
 	}
+	booking.Price = option.Price
 
-	var existingBooking Booking
-	err := bookingCollactions.FindOne(context.Background(), query).Decode(&existingBooking)
-	if err == nil {
+	existing, err := s.Bookings.FindByPatient(c, booking.Email, booking.AppointmentDate, booking.Treatment)
+	if err == nil && !existing.holdExpired(time.Now()) {
 		message := fmt.Sprintf("You already have a booking on %s", booking.AppointmentDate)
 		c.JSON(http.StatusOK, gin.H{"acknowledged": false, "message": message})
 		return
-	} else if err != mongo.ErrNoDocuments {
+	} else if err != nil && err != ErrNotFound {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check existing booking"})
 		return
 	}
 
-	result, err := bookingCollactions.InsertOne(context.Background(), booking)
+	// The store enforces slot uniqueness, so a concurrent booking of the same
+	// slot loses here rather than producing a double booking
+	err = s.reserveWithDoctor(c, option, &booking, func() error { return s.Bookings.Insert(c, &booking) })
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert booking"})
+		if err == ErrSlotTaken {
+			s.respondSlotTaken(c, option, booking.AppointmentDate)
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert booking"})
+		}
 		return
 	}
 
 	// TODO: Implement sendBookingEmail function (requires external email service integration)
 	// sendBookingEmail(booking)
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"InsertedID": booking.ID})
 }
 
-func handleCreatePaymentIntent(c *gin.Context) {
-	var booking Booking
-	if err := c.BindJSON(&booking); err != nil {
+// findBookableOption looks up the treatment of booking with the slots it
+// offers on the booked date and checks that the requested slot is one of
+// them, replying with an error when it is not. It normalizes the date of the
+// booking and sets its times.
+func (s *Server) findBookableOption(c *gin.Context, booking *Booking) (AppointmentOption, bool) {
+	date, err := normalizeAppointmentDate(booking.AppointmentDate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return AppointmentOption{}, false
+	}
+	booking.AppointmentDate = date
+	option, err := s.AppointmentOptions.FindByName(c, booking.Treatment)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown treatment"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment option"})
+		}
+		return option, false
+	}
+	options := []AppointmentOption{option}
+	if err := s.scheduleOptions(c, options, booking.AppointmentDate); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch doctor schedules"})
+		return option, false
+	}
+	option = options[0]
+	if !hasSlot(option, booking.Slot) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid slot for treatment"})
+		return option, false
+	}
+	if err := booking.setTimes(s.config.ClinicLocation); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return option, false
+	}
+	return option, true
+}
+
+// respondSlotTaken replies 409 Conflict with the slots of option still free on date
+func (s *Server) respondSlotTaken(c *gin.Context, option AppointmentOption, date string) {
+	bookings, err := s.Bookings.FindByDate(c, date)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch bookings"})
 		return
 	}
+	options := []AppointmentOption{option}
+	removeBookedSlots(options, bookings)
 
-	price := booking.Price
-	amount := int64(price * 100)
-
-	// TODO: Integrate with Stripe to create a payment intent
-	// You'll need to install the Stripe Go library and use your secret key
-	// Example (replace with your actual Stripe API call):
-	// stripe.Key = os.Getenv("STRIPE_KEY")
-	// params := &stripe.PaymentIntentParams{
-	// 	Amount:   stripe.Int64(amount),
-	// 	Currency: stripe.String(stripe.CurrencyUSD),
-	// 	PaymentMethodTypes: stripe.StringSlice([]string{
-	// 		"card",
-	// 	}),
-	// }
-	// pi, err := paymentintent.New(params)
-	// if err != nil {
-	// 	c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create payment intent"})
-	// 	log.Printf("Stripe error: %v", err)
-	// 	return
-	// }
-	//
-	// c.JSON(http.StatusOK, gin.H{"clientSecret": pi.ClientSecret})
-
-	// Placeholder for demonstration without actual Stripe integration
-	fmt.Printf("Creating payment intent for amount: %d\n", amount)
-	clientSecret := "test_client_secret" // Placeholder
-	c.JSON(http.StatusOK, gin.H{"clientSecret": clientSecret})
+	c.JSON(http.StatusConflict, gin.H{
+		"error":          "slot is already booked",
+		"availableSlots": options[0].Slots,
+	})
 }
 
-func handlePostPayment(c *gin.Context) {
-	var payment Payment
-	if err := c.BindJSON(&payment); err != nil {
+// PaymentIntentRequest is the body accepted by /create-payment-intent. The
+// amount is never taken from the client; it comes from the booked treatment.
+type PaymentIntentRequest struct {
+	BookingID string `json:"bookingId"`
+}
+
+func (s *Server) handleCreatePaymentIntent(c *gin.Context) {
+	var req PaymentIntentRequest
+	if err := c.BindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	bookingID, err := primitive.ObjectIDFromHex(req.BookingID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid booking ID"})
+		return
+	}
+
+	booking, err := s.Bookings.FindByID(c, bookingID)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch booking"})
+		}
+		return
+	}
+	if !s.authorizeBooking(c, booking, PermBookingsWriteAny) {
+		return
+	}
+	if booking.Paid {
+		c.JSON(http.StatusConflict, gin.H{"error": "booking is already paid"})
+		return
+	}
+	if !booking.occupiesSlot(time.Now()) {
+		c.JSON(http.StatusConflict, gin.H{"error": "booking is no longer active"})
+		return
+	}
+
+	option, err := s.AppointmentOptions.FindByName(c, booking.Treatment)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment option"})
+		return
+	}
 
-	result, err := paymentCollection.InsertOne(context.Background(), payment)
+	currency := s.config.Currency
+	amount := toMinorUnits(option.Price, currency)
+	intent, err := s.provider.CreateIntent(c, IntentParams{
+		Amount:         amount,
+		Currency:       currency,
+		Metadata:       map[string]string{"bookingId": booking.ID.Hex()},
+		IdempotencyKey: fmt.Sprintf("intent-%s-%d-%s", booking.ID.Hex(), amount, currency),
+	})
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert payment"})
+		respondPaymentError(c, err, "failed to create payment intent")
 		return
 	}
 
-	// TODO: Update booking status to paid if needed
+	c.JSON(http.StatusOK, gin.H{"clientSecret": intent.ClientSecret, "amount": amount, "currency": currency})
+}
 
-	c.JSON(http.StatusOK, result)
+// respondPaymentError maps an error from the payment provider to a response
+func respondPaymentError(c *gin.Context, err error, message string) {
+	var paymentErr *PaymentError
+	switch {
+	case errors.As(err, &paymentErr):
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": message, "code": paymentErr.Code, "declineCode": paymentErr.DeclineCode})
+	case errors.Is(err, ErrProviderUnavailable):
+		log.Printf("Payment provider error: %v", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "payment provider unavailable, please retry"})
+	default:
+		log.Printf("Payment provider error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
 }
 
-func handleGetJWT(c *gin.Context) {
-	email := c.Query("email")
-	if email == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "email query parameter is required"})
+func (s *Server) handlePostPayment(c *gin.Context) {
+	var payment Payment
+	if err := c.BindJSON(&payment); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	payment.ID = primitive.NilObjectID
 
-	var user User
-	err := usersCollactions.FindOne(context.Background(), bson.M{"email": email}).Decode(&user)
+	bookingID, err := primitive.ObjectIDFromHex(payment.Booking.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid booking ID"})
+		return
+	}
+
+	booking, err := s.Bookings.FindByID(c, bookingID)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
-			c.JSON(http.StatusUnauthorized, gin.H{"accessToken": ""})
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "booking not found"})
 		} else {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch booking"})
 		}
 		return
 	}
+	if !s.authorizeBooking(c, booking, PermBookingsWriteAny) {
+		return
+	}
 
-	expirationTime := time.Now().Add(2 * 24 * time.Hour) // 2 days
-	claims := &Claims{
-		Email: email,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-		},
+	// The charge has to exist at the provider for it to be refundable later,
+	// and has to have been made for this booking
+	if payment.TransactionID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "transactionId is required"})
+		return
 	}
+	intent, err := s.settleIntent(c, payment.TransactionID, payment.PaymentMethodId)
+	if err != nil {
+		respondPaymentError(c, err, "payment failed")
+		return
+	}
+	if intent.Metadata["bookingId"] != booking.ID.Hex() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "payment intent was not created for this booking"})
+		return
+	}
+	if intent.Status != IntentSucceeded {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": "payment is not complete", "status": intent.Status, "clientSecret": intent.ClientSecret})
+		return
+	}
+	payment.Amount = intent.Amount
+	payment.Currency = strings.ToLower(intent.Currency)
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(jwtSecret))
+	err = s.recordPayment(c, booking, &payment)
+	if err == errHoldExpired {
+		// The money was taken already, so the slot is reserved again or the charge refunded
+		err = s.recordLateCharge(c, booking, &payment)
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate JWT"})
+		switch {
+		case err == ErrDuplicatePayment:
+			c.JSON(http.StatusConflict, gin.H{"error": "booking is already paid"})
+		case err == errHoldExpired, err == errChargeRefunded:
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		case err == errAmountMismatch:
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, errInvalidTransition):
+			c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		default:
+			respondTransitionError(c, err)
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"accessToken": tokenString})
+	c.JSON(http.StatusOK, gin.H{"InsertedID": payment.ID})
 }
 
-func handleGetAppointmentSpecialty(c *gin.Context) {
-	cursor, err := appointmentOptionsCollection.Find(context.Background(), bson.M{}, options.Find().SetProjection(bson.M{"name": 1, "_id": 0}))
+func (s *Server) handleGetAppointmentSpecialty(c *gin.Context) {
+	options, err := s.AppointmentOptions.List(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment specialties"})
 		return
 	}
-	defer cursor.Close(context.Background())
 
 	var specialties []map[string]string
-	for cursor.Next(context.Background()) {
-		var option AppointmentOption
-		if err := cursor.Decode(&option); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode specialty"})
-			return
-		}
+	for _, option := range options {
 		specialties = append(specialties, map[string]string{"name": option.Name})
 	}
 
-	if err := cursor.Err(); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "cursor error"})
-		return
-	}
-
 	c.JSON(http.StatusOK, specialties)
 }
 
-func handleGetUsers(c *gin.Context) {
-	cursor, err := usersCollactions.Find(context.Background(), bson.M{})
+func (s *Server) handleGetUsers(c *gin.Context) {
+	users, err := s.Users.List(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch users"})
 		return
 	}
-	defer cursor.Close(context.Background())
-
-	var users []User
-	if err = cursor.All(context.Background(), &users); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode users"})
-		return
-	}
 
 	c.JSON(http.StatusOK, users)
 }
 
-func handlePostUser(c *gin.Context) {
+func (s *Server) handlePostUser(c *gin.Context) {
 	var user User
 	if err := c.BindJSON(&user); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	result, err := usersCollactions.InsertOne(context.Background(), user)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert user"})
+	// Roles are only ever granted by staff
+	user.ID = primitive.NilObjectID
+	user.Roles = nil
+	if err := s.Users.Insert(c, &user); err != nil {
+		if err == ErrDuplicateEmail {
+			c.JSON(http.StatusConflict, gin.H{"error": "an account with this email already exists"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert user"})
+		}
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"InsertedID": user.ID})
 }
 
-func handleGetUserAdminByEmail(c *gin.Context) {
+func (s *Server) handleGetUserAdminByEmail(c *gin.Context) {
 	email := c.Param("email")
-	var user User
-	err := usersCollactions.FindOne(context.Background(), bson.M{"email": email}).Decode(&user)
+	if !s.authorizeEmail(c, email, PermUsersRead) {
+		return
+	}
+	user, err := s.Users.FindByEmail(c, email)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == ErrNotFound {
 			c.JSON(http.StatusOK, gin.H{"isAdmin": false})
 		} else {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
@@ -395,48 +440,25 @@ func handleGetUserAdminByEmail(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"isAdmin": user.Role == "admin"})
+	c.JSON(http.StatusOK, gin.H{"isAdmin": user.hasRole(RoleAdmin) || user.hasRole(RoleSuperAdmin)})
 }
 
-func handlePutUserAdminByID(c *gin.Context) {
-	idStr := c.Param("id")
-	objID, err := primitive.ObjectIDFromHex(idStr)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
-		return
-	}
-
-	filter := bson.M{"_id": objID}
-	update := bson.M{"$set": bson.M{"role": "admin"}}
-	options := options.Update().SetUpsert(true)
-
-	result, err := usersCollactions.UpdateOne(context.Background(), filter, update, options)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user role"})
-		return
-	}
-
-	c.JSON(http.StatusOK, result)
+// handlePutUserAdminByID makes an existing user an admin
+func (s *Server) handlePutUserAdminByID(c *gin.Context) {
+	s.grantRole(c, RoleAdmin)
 }
 
-func handleGetDoctors(c *gin.Context) {
-	cursor, err := doctorsCollactions.Find(context.Background(), bson.M{})
+func (s *Server) handleGetDoctors(c *gin.Context) {
+	doctors, err := s.Doctors.List(c)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch doctors"})
 		return
 	}
-	defer cursor.Close(context.Background())
-
-	var doctors []Doctor
-	if err = cursor.All(context.Background(), &doctors); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to decode doctors"})
-		return
-	}
 
 	c.JSON(http.StatusOK, doctors)
 }
 
-func handleDeleteDoctorByID(c *gin.Context) {
+func (s *Server) handleDeleteDoctorByID(c *gin.Context) {
 	idStr := c.Param("id")
 	objID, err := primitive.ObjectIDFromHex(idStr)
 	if err != nil {
@@ -444,28 +466,29 @@ func handleDeleteDoctorByID(c *gin.Context) {
 		return
 	}
 
-	filter := bson.M{"_id": objID}
-	result, err := doctorsCollactions.DeleteOne(context.Background(), filter)
+	deleted, err := s.Doctors.Delete(c, objID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete doctor"})
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"DeletedCount": deleted})
 }
 
-func handlePostDoctor(c *gin.Context) {
+func (s *Server) handlePostDoctor(c *gin.Context) {
 	var doctor Doctor
 	if err := c.BindJSON(&doctor); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !s.checkSchedules(c, doctor.Schedules) {
+		return
+	}
 
-	result, err := doctorsCollactions.InsertOne(context.Background(), doctor)
-	if err != nil {
+	if err := s.Doctors.Insert(c, &doctor); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert doctor"})
 		return
 	}
 
-	c.JSON(http.StatusOK, result)
+	c.JSON(http.StatusOK, gin.H{"InsertedID": doctor.ID})
 }
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestPostBooking(t *testing.T) {
+	tests := []struct {
+		name    string
+		caller  string // email logged in as, "" for no token
+		booking bookingRequest
+		status  int
+	}{
+		{"books a free slot", "p@x.com", bookingRequest{testDate, "Teeth Cleaning", testSlots[0], "p@x.com"}, http.StatusOK},
+		{"accepts ISO dates", "p@x.com", bookingRequest{"2099-01-05", "Teeth Cleaning", testSlots[1], "p@x.com"}, http.StatusOK},
+		{"rejects unknown treatments", "p@x.com", bookingRequest{testDate, "Root Canal", testSlots[0], "p@x.com"}, http.StatusBadRequest},
+		{"rejects slots the treatment does not offer", "p@x.com", bookingRequest{testDate, "Teeth Cleaning", "11.00 PM - 11.30 PM", "p@x.com"}, http.StatusBadRequest},
+		{"rejects unreadable dates", "p@x.com", bookingRequest{"someday", "Teeth Cleaning", testSlots[0], "p@x.com"}, http.StatusBadRequest},
+		{"rejects booking for someone else", "p@x.com", bookingRequest{testDate, "Teeth Cleaning", testSlots[0], "q@x.com"}, http.StatusForbidden},
+		{"requires a login", "", bookingRequest{testDate, "Teeth Cleaning", testSlots[0], "p@x.com"}, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			token := ""
+			if tt.caller != "" {
+				token = ts.login(tt.caller)
+			}
+			expectStatus(t, ts.do("POST", "/bookings", token, tt.booking), tt.status)
+		})
+	}
+}
+
+// bookingRequest is the part of a booking request the tests vary
+type bookingRequest struct {
+	AppointmentDate string `json:"appointmentDate"`
+	Treatment       string `json:"treatment"`
+	Slot            string `json:"slot"`
+	Email           string `json:"email"`
+}
+
+func TestPostBookingSetsPriceAndStatus(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.login("p@x.com")
+	body := map[string]interface{}{
+		"appointmentDate": testDate, "treatment": "Teeth Cleaning", "slot": testSlots[0],
+		"email": "p@x.com", "price": 1, "status": "paid", "paid": true,
+	}
+	rec := ts.do("POST", "/bookings", token, body)
+	expectStatus(t, rec, http.StatusOK)
+
+	bookings, err := ts.Bookings.FindByEmail(context.Background(), "p@x.com")
+	if err != nil || len(bookings) != 1 {
+		t.Fatalf("got %v, %v", bookings, err)
+	}
+	got := bookings[0]
+	if got.Price != 20 || got.Status != StatusConfirmed || got.Paid {
+		t.Errorf("client-set fields were kept: price %v, status %s, paid %v", got.Price, got.Status, got.Paid)
+	}
+	if got.StartsAt == nil || got.StartsAt.Hour() != 8 {
+		t.Errorf("got start %v, want 08:00 UTC", got.StartsAt)
+	}
+}
+
+func TestPostBookingOncePerDay(t *testing.T) {
+	ts := newTestServer(t)
+	token := ts.login("p@x.com")
+	expectStatus(t, ts.do("POST", "/bookings", token, bookingRequest{testDate, "Teeth Cleaning", testSlots[0], "p@x.com"}), http.StatusOK)
+
+	rec := ts.do("POST", "/bookings", token, bookingRequest{testDate, "Teeth Cleaning", testSlots[1], "p@x.com"})
+	expectStatus(t, rec, http.StatusOK)
+	if body := decodeJSON[map[string]interface{}](t, rec); body["acknowledged"] != false {
+		t.Errorf("second booking on the same day was accepted: %v", body)
+	}
+}
+
+func TestGetBookings(t *testing.T) {
+	ts := newTestServer(t)
+	ts.book("p@x.com", testSlots[0])
+	ts.book("q@x.com", testSlots[1])
+
+	tests := []struct {
+		name   string
+		token  string
+		query  string
+		status int
+		count  int
+	}{
+		{"patients see their own bookings", ts.login("p@x.com"), "p@x.com", http.StatusOK, 1},
+		{"patients cannot see other bookings", ts.login("p@x.com"), "q@x.com", http.StatusForbidden, 0},
+		{"receptionists see any bookings", ts.login("desk@x.com", RoleReceptionist), "q@x.com", http.StatusOK, 1},
+		{"a login is required", "", "p@x.com", http.StatusUnauthorized, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ts.do("GET", "/bookings?email="+tt.query, tt.token, nil)
+			expectStatus(t, rec, tt.status)
+			if tt.status != http.StatusOK {
+				return
+			}
+			views := decodeJSON[[]BookingView](t, rec)
+			if len(views) != tt.count {
+				t.Fatalf("got %d bookings, want %d", len(views), tt.count)
+			}
+			if views[0].TimeZone != "UTC" || views[0].LocalStartsAt == nil {
+				t.Errorf("booking view lacks local times: %+v", views[0])
+			}
+		})
+	}
+}
+
+func TestGetAppointmentOptionsHidesBookedSlots(t *testing.T) {
+	ts := newTestServer(t)
+	ts.book("p@x.com", testSlots[1])
+
+	for _, path := range []string{
+		"/appointmentOptions?date=" + "Jan%205,%202099",
+		"/v2/appointmentOptions?date=2099-01-05",
+		"/v2/appointmentOptions?data=Jan%205,%202099",
+	} {
+		t.Run(path, func(t *testing.T) {
+			rec := ts.do("GET", path, "", nil)
+			expectStatus(t, rec, http.StatusOK)
+			options := decodeJSON[[]AppointmentOption](t, rec)
+			if len(options) != 1 {
+				t.Fatalf("got %d options, want 1", len(options))
+			}
+			want := []string{testSlots[0], testSlots[2]}
+			if len(options[0].Slots) != len(want) || options[0].Slots[0] != want[0] || options[0].Slots[1] != want[1] {
+				t.Errorf("got slots %v, want %v", options[0].Slots, want)
+			}
+		})
+	}
+
+	expectStatus(t, ts.do("GET", "/appointmentOptions", "", nil), http.StatusBadRequest)
+}
+
+func TestPostContact(t *testing.T) {
+	ts := newTestServer(t)
+	rec := ts.do("POST", "/contact", "", Contact{Name: "Pat", Email: "p@x.com", Message: "hello"})
+	expectStatus(t, rec, http.StatusOK)
+	expectStatus(t, ts.do("POST", "/contact", "", "{"), http.StatusBadRequest)
+}
+
+func TestPostBookingSlotTaken(t *testing.T) {
+	ts := newTestServer(t)
+	ts.book("q@x.com", testSlots[0])
+
+	rec := ts.do("POST", "/bookings", ts.login("p@x.com"), bookingRequest{testDate, "Teeth Cleaning", testSlots[0], "p@x.com"})
+	expectStatus(t, rec, http.StatusConflict)
+	body := decodeJSON[struct{ AvailableSlots []string }](t, rec)
+	if len(body.AvailableSlots) != 2 || body.AvailableSlots[0] != testSlots[1] {
+		t.Errorf("got available slots %v, want the two free ones", body.AvailableSlots)
+	}
+}
+
+func TestPostBookingRaceBooksSlotOnce(t *testing.T) {
+	ts := newTestServer(t)
+	const patients = 8
+	tokens := make([]string, patients)
+	for i := range tokens {
+		tokens[i] = ts.login(fmt.Sprintf("p%d@x.com", i))
+	}
+
+	codes := make(chan int, patients)
+	var wg sync.WaitGroup
+	for i, token := range tokens {
+		wg.Add(1)
+		go func(email, token string) {
+			defer wg.Done()
+			codes <- ts.do("POST", "/bookings", token, bookingRequest{testDate, "Teeth Cleaning", testSlots[0], email}).Code
+		}(fmt.Sprintf("p%d@x.com", i), token)
+	}
+	wg.Wait()
+	close(codes)
+
+	won := 0
+	for code := range codes {
+		switch code {
+		case http.StatusOK:
+			won++
+		case http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %d", code)
+		}
+	}
+	if won != 1 {
+		t.Errorf("%d patients booked the same slot, want 1", won)
+	}
+}
+
+func TestPostBookingIgnoresManagedFields(t *testing.T) {
+	ts := newTestServer(t)
+	taken := ts.book("q@x.com", testSlots[0])
+	blackout := primitive.NewObjectID()
+
+	// Reusing the ID of another booking must not clash with it, and a client
+	// cannot flag its own booking as conflicting with a blackout
+	body := map[string]interface{}{
+		"ID": taken.ID, "Conflicts": []primitive.ObjectID{blackout},
+		"appointmentDate": testDate, "treatment": "Teeth Cleaning", "slot": testSlots[1], "email": "p@x.com",
+	}
+	rec := ts.do("POST", "/bookings", ts.login("p@x.com"), body)
+	expectStatus(t, rec, http.StatusOK)
+	if id := decodeJSON[struct{ InsertedID primitive.ObjectID }](t, rec).InsertedID; id == taken.ID {
+		t.Errorf("the client-supplied ID was kept")
+	}
+
+	conflicted, err := ts.Bookings.FindConflicted(context.Background())
+	if err != nil || len(conflicted) != 0 {
+		t.Errorf("client-supplied conflicts were stored: %v, %v", conflicted, err)
+	}
+	if bookings, _ := ts.Bookings.FindByDate(context.Background(), testDate); len(bookings) != 2 {
+		t.Errorf("got %d bookings, want 2", len(bookings))
+	}
+}
+
+func TestGetBookingByIDShowsPayment(t *testing.T) {
+	ts := newTestServer(t)
+	booking := ts.book("p@x.com", testSlots[0])
+	payment := Payment{TransactionID: "pi_test", Amount: 2000, Currency: "usd", Booking: paymentBookingFrom(booking)}
+	change := StatusChange{From: StatusConfirmed, To: StatusPaid, At: time.Now(), By: "p@x.com"}
+	if err := ts.Payments.Record(context.Background(), &payment, change); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"the patient", ts.login("p@x.com"), http.StatusOK},
+		{"a receptionist", ts.login("desk@x.com", RoleReceptionist), http.StatusOK},
+		{"another patient", ts.login("q@x.com"), http.StatusForbidden},
+		{"no login", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ts.do("GET", "/bookings/"+booking.ID.Hex(), tt.token, nil)
+			expectStatus(t, rec, tt.status)
+			if tt.status != http.StatusOK {
+				return
+			}
+			body := decodeJSON[map[string]interface{}](t, rec)
+			if body["paid"] != true || body["transactionId"] != "pi_test" {
+				t.Errorf("got paid %v and transactionId %v", body["paid"], body["transactionId"])
+			}
+		})
+	}
+}
+
+func TestPostPaymentAfterHoldLapsed(t *testing.T) {
+	ts := newTestServer(t)
+	booking := ts.hold("p@x.com", testSlots[0], -time.Minute)
+	intent := ts.charge(booking)
+
+	// The charge went through after the hold lapsed, but nobody took the slot
+	body := Payment{TransactionID: intent.ID, Booking: PaymentBooking{ID: booking.ID.Hex()}}
+	expectStatus(t, ts.do("POST", "/payments", ts.login("p@x.com"), body), http.StatusOK)
+	if got, _ := ts.Bookings.FindByID(context.Background(), booking.ID); !got.Paid || got.HoldExpiresAt != nil {
+		t.Errorf("booking was not reserved again and paid: %+v", got)
+	}
+}
+
+func TestPostPayment(t *testing.T) {
+	tests := []struct {
+		name    string
+		payment func(ts *testServer, booking Booking) Payment
+		status  int
+	}{
+		{"a charge for the booking", func(ts *testServer, booking Booking) Payment {
+			return Payment{TransactionID: ts.charge(booking).ID}
+		}, http.StatusOK},
+		{"no charge", func(ts *testServer, booking Booking) Payment {
+			return Payment{}
+		}, http.StatusBadRequest},
+		{"an unknown charge", func(ts *testServer, booking Booking) Payment {
+			return Payment{TransactionID: "pi_unknown"}
+		}, http.StatusPaymentRequired},
+		{"a charge for another booking", func(ts *testServer, booking Booking) Payment {
+			return Payment{TransactionID: ts.charge(ts.hold("q@x.com", testSlots[1], time.Minute)).ID}
+		}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			booking := ts.hold("p@x.com", testSlots[0], time.Minute)
+			payment := tt.payment(ts, booking)
+			payment.Booking = PaymentBooking{ID: booking.ID.Hex()}
+			expectStatus(t, ts.do("POST", "/payments", ts.login("p@x.com"), payment), tt.status)
+		})
+	}
+}
+
+func TestPostPaymentIgnoresRefunds(t *testing.T) {
+	ts := newTestServer(t)
+	booking := ts.hold("p@x.com", testSlots[0], time.Minute)
+	payment := Payment{
+		TransactionID: ts.charge(booking).ID,
+		Refunds:       []RefundRecord{{ID: "re_forged", Amount: 1000}},
+		Booking:       PaymentBooking{ID: booking.ID.Hex()},
+	}
+	expectStatus(t, ts.do("POST", "/payments", ts.login("p@x.com"), payment), http.StatusOK)
+
+	stored, err := ts.Payments.FindByBooking(context.Background(), booking.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored.Refunds) != 0 || stored.AmountRefunded != 0 {
+		t.Fatalf("stored payment has refunds %+v, refunded %d; want none", stored.Refunds, stored.AmountRefunded)
+	}
+}
+
+func TestRefundBooking(t *testing.T) {
+	tests := []struct {
+		name   string
+		amount int64
+		status int
+	}{
+		{"what is left", 0, http.StatusOK},
+		{"part of the payment", 500, http.StatusOK},
+		{"more than the payment", 5000, http.StatusBadRequest},
+		{"a negative amount", -500, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			booking := ts.hold("p@x.com", testSlots[0], time.Minute)
+			payment := Payment{TransactionID: ts.charge(booking).ID, Booking: PaymentBooking{ID: booking.ID.Hex()}}
+			expectStatus(t, ts.do("POST", "/payments", ts.login("p@x.com"), payment), http.StatusOK)
+
+			admin := ts.login("admin@x.com", RoleAdmin)
+			expectStatus(t, ts.do("POST", "/bookings/"+booking.ID.Hex()+"/refund", admin, RefundRequest{Amount: tt.amount}), tt.status)
+		})
+	}
+}
+
+func TestSetBookingStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		date   string
+		status BookingStatus
+		want   int
+	}{
+		{"completed", "Jan 5, 2020", StatusCompleted, http.StatusOK},
+		{"no-show", "Jan 5, 2020", StatusNoShow, http.StatusOK},
+		{"another status", "Jan 5, 2020", StatusCancelled, http.StatusBadRequest},
+		{"before the appointment", testDate, StatusCompleted, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			booking := Booking{AppointmentDate: tt.date, Treatment: "Teeth Cleaning", Slot: testSlots[0], Email: "p@x.com", Status: StatusConfirmed}
+			if err := booking.setTimes(ts.config.ClinicLocation); err != nil {
+				t.Fatal(err)
+			}
+			if err := ts.Bookings.Insert(context.Background(), &booking); err != nil {
+				t.Fatal(err)
+			}
+			path := "/bookings/" + booking.ID.Hex() + "/status"
+			req := BookingStatusRequest{Status: tt.status}
+
+			expectStatus(t, ts.do("POST", path, ts.login("p@x.com"), req), http.StatusForbidden)
+			desk := ts.login("desk@x.com", RoleReceptionist)
+			expectStatus(t, ts.do("POST", path, desk, req), tt.want)
+			if tt.want != http.StatusOK {
+				return
+			}
+			got, _ := ts.Bookings.FindByID(context.Background(), booking.ID)
+			if got.currentStatus() != tt.status {
+				t.Errorf("got status %s, want %s", got.currentStatus(), tt.status)
+			}
+			// Completed and no-show bookings are final
+			expectStatus(t, ts.do("POST", path, desk, req), http.StatusConflict)
+		})
+	}
+}
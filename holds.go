@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handlePostHold reserves a slot for the configured hold TTL while the
+// patient goes through checkout
+func (s *Server) handlePostHold(c *gin.Context) {
+	var booking Booking
+	if err := c.BindJSON(&booking); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !s.authorizeEmail(c, booking.Email, PermBookingsWriteAny) {
+		return
+	}
+
+	hold, ok := s.placeHold(c, booking)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"holdId": hold.ID, "expiresAt": hold.HoldExpiresAt})
+}
+
+// placeHold stores booking as a temporary hold on its slot, replying with an
+// error when the slot cannot be held. A patient asking again for a slot they
+// already hold gets their existing hold back.
+func (s *Server) placeHold(c *gin.Context, booking Booking) (Booking, bool) {
+	option, ok := s.findBookableOption(c, &booking)
+	if !ok {
+		return booking, false
+	}
+
+	now := time.Now()
+	existing, err := s.Bookings.FindByPatient(c, booking.Email, booking.AppointmentDate, booking.Treatment)
+	if err == nil && !existing.holdExpired(now) {
+		if existing.HoldExpiresAt != nil && existing.Slot == booking.Slot {
+			return existing, true
+		}
+		message := fmt.Sprintf("You already have a booking on %s", booking.AppointmentDate)
+		c.JSON(http.StatusConflict, gin.H{"error": message})
+		return booking, false
+	} else if err != nil && err != ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to check existing booking"})
+		return booking, false
+	}
+
+	expiresAt := now.Add(s.config.HoldTTL)
+	booking.resetManagedFields()
+	booking.Price = option.Price
+	booking.HoldExpiresAt = &expiresAt
+	booking.Status = StatusPending
+	err = s.reserveWithDoctor(c, option, &booking, func() error { return s.Bookings.Insert(c, &booking) })
+	if err != nil {
+		if err == ErrSlotTaken {
+			s.respondSlotTaken(c, option, booking.AppointmentDate)
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hold slot"})
+		}
+		return booking, false
+	}
+	return booking, true
+}
+
+// sweepExpiredHolds periodically releases holds whose checkout was abandoned
+// until ctx is cancelled
+func (s *Server) sweepExpiredHolds(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			released, err := s.Bookings.DeleteExpiredHolds(ctx, now)
+			if err != nil {
+				log.Printf("Failed to release expired holds: %v", err)
+			} else if released > 0 {
+				log.Printf("Released %d expired slot holds", released)
+			}
+		}
+	}
+}
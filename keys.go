@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// SigningKey is one of the keys access tokens are signed with. Keys are
+// rotated by adding a key with a later ActiveFrom: it is published in the JWKS
+// right away and starts signing once active, while the previous key keeps
+// verifying the tokens it signed until it is retired.
+type SigningKey struct {
+	ID         string
+	Algorithm  string    // RS256 or ES256
+	ActiveFrom time.Time // when the key starts signing; zero means immediately
+	RetireAt   time.Time // when tokens signed with the key stop verifying; zero means never
+	private    crypto.Signer
+}
+
+// method returns the JWT signing method of the key
+func (k SigningKey) method() jwt.SigningMethod {
+	return jwt.GetSigningMethod(k.Algorithm)
+}
+
+func (k SigningKey) retired(now time.Time) bool {
+	return !k.RetireAt.IsZero() && !now.Before(k.RetireAt)
+}
+
+// Keyring holds the access token signing keys, ordered by ActiveFrom
+type Keyring struct {
+	keys []SigningKey
+}
+
+// newKeyring checks keys and orders them for rotation
+func newKeyring(keys []SigningKey) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys")
+	}
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if key.ID == "" || seen[key.ID] {
+			return nil, fmt.Errorf("signing key IDs must be unique and non-empty, got %q", key.ID)
+		}
+		seen[key.ID] = true
+		if err := checkKeyAlgorithm(key.Algorithm, key.private); err != nil {
+			return nil, fmt.Errorf("signing key %s: %v", key.ID, err)
+		}
+	}
+	keys = append([]SigningKey(nil), keys...)
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].ActiveFrom.Before(keys[j].ActiveFrom) })
+	return &Keyring{keys: keys}, nil
+}
+
+// checkKeyAlgorithm reports whether private can sign with alg
+func checkKeyAlgorithm(alg string, private crypto.Signer) error {
+	switch key := private.(type) {
+	case *ecdsa.PrivateKey:
+		if alg != jwt.SigningMethodES256.Alg() || key.Curve != elliptic.P256() {
+			return fmt.Errorf("%s needs a P-256 key", jwt.SigningMethodES256.Alg())
+		}
+	case *rsa.PrivateKey:
+		if alg != jwt.SigningMethodRS256.Alg() || key.N.BitLen() < 2048 {
+			return fmt.Errorf("%s needs an RSA key of at least 2048 bits", jwt.SigningMethodRS256.Alg())
+		}
+	default:
+		return fmt.Errorf("unsupported key type %T (expected ES256 or RS256)", private)
+	}
+	return nil
+}
+
+// signingKey returns the most recently activated key at now
+func (r *Keyring) signingKey(now time.Time) (SigningKey, error) {
+	for i := len(r.keys) - 1; i >= 0; i-- {
+		key := r.keys[i]
+		if !key.ActiveFrom.After(now) && !key.retired(now) {
+			return key, nil
+		}
+	}
+	return SigningKey{}, errors.New("no active signing key")
+}
+
+// verificationKey returns the unretired key with the given ID
+func (r *Keyring) verificationKey(kid string, now time.Time) (SigningKey, bool) {
+	for _, key := range r.keys {
+		if key.ID == kid && !key.retired(now) {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// algorithms lists the signing algorithms tokens may use
+func (r *Keyring) algorithms() []string {
+	var algs []string
+	seen := make(map[string]bool)
+	for _, key := range r.keys {
+		if !seen[key.Algorithm] {
+			seen[key.Algorithm] = true
+			algs = append(algs, key.Algorithm)
+		}
+	}
+	return algs
+}
+
+// keyringFileEntry describes a signing key in the JWT_KEYS_FILE
+type keyringFileEntry struct {
+	ID             string    `json:"kid"`
+	Algorithm      string    `json:"alg"`
+	PrivateKeyFile string    `json:"privateKeyFile"` // PEM, relative to the keys file
+	ActiveFrom     time.Time `json:"activeFrom"`
+	RetireAt       time.Time `json:"retireAt"`
+}
+
+// loadKeyring reads the signing keys listed in a JSON keys file
+func loadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []keyringFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, err
+	}
+
+	var keys []SigningKey
+	for _, entry := range entries {
+		keyPath := entry.PrivateKeyFile
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(path), keyPath)
+		}
+		pemData, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %v", entry.ID, err)
+		}
+		private, err := parsePrivateKeyPEM(pemData)
+		if err != nil {
+			return nil, fmt.Errorf("signing key %s: %v", entry.ID, err)
+		}
+		keys = append(keys, SigningKey{
+			ID:         entry.ID,
+			Algorithm:  entry.Algorithm,
+			ActiveFrom: entry.ActiveFrom,
+			RetireAt:   entry.RetireAt,
+			private:    private,
+		})
+	}
+	return newKeyring(keys)
+}
+
+// parsePrivateKeyPEM reads a PKCS#8, SEC 1 (EC) or PKCS#1 (RSA) private key
+func parsePrivateKeyPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+// generatePrivateKeyPEM creates a new private key for alg in PKCS#8 PEM
+func generatePrivateKeyPEM(alg string) ([]byte, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case jwt.SigningMethodES256.Alg():
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case jwt.SigningMethodRS256.Alg():
+		private, err = rsa.GenerateKey(rand.Reader, 3072)
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q (expected ES256 or RS256)", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), nil
+}
+
+// ephemeralKeyring returns a keyring with a single freshly generated ES256
+// key. Tokens it signs stop verifying when the process exits.
+func ephemeralKeyring() (*Keyring, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	return newKeyring([]SigningKey{{
+		ID:        "ephemeral-" + hex.EncodeToString(id),
+		Algorithm: jwt.SigningMethodES256.Alg(),
+		private:   private,
+	}})
+}
+
+// jwk is the public part of a signing key in JSON Web Key form (RFC 7517)
+type jwk struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	Modulus   string `json:"n,omitempty"`
+	Exponent  string `json:"e,omitempty"`
+}
+
+func publicJWK(key SigningKey) jwk {
+	b64 := base64.RawURLEncoding.EncodeToString
+	result := jwk{KeyID: key.ID, Use: "sig", Algorithm: key.Algorithm}
+	switch public := key.private.Public().(type) {
+	case *ecdsa.PublicKey:
+		size := (public.Curve.Params().BitSize + 7) / 8
+		result.KeyType = "EC"
+		result.Curve = public.Curve.Params().Name
+		result.X = b64(public.X.FillBytes(make([]byte, size)))
+		result.Y = b64(public.Y.FillBytes(make([]byte, size)))
+	case *rsa.PublicKey:
+		result.KeyType = "RSA"
+		result.Modulus = b64(public.N.Bytes())
+		result.Exponent = b64(big.NewInt(int64(public.E)).Bytes())
+	}
+	return result
+}
+
+// handleGetJWKS publishes the public keys that verify our access tokens,
+// including keys scheduled to start signing later
+func (s *Server) handleGetJWKS(c *gin.Context) {
+	now := time.Now()
+	keys := []jwk{}
+	for _, key := range s.config.SigningKeys.keys {
+		if !key.retired(now) {
+			keys = append(keys, publicJWK(key))
+		}
+	}
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
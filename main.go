@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -13,23 +16,35 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
-// Global variables for database collections (will be initialized later)
-var (
-	appointmentOptionsCollection *mongo.Collection
-	bookingCollactions           *mongo.Collection
-	usersCollactions             *mongo.Collection
-	doctorsCollactions           *mongo.Collection
-	paymentCollection            *mongo.Collection
-	contactCollection            *mongo.Collection
-	jwtSecret                    string // For JWT secret key
-	mongoClient                  *mongo.Client
-)
-
 func main() {
-	// Load environment variables
+	// `go run . sign-webhook <payload.json>` prints a signature header for a
+	// local webhook payload, signed with PAYMENT_WEBHOOK_SECRET
+	if len(os.Args) == 3 && os.Args[1] == "sign-webhook" {
+		godotenv.Load()
+		payload, err := os.ReadFile(os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to read payload: %v", err)
+		}
+		fmt.Printf("%s: %s\n", webhookSignatureHeader, webhookSignature(os.Getenv("PAYMENT_WEBHOOK_SECRET"), time.Now(), payload))
+		return
+	}
+
+	// `go run . generate-signing-key <ES256|RS256>` prints a new private key
+	// in PEM for the JWT_KEYS_FILE
+	if len(os.Args) == 3 && os.Args[1] == "generate-signing-key" {
+		key, err := generatePrivateKeyPEM(os.Args[2])
+		if err != nil {
+			log.Fatalf("Failed to generate key: %v", err)
+		}
+		os.Stdout.Write(key)
+		return
+	}
+
+	// Load environment variables; a missing .env file is fine when the
+	// variables are provided by the environment (CI, containers)
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatal("Error loading .env file")
+		log.Println("No .env file found, using process environment")
 	}
 
 	port := os.Getenv("PORT")
@@ -37,47 +52,195 @@ func main() {
 		port = "3000"
 	}
 
-	uri := os.Getenv("DB_URI")
-	if uri == "" {
-		log.Fatal("DB_URI environment variable not set")
+	var signingKeys *Keyring
+	if path := os.Getenv("JWT_KEYS_FILE"); path != "" {
+		signingKeys, err = loadKeyring(path)
+		if err != nil {
+			log.Fatalf("Failed to load JWT_KEYS_FILE: %v", err)
+		}
+	} else {
+		// Fine for development; tokens stop verifying on restart and other
+		// instances cannot verify them
+		signingKeys, err = ephemeralKeyring()
+		if err != nil {
+			log.Fatalf("Failed to generate signing key: %v", err)
+		}
+		log.Println("JWT_KEYS_FILE not set, signing tokens with an ephemeral key")
+	}
+	tokenIssuer := os.Getenv("JWT_ISSUER")
+	if tokenIssuer == "" {
+		tokenIssuer = "go-doctor"
+	}
+	tokenAudience := os.Getenv("JWT_AUDIENCE")
+	if tokenAudience == "" {
+		tokenAudience = "go-doctor-api"
 	}
 
-	jwtSecret = os.Getenv("ACCESS_TOKEN")
-	if jwtSecret == "" {
-		log.Fatal("ACCESS_TOKEN environment variable not set")
+	oidcProviders := make(map[string]*OIDCProvider)
+	if path := os.Getenv("OIDC_PROVIDERS_FILE"); path != "" {
+		oidcProviders, err = loadOIDCProviders(path)
+		if err != nil {
+			log.Fatalf("Failed to load OIDC_PROVIDERS_FILE: %v", err)
+		}
+	}
+	fakeOIDC, err := fakeIssuerFromEnv()
+	if err != nil {
+		log.Fatalf("Failed to create fake OIDC issuer: %v", err)
+	}
+	if fakeOIDC != nil {
+		if oidcProviders[fakeIssuerName] != nil {
+			log.Fatalf("OIDC provider name %q is reserved for the fake issuer", fakeIssuerName)
+		}
+		oidcProviders[fakeIssuerName] = fakeOIDC.provider()
+		log.Println("Fake OIDC issuer enabled, anyone can log in as any email")
 	}
 
-	// Initialize MongoDB connection
-	mongoClient, err = connectMongoDB(uri)
+	clinicLocation, err := clinicLocationFromEnv()
 	if err != nil {
-		log.Fatalf("Failed to connect to MongoDB: %v", err)
+		log.Fatalf("Invalid CLINIC_TIME_ZONE: %v", err)
 	}
-	defer func() {
-		if err := mongoClient.Disconnect(context.Background()); err != nil {
-			log.Fatalf("Failed to disconnect from MongoDB: %v", err)
+
+	var stores Stores
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "memory":
+		// In-memory storage for local development and tests
+		seed, err := loadSeedOptions(os.Getenv("SEED_FILE"))
+		if err != nil {
+			log.Fatalf("Failed to load seed file: %v", err)
+		}
+		stores = newMemoryStores(seed)
+		fmt.Println("Using in-memory storage")
+	case "", "mongo":
+		uri := os.Getenv("DB_URI")
+		if uri == "" {
+			log.Fatal("DB_URI environment variable not set")
 		}
-	}()
 
-	// Initialize database collections
-	db := mongoClient.Database("doctors-portal")
-	appointmentOptionsCollection = db.Collection("appointmentCollection")
-	bookingCollactions = db.Collection("bookingCollaction")
-	usersCollactions = db.Collection("usersCollaction")
-	doctorsCollactions = db.Collection("doctorsCollactions")
-	paymentCollection = db.Collection("paymentCollection")
-	contactCollection = db.Collection("contactCollection")
+		// Initialize MongoDB connection
+		mongoClient, err := connectMongoDB(uri)
+		if err != nil {
+			log.Fatalf("Failed to connect to MongoDB: %v", err)
+		}
+		defer func() {
+			if err := mongoClient.Disconnect(context.Background()); err != nil {
+				log.Fatalf("Failed to disconnect from MongoDB: %v", err)
+			}
+		}()
+
+		// Initialize database backed stores
+		db := mongoClient.Database("doctors-portal")
+		if err := ensureMongoIndexes(context.Background(), db); err != nil {
+			log.Fatalf("Failed to create MongoDB indexes: %v", err)
+		}
+		if err := migrateBookingTimes(context.Background(), db, clinicLocation); err != nil {
+			log.Fatalf("Failed to migrate booking times: %v", err)
+		}
+		stores = newMongoStores(db)
+	default:
+		log.Fatalf("Unknown STORAGE_BACKEND %q (expected \"mongo\" or \"memory\")", backend)
+	}
+
+	// Bootstraps the first superadmin, who can then grant every other role
+	if email := os.Getenv("SUPERADMIN_EMAIL"); email != "" {
+		if err := grantSuperAdmin(context.Background(), stores.Users, email); err != nil {
+			log.Printf("Failed to make %s superadmin: %v", email, err)
+		}
+	}
+
+	roleCacheTTL := time.Minute
+	if ttl := os.Getenv("ROLE_CACHE_TTL"); ttl != "" {
+		roleCacheTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid ROLE_CACHE_TTL: %v", err)
+		}
+	}
+
+	holdTTL := 10 * time.Minute
+	if ttl := os.Getenv("HOLD_TTL"); ttl != "" {
+		holdTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid HOLD_TTL: %v", err)
+		}
+	}
+
+	waitlistClaimTTL := 2 * time.Hour
+	if ttl := os.Getenv("WAITLIST_CLAIM_TTL"); ttl != "" {
+		waitlistClaimTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("Invalid WAITLIST_CLAIM_TTL: %v", err)
+		}
+	}
+
+	provider, err := paymentProviderFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid payment provider: %v", err)
+	}
+	if _, ok := provider.(*fakeProvider); ok {
+		fmt.Println("Using fake payment provider")
+	}
+
+	currency := strings.ToLower(os.Getenv("CURRENCY"))
+	if currency == "" {
+		currency = "usd"
+	}
+
+	cancellationPolicy := defaultCancellationPolicy
+	if spec := os.Getenv("REFUND_POLICY"); spec != "" {
+		cancellationPolicy, err = parseCancellationPolicy(spec)
+		if err != nil {
+			log.Fatalf("Invalid REFUND_POLICY: %v", err)
+		}
+	}
+
+	notifier, err := notifierFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid notifier: %v", err)
+	}
+
+	server := NewServer(stores, provider, notifier, Config{
+		SigningKeys:        signingKeys,
+		TokenIssuer:        tokenIssuer,
+		TokenAudience:      tokenAudience,
+		OIDCProviders:      oidcProviders,
+		FakeIssuer:         fakeOIDC,
+		HoldTTL:            holdTTL,
+		Currency:           currency,
+		WebhookSecret:      os.Getenv("PAYMENT_WEBHOOK_SECRET"),
+		CancellationPolicy: cancellationPolicy,
+		PasswordResetURL:   os.Getenv("PASSWORD_RESET_URL"),
+		RoleCacheTTL:       roleCacheTTL,
+		ClinicLocation:     clinicLocation,
+		WaitlistClaimTTL:   waitlistClaimTTL,
+		WaitlistClaimURL:   os.Getenv("WAITLIST_CLAIM_URL"),
+	})
+
+	// Release slot holds abandoned during checkout
+	go server.sweepExpiredHolds(context.Background(), time.Minute)
+	// Pass slots offered to waitlisted patients on once a claim link lapses
+	go server.sweepWaitlistOffers(context.Background(), time.Minute)
 
 	// Setup Gin router
 	router := gin.Default()
 	router.Use(cors.Default()) // Enable CORS
 
 	// Define API routes (handlers are defined in handlers.go)
-	setupRoutes(router)
+	if err := server.setupRoutes(router); err != nil {
+		log.Fatalf("Invalid routes: %v", err)
+	}
 
 	fmt.Printf("Doctors portal server is running on port %s\n", port)
 	router.Run(":" + port)
 }
 
+// clinicLocationFromEnv returns the time zone appointment dates and slots are
+// wall clock times in, the server's own unless CLINIC_TIME_ZONE is set
+func clinicLocationFromEnv() (*time.Location, error) {
+	if name := os.Getenv("CLINIC_TIME_ZONE"); name != "" {
+		return time.LoadLocation(name)
+	}
+	return time.Local, nil
+}
+
 // connectMongoDB establishes a connection to MongoDB
 func connectMongoDB(uri string) (*mongo.Client, error) {
 	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
@@ -93,23 +256,94 @@ func connectMongoDB(uri string) (*mongo.Client, error) {
 	return client, nil
 }
 
-// setupRoutes defines all the API endpoints
-func setupRoutes(router *gin.Engine) {
-	router.POST("/contact", handleContactPost)
-	router.GET("/appointmentOptions", handleGetAppointmentOptions)
-	router.GET("/v2/appointmentOptions", handleGetV2AppointmentOptions)
-	router.GET("/bookings", verifyJWT(), handleGetBookings)
-	router.GET("/bookings/:id", handleGetBookingByID)
-	router.POST("/bookings", handlePostBooking)
-	router.POST("/create-payment-intent", handleCreatePaymentIntent)
-	router.POST("/payments", handlePostPayment)
-	router.GET("/jwt", handleGetJWT)
-	router.GET("/appointmentSpecialty", handleGetAppointmentSpecialty)
-	router.GET("/users", handleGetUsers)
-	router.POST("/users", handlePostUser)
-	router.GET("/users/admin/:email", handleGetUserAdminByEmail)
-	router.PUT("/users/admin/:id", verifyJWT(), verifyAdmin(), handlePutUserAdminByID)
-	router.GET("/doctors", verifyJWT(), verifyAdmin(), handleGetDoctors)
-	router.DELETE("/doctors/:id", verifyJWT(), verifyAdmin(), handleDeleteDoctorByID)
-	router.POST("/doctors", verifyJWT(), verifyAdmin(), handlePostDoctor)
+// loadSeedOptions reads the appointment options used to seed the in-memory
+// backend from a JSON file; an empty path yields no options
+func loadSeedOptions(path string) ([]AppointmentOption, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var options []AppointmentOption
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// setupRoutes defines all the API endpoints along with who may call them,
+// and checks that every route on the router has an access rule
+func (s *Server) setupRoutes(router *gin.Engine) error {
+	routes := newRouteTable(s, router)
+	routes.handle("POST", "/contact", publicRoute, s.handleContactPost)
+	routes.handle("GET", "/appointmentOptions", publicRoute, s.handleGetAppointmentOptions)
+	routes.handle("GET", "/v2/appointmentOptions", publicRoute, s.handleGetV2AppointmentOptions)
+	routes.handle("GET", "/availability", publicRoute, s.handleGetAvailability)
+	routes.handle("GET", "/appointmentSpecialty", publicRoute, s.handleGetAppointmentSpecialty)
+	routes.handle("GET", "/bookings", authenticatedRoute, s.handleGetBookings)
+	routes.handle("GET", "/bookings/:id", authenticatedRoute, s.handleGetBookingByID)
+	routes.handle("POST", "/bookings", authenticatedRoute, s.handlePostBooking)
+	routes.handle("POST", "/bookings/:id/cancel", authenticatedRoute, s.handleCancelBooking)
+	routes.handle("POST", "/bookings/:id/reschedule", authenticatedRoute, s.handleRescheduleBooking)
+	routes.handle("POST", "/bookings/:id/status", requires(PermBookingsWriteAny), s.handleSetBookingStatus)
+	routes.handle("POST", "/bookings/:id/refund", stepUp(requires(PermBookingsRefund)), s.handleRefundBooking)
+	routes.handle("GET", "/bookings/:id/payment", authenticatedRoute, s.handleGetBookingPayment)
+	routes.handle("POST", "/holds", authenticatedRoute, s.handlePostHold)
+	routes.handle("GET", "/waitlist", authenticatedRoute, s.handleGetWaitlist)
+	routes.handle("POST", "/waitlist", authenticatedRoute, s.handlePostWaitlist)
+	routes.handle("DELETE", "/waitlist/:id", authenticatedRoute, s.handleDeleteWaitlist)
+	routes.handle("POST", "/waitlist/claim", publicRoute, s.handleClaimWaitlistOffer) // the claim token authenticates
+	routes.handle("POST", "/create-payment-intent", authenticatedRoute, s.handleCreatePaymentIntent)
+	routes.handle("POST", "/payments", authenticatedRoute, s.handlePostPayment)
+	routes.handle("GET", "/payments/report", requires(PermPaymentsReadAny), s.handleGetPaymentsReport)
+	routes.handle("POST", "/webhooks/payments", publicRoute, s.handlePaymentWebhook) // signed by the provider
+	routes.handle("GET", "/.well-known/jwks.json", publicRoute, s.handleGetJWKS)
+	routes.handle("POST", "/auth/register", publicRoute, s.handleRegister)
+	routes.handle("POST", "/auth/login", publicRoute, s.handleLogin)
+	routes.handle("POST", "/auth/refresh", publicRoute, s.handleRefreshToken)
+	routes.handle("POST", "/auth/logout", authenticatedRoute, s.handleLogout)
+	routes.handle("POST", "/auth/password-reset", publicRoute, s.handleRequestPasswordReset)
+	routes.handle("POST", "/auth/password-reset/confirm", publicRoute, s.handleConfirmPasswordReset)
+	routes.handle("POST", "/auth/oidc/:provider", publicRoute, s.handleOIDCLogin)
+	routes.handle("POST", "/auth/mfa/totp", authenticatedRoute, s.handleEnrollTOTP)
+	routes.handle("POST", "/auth/mfa/totp/confirm", authenticatedRoute, s.handleConfirmTOTP)
+	routes.handle("DELETE", "/auth/mfa/totp", stepUp(authenticatedRoute), s.handleDisableTOTP)
+	routes.handle("POST", "/auth/mfa/verify", authenticatedRoute, s.handleVerifyMFA)
+	routes.handle("POST", "/auth/mfa/recovery-codes", stepUp(authenticatedRoute), s.handleRegenerateRecoveryCodes)
+	if s.config.FakeIssuer != nil {
+		routes.handle("POST", "/fake-oidc/token", publicRoute, s.handleFakeIDToken)
+	}
+	routes.handle("GET", "/users", requires(PermUsersRead), s.handleGetUsers)
+	routes.handle("POST", "/users", requires(PermUsersWrite), s.handlePostUser)
+	routes.handle("GET", "/users/admin/:email", authenticatedRoute, s.handleGetUserAdminByEmail)
+	routes.handle("PUT", "/users/admin/:id", stepUp(requires(PermUsersGrantRoles)), s.handlePutUserAdminByID)
+	routes.handle("POST", "/users/:id/roles", stepUp(requires(PermUsersGrantRoles)), s.handleGrantRole)
+	routes.handle("DELETE", "/users/:id/roles/:role", stepUp(requires(PermUsersGrantRoles)), s.handleRevokeRole)
+	routes.handle("POST", "/users/:id/demote", stepUp(requires(PermUsersGrantRoles)), s.handleDemoteUser)
+	routes.handle("DELETE", "/users/:id/sessions", requires(PermUsersRevokeSessions), s.handleRevokeUserSessions)
+	routes.handle("GET", "/api-keys", requires(PermAPIKeysManage), s.handleGetAPIKeys)
+	routes.handle("POST", "/api-keys", stepUp(requires(PermAPIKeysManage)), s.handlePostAPIKey)
+	routes.handle("DELETE", "/api-keys/:id", requires(PermAPIKeysManage), s.handleRevokeAPIKey)
+	routes.handle("GET", "/doctors", requires(PermDoctorsRead), s.handleGetDoctors)
+	routes.handle("GET", "/doctors/me/bookings", requires(PermBookingsReadOwnTreat), s.handleGetDoctorBookings)
+	routes.handle("DELETE", "/doctors/:id", stepUp(requires(PermDoctorsWrite)), s.handleDeleteDoctorByID)
+	routes.handle("POST", "/doctors", requires(PermDoctorsWrite), s.handlePostDoctor)
+	routes.handle("PUT", "/doctors/:id/schedules", requires(PermDoctorsWrite), s.handlePutDoctorSchedules)
+	routes.handle("GET", "/blackouts", requires(PermBookingsReadAny), s.handleGetBlackouts)
+	routes.handle("GET", "/blackouts/conflicts", requires(PermBookingsReadAny), s.handleGetConflictedBookings)
+	routes.handle("POST", "/blackouts", requires(PermBlackoutsManage), s.handlePostBlackout)
+	routes.handle("DELETE", "/blackouts/:id", requires(PermBlackoutsManage), s.handleDeleteBlackout)
+	return routes.check()
+}
+
+// grantSuperAdmin gives the superadmin role to the registered user with email
+func grantSuperAdmin(ctx context.Context, users UserStore, email string) error {
+	user, err := users.FindByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
+	_, err = users.GrantRole(ctx, user.ID, RoleSuperAdmin)
+	return err
 }
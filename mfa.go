@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	totpPeriod        = 30 * time.Second
+	totpDigits        = 6
+	totpModulus       = 1000000 // 10^totpDigits
+	totpSkew          = 1       // steps either side of now whose codes are accepted
+	recoveryCodeCount = 10
+	// stepUpMaxAge is how recently the second factor must have been passed
+	// for destructive actions
+	stepUpMaxAge = 5 * time.Minute
+)
+
+// base32NoPadding is how TOTP secrets are written in authenticator apps
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// totpCode returns the code for a secret at a time step
+func totpCode(secret []byte, step int64) string {
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%totpModulus)
+}
+
+// matchTOTP returns the time step whose code is code, looking totpSkew steps
+// either side of now to allow for clock drift
+func matchTOTP(secret, code string, now time.Time) (int64, bool) {
+	key, err := base32NoPadding.DecodeString(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	current := now.Unix() / int64(totpPeriod.Seconds())
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// normalizeRecoveryCode lets recovery codes be typed with any case, spaces
+// and dashes
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// newRecoveryCodes returns fresh recovery codes and the hashes they are stored as
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(raw))
+		codes[i] = code[:4] + "-" + code[4:]
+		hashes[i] = hashToken(normalizeRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// TOTPCodeRequest carries a code from the authenticator app or, when
+// verifying, a recovery code instead
+type TOTPCodeRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// currentSession returns the session verifyJWT authenticated the request
+// with; requests made with an API key have none
+func currentSession(c *gin.Context) (Session, bool) {
+	session, ok := c.Get("session")
+	if !ok {
+		return Session{}, false
+	}
+	return session.(Session), true
+}
+
+// requireMFA aborts the request when the caller has not passed their second
+// factor in this session. Every permission comes from a staff role, so it
+// guards every use of one.
+func requireMFA(c *gin.Context) bool {
+	if session, ok := currentSession(c); ok && session.MFAVerifiedAt != nil {
+		return true
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"error":       "two-factor authentication is required for staff accounts",
+		"mfaRequired": true,
+	})
+	return false
+}
+
+// Middleware to require that the second factor was passed within
+// stepUpMaxAge, for destructive actions
+func (s *Server) requireStepUp() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, ok := currentSession(c)
+		if !ok || session.MFAVerifiedAt == nil || time.Since(*session.MFAVerifiedAt) > stepUpMaxAge {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error":  "confirm this action with your second factor",
+				"stepUp": true,
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// handleEnrollTOTP creates a new TOTP secret for the caller. It only takes
+// effect once a code from it is confirmed.
+func (s *Server) handleEnrollTOTP(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTP != nil && user.TOTP.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is already enabled"})
+		return
+	}
+
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create secret"})
+		return
+	}
+	secret := base32NoPadding.EncodeToString(raw)
+	if err := s.Users.SetTOTP(c, user.ID, &TOTP{Secret: secret}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store secret"})
+		return
+	}
+
+	label := url.PathEscape(s.config.TokenIssuer + ":" + user.Email)
+	params := url.Values{"secret": {secret}, "issuer": {s.config.TokenIssuer}}
+	c.JSON(http.StatusOK, gin.H{
+		"secret":     secret,
+		"otpauthUrl": "otpauth://totp/" + label + "?" + params.Encode(),
+	})
+}
+
+// handleConfirmTOTP enables the enrolled secret with a code from it and
+// returns the recovery codes, which are never shown again
+func (s *Server) handleConfirmTOTP(c *gin.Context) {
+	var req TOTPCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTP == nil || user.TOTP.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "no two-factor enrollment is pending"})
+		return
+	}
+
+	now := time.Now()
+	step, ok := matchTOTP(user.TOTP.Secret, req.Code, now)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid code"})
+		return
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create recovery codes"})
+		return
+	}
+	totp := TOTP{Secret: user.TOTP.Secret, Enabled: true, LastStep: step, RecoveryCodeHashes: hashes}
+	if err := s.Users.SetTOTP(c, user.ID, &totp); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to enable two-factor authentication"})
+		return
+	}
+	session, _ := currentSession(c)
+	if err := s.Sessions.SetMFAVerified(c, session.ID, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// handleVerifyMFA passes the second factor for the caller's session, with a
+// TOTP code or a single-use recovery code. Failures count towards the same
+// lockout as failed logins.
+func (s *Server) handleVerifyMFA(c *gin.Context) {
+	var req TOTPCodeRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTP == nil || !user.TOTP.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is not enabled"})
+		return
+	}
+	now := time.Now()
+	if user.locked(now) {
+		c.Header("Retry-After", fmt.Sprint(int(user.LockedUntil.Sub(now).Seconds())+1))
+		c.JSON(http.StatusLocked, gin.H{"error": "account is locked after too many failed attempts, try again later"})
+		return
+	}
+
+	var err error
+	if req.RecoveryCode != "" {
+		err = s.Users.ConsumeRecoveryCode(c, user.ID, hashToken(normalizeRecoveryCode(req.RecoveryCode)))
+	} else if step, ok := matchTOTP(user.TOTP.Secret, req.Code, now); ok {
+		err = s.Users.UseTOTPStep(c, user.ID, step)
+	} else {
+		err = ErrNotFound
+	}
+	if err == ErrNotFound {
+		failures, err := s.Users.RecordLoginFailure(c, user.ID)
+		if err == nil && failures >= maxLoginAttempts {
+			until := now.Add(loginLockout)
+			err = s.Users.SetLockout(c, user.ID, &until)
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record attempt"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or already used code"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to verify code"})
+		return
+	}
+
+	if user.FailedLogins > 0 {
+		if err := s.Users.SetLockout(c, user.ID, nil); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record attempt"})
+			return
+		}
+	}
+	session, _ := currentSession(c)
+	if err := s.Sessions.SetMFAVerified(c, session.ID, now); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"verifiedAt": now})
+}
+
+// handleRegenerateRecoveryCodes replaces the caller's recovery codes
+func (s *Server) handleRegenerateRecoveryCodes(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+	if user.TOTP == nil || !user.TOTP.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "two-factor authentication is not enabled"})
+		return
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create recovery codes"})
+		return
+	}
+	totp := *user.TOTP
+	totp.RecoveryCodeHashes = hashes
+	if err := s.Users.SetTOTP(c, user.ID, &totp); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store recovery codes"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"recoveryCodes": codes})
+}
+
+// handleDisableTOTP removes the caller's second factor. Staff cannot use
+// their permissions again until they enroll a new one.
+func (s *Server) handleDisableTOTP(c *gin.Context) {
+	user, ok := s.currentUser(c)
+	if !ok {
+		return
+	}
+	if err := s.Users.SetTOTP(c, user.ID, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to disable two-factor authentication"})
+		return
+	}
+	if _, err := s.Sessions.RevokeAllForUser(c, user.ID, time.Now(), "two-factor authentication disabled"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "two-factor authentication disabled"})
+}
@@ -1,19 +1,20 @@
 package main
 
 import (
-	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 // Custom claims for JWT
 type Claims struct {
-	Email string `json:"email"`
+	Email     string `json:"email"`
+	SessionID string `json:"sid"`   // the session the token was issued for
+	Roles     []Role `json:"roles"` // the user's roles when the token was issued
 	jwt.RegisteredClaims
 }
 
@@ -22,8 +23,8 @@ func splitString(s, sep string) []string {
 	return strings.Split(s, sep)
 }
 
-// Middleware to verify JWT token
-func verifyJWT() gin.HandlerFunc {
+// Middleware to verify JWT token, or an API key sent as "ApiKey <key>"
+func (s *Server) verifyJWT() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -33,62 +34,120 @@ func verifyJWT() gin.HandlerFunc {
 
 		tokenStr := ""
 		parts := splitString(authHeader, " ")
-		if len(parts) == 2 && parts[0] == "Bearer" {
+		if len(parts) == 2 && parts[0] == "ApiKey" {
+			s.authenticateAPIKey(c, parts[1])
+			return
+		} else if len(parts) == 2 && parts[0] == "Bearer" {
 			tokenStr = parts[1]
 		} else {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid token format"})
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte(jwtSecret), nil
-		})
-
+		claims, err := s.parseAccessToken(tokenStr)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid token"})
 			return
 		}
 
-		if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-			c.Set("decodedEmail", claims.Email)
-			c.Next()
-		} else {
+		// Tokens stop working as soon as their session is revoked
+		sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
+		if err != nil {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid token claims"})
 			return
 		}
+		session, err := s.Sessions.FindByID(c, sessionID)
+		if err != nil && err != ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
+		if err == ErrNotFound || !session.active(time.Now()) || session.Email != claims.Email {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session has ended"})
+			return
+		}
+
+		c.Set("decodedEmail", claims.Email)
+		c.Set("sessionID", sessionID)
+		c.Set("session", session)
+		c.Set("claims", claims)
+		c.Next()
 	}
 }
 
-// Middleware to verify admin role
-func verifyAdmin() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		decodedEmail, exists := c.Get("decodedEmail")
-		if !exists {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized access"})
-			return
+// currentUser returns the user verifyJWT authenticated, loading it once per
+// request. It aborts the request when the user cannot be loaded.
+func (s *Server) currentUser(c *gin.Context) (User, bool) {
+	if user, ok := c.Get("currentUser"); ok {
+		return user.(User), true
+	}
+
+	email, exists := c.Get("decodedEmail")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized access"})
+		return User{}, false
+	}
+
+	user, err := s.Users.FindByEmail(c, email.(string))
+	if err != nil {
+		if err == ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden access"})
+		} else {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
 		}
+		return User{}, false
+	}
 
-		email, ok := decodedEmail.(string)
-		if !ok {
+	c.Set("currentUser", user)
+	return user, true
+}
+
+// callerCan reports whether the caller's roles grant perm. The roles come
+// from the access token or the role cache rather than the user record, so a
+// role change can take up to the cache TTL to apply. It aborts the request
+// when the roles cannot be loaded, or when perm is granted but the caller has
+// not passed their second factor.
+func (s *Server) callerCan(c *gin.Context, perm Permission) (bool, bool) {
+	if key, ok := c.Get("apiKey"); ok {
+		return key.(APIKey).allows(perm), true
+	}
+
+	value, exists := c.Get("claims")
+	if !exists {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized access"})
+		return false, false
+	}
+	claims := value.(*Claims)
+	userID, err := primitive.ObjectIDFromHex(claims.Subject)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "invalid token claims"})
+		return false, false
+	}
+
+	roles, err := s.roles.roles(c, userID, claims.Roles, claims.IssuedAt.Time, s.Users.FindByID)
+	if err != nil {
+		if err == ErrNotFound {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden access"})
+		} else {
 			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-			return
 		}
+		return false, false
+	}
+	allowed := User{Roles: roles}.can(perm)
+	if allowed && !requireMFA(c) {
+		return false, false
+	}
+	return allowed, true
+}
 
-		var user User
-		err := usersCollactions.FindOne(c, bson.M{"email": email}).Decode(&user)
-		if err != nil {
-			if err == mongo.ErrNoDocuments {
-				c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden access"})
-			} else {
-				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
-			}
+// Middleware to require a permission from one of the caller's roles
+func (s *Server) requirePermission(perm Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, ok := s.callerCan(c, perm)
+		if !ok {
 			return
 		}
 
-		if user.Role != "admin" {
+		if !allowed {
 			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden access"})
 			return
 		}
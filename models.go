@@ -1,6 +1,10 @@
 package main
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
 
 // AppointmentOption represents the structure of appointment options
 type AppointmentOption struct {
@@ -8,6 +12,21 @@ type AppointmentOption struct {
 	Name  string             `bson:"name"`
 	Slots []string           `bson:"slots"`
 	Price float64            `bson:"price"`
+	// doctors are the doctors offering each slot laid out by their schedules
+	// on a date, set by applySchedules; fixed slots have none
+	doctors map[string][]primitive.ObjectID
+}
+
+// BookedOption is an appointment option with the slots booked on a date
+type BookedOption struct {
+	AppointmentOption `bson:",inline"`
+	Booked            []BookedSlot `bson:"booked"`
+}
+
+// BookedSlot is a slot taken by a booking, with the doctor it was booked with
+type BookedSlot struct {
+	Slot     string              `bson:"slot"`
+	DoctorID *primitive.ObjectID `bson:"doctorId,omitempty"`
 }
 
 // Booking represents the structure of a booking
@@ -17,9 +36,60 @@ type Booking struct {
 	Treatment       string             `bson:"treatment"`
 	Patient         string             `bson:"patient"`
 	Slot            string             `bson:"slot"`
-	Email           string             `bson:"email"`
-	Phone           string             `bson:"phone"`
-	Price           float64            `bson:"price"`
+	// DoctorID is the doctor seeing the patient when the slot was laid out by
+	// doctor schedules; each doctor offering a slot can be booked for it
+	DoctorID *primitive.ObjectID `bson:"doctorId,omitempty"`
+	// StartsAt and EndsAt are when the slot starts and ends in UTC; bookings
+	// stored before they existed get them from migrateBookingTimes
+	StartsAt *time.Time `bson:"startsAt,omitempty"`
+	EndsAt   *time.Time `bson:"endsAt,omitempty"`
+	Email    string     `bson:"email"`
+	Phone    string     `bson:"phone"`
+	Price    float64    `bson:"price"`
+	// HoldExpiresAt is set while the booking is only a temporary hold on the
+	// slot during checkout; a confirmed booking has no expiry
+	HoldExpiresAt *time.Time     `bson:"holdExpiresAt,omitempty"`
+	Status        BookingStatus  `bson:"status"`
+	StatusHistory []StatusChange `bson:"statusHistory,omitempty"`
+	Paid          bool           `bson:"paid" json:"paid"`
+	TransactionID string         `bson:"transactionId,omitempty" json:"transactionId"`
+	PaymentError  string         `bson:"paymentError,omitempty"` // last failed payment attempt
+	// Conflicts are the blackouts created after the booking that fall on it;
+	// staff reschedule or cancel flagged bookings
+	Conflicts []primitive.ObjectID `bson:"conflicts,omitempty"`
+}
+
+// resetManagedFields clears the fields only the server may set, so a client
+// cannot smuggle them in through a request body
+func (b *Booking) resetManagedFields() {
+	b.ID = primitive.NilObjectID
+	b.DoctorID = nil
+	b.HoldExpiresAt = nil
+	b.Status = ""
+	b.StatusHistory = nil
+	b.Paid = false
+	b.TransactionID = ""
+	b.PaymentError = ""
+	b.Conflicts = nil
+}
+
+// holdExpired reports whether the booking is a hold that lapsed before now
+func (b Booking) holdExpired(now time.Time) bool {
+	return b.HoldExpiresAt != nil && !b.HoldExpiresAt.After(now)
+}
+
+// currentStatus returns the status of the booking, treating bookings stored
+// before statuses existed as confirmed
+func (b Booking) currentStatus() BookingStatus {
+	if b.Status == "" {
+		return StatusConfirmed
+	}
+	return b.Status
+}
+
+// occupiesSlot reports whether the booking still blocks its slot at now
+func (b Booking) occupiesSlot(now time.Time) bool {
+	return b.currentStatus() != StatusCancelled && !b.holdExpired(now)
 }
 
 // User represents the structure of a user
@@ -27,7 +97,157 @@ type User struct {
 	ID    primitive.ObjectID `bson:"_id,omitempty"`
 	Name  string             `bson:"name"`
 	Email string             `bson:"email"`
-	Role  string             `bson:"role"`
+	Roles []Role             `bson:"roles,omitempty"` // on top of the implicit patient role
+	// Credentials are never sent to or accepted from clients
+	PasswordHash string     `bson:"passwordHash,omitempty" json:"-"`
+	FailedLogins int        `bson:"failedLogins,omitempty" json:"-"`
+	LockedUntil  *time.Time `bson:"lockedUntil,omitempty" json:"-"`
+	// Identities are the identity provider accounts the user logs in with
+	Identities []Identity `bson:"identities,omitempty"`
+	// TOTP is the user's authenticator app second factor, if enrolled
+	TOTP *TOTP `bson:"totp,omitempty" json:"-"`
+}
+
+// TOTP is a time-based one-time password second factor (RFC 6238)
+type TOTP struct {
+	Secret  string `bson:"secret"`  // base32, shared with the authenticator app
+	Enabled bool   `bson:"enabled"` // false until the first code is confirmed
+	// LastStep is the time step of the last accepted code, so that a code
+	// cannot be used twice
+	LastStep           int64    `bson:"lastStep,omitempty"`
+	RecoveryCodeHashes []string `bson:"recoveryCodeHashes,omitempty"`
+}
+
+// Identity links a user to an account at an OIDC identity provider
+type Identity struct {
+	Provider string `bson:"provider"` // name of the configured provider
+	Subject  string `bson:"subject"`  // sub claim of the provider's ID tokens
+}
+
+// locked reports whether too many failed logins keep the user out at now
+func (u User) locked(now time.Time) bool {
+	return u.LockedUntil != nil && now.Before(*u.LockedUntil)
+}
+
+// Session is a login that can be extended with its refresh token until it
+// expires or is revoked. Only the SHA-256 of the current refresh token is stored.
+type Session struct {
+	ID               primitive.ObjectID `bson:"_id,omitempty"`
+	UserID           primitive.ObjectID `bson:"userId"`
+	Email            string             `bson:"email"`
+	RefreshTokenHash string             `bson:"refreshTokenHash"`
+	// UsedTokenHashes are the hashes of refresh tokens rotated out of the session
+	UsedTokenHashes []string   `bson:"usedTokenHashes,omitempty"`
+	CreatedAt       time.Time  `bson:"createdAt"`
+	RefreshedAt     time.Time  `bson:"refreshedAt"`
+	ExpiresAt       time.Time  `bson:"expiresAt"`
+	RevokedAt       *time.Time `bson:"revokedAt,omitempty"`
+	RevokedReason   string     `bson:"revokedReason,omitempty"`
+	// MFAVerifiedAt is when the user last passed their second factor in the session
+	MFAVerifiedAt *time.Time `bson:"mfaVerifiedAt,omitempty"`
+}
+
+// active reports whether the session can still be used at now
+func (s Session) active(now time.Time) bool {
+	return s.RevokedAt == nil && now.Before(s.ExpiresAt)
+}
+
+// usedRefreshToken reports whether a refresh token with hash was already
+// rotated out of the session
+func (s Session) usedRefreshToken(hash string) bool {
+	for _, used := range s.UsedTokenHashes {
+		if used == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// PasswordReset is a single-use token letting a user choose a new password.
+// Only the SHA-256 of the token is stored.
+type PasswordReset struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	UserID    primitive.ObjectID `bson:"userId"`
+	TokenHash string             `bson:"tokenHash"`
+	ExpiresAt time.Time          `bson:"expiresAt"`
+	UsedAt    *time.Time         `bson:"usedAt,omitempty"`
+}
+
+// BlackoutKind says what a blackout closes
+type BlackoutKind string
+
+const (
+	BlackoutHoliday BlackoutKind = "holiday" // the whole clinic
+	BlackoutLeave   BlackoutKind = "leave"   // one doctor
+	BlackoutSlot    BlackoutKind = "slot"    // one slot of one treatment
+)
+
+// Blackout is a period in which slots are not offered
+type Blackout struct {
+	ID        primitive.ObjectID  `bson:"_id,omitempty"`
+	Kind      BlackoutKind        `bson:"kind"`
+	DoctorID  *primitive.ObjectID `bson:"doctorId,omitempty"`  // the doctor on leave
+	Treatment string              `bson:"treatment,omitempty"` // the treatment of a blocked slot
+	StartsAt  time.Time           `bson:"startsAt"`
+	EndsAt    time.Time           `bson:"endsAt"`
+	Reason    string              `bson:"reason,omitempty"`
+	CreatedBy string              `bson:"createdBy"`
+	CreatedAt time.Time           `bson:"createdAt"`
+}
+
+// WaitlistStatus is where a waitlist entry is in the queue
+type WaitlistStatus string
+
+const (
+	WaitlistWaiting WaitlistStatus = "waiting"
+	WaitlistOffered WaitlistStatus = "offered" // a freed slot is held for the patient
+	WaitlistClaimed WaitlistStatus = "claimed"
+)
+
+// WaitlistEntry is a patient waiting for a slot of a treatment to free up
+// between two dates
+type WaitlistEntry struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	Email     string             `bson:"email"`
+	Treatment string             `bson:"treatment"`
+	From      time.Time          `bson:"from"` // midnight of the first date in the clinic's time zone
+	To        time.Time          `bson:"to"`   // midnight after the last date
+	Status    WaitlistStatus     `bson:"status"`
+	CreatedAt time.Time          `bson:"createdAt"`
+	Offer     *WaitlistOffer     `bson:"offer,omitempty"`
+	// Passed are the start times of slots offered to the patient that they
+	// let expire; they are not offered again
+	Passed []time.Time `bson:"passed,omitempty"`
+}
+
+// WaitlistOffer is a freed slot held for a waitlisted patient until they
+// claim it or the offer expires
+type WaitlistOffer struct {
+	BookingID       primitive.ObjectID `bson:"bookingId"` // the hold on the slot
+	AppointmentDate string             `bson:"appointmentDate"`
+	Slot            string             `bson:"slot"`
+	StartsAt        time.Time          `bson:"startsAt"`
+	ExpiresAt       time.Time          `bson:"expiresAt"`
+	ClaimTokenHash  string             `bson:"claimTokenHash" json:"-"`
+}
+
+// APIKey lets a machine client such as a reporting job or a kiosk call the
+// API with a fixed set of permissions. Only the SHA-256 of the key is stored.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	Name       string             `bson:"name"`
+	KeyHash    string             `bson:"keyHash" json:"-"`
+	Scopes     []Permission       `bson:"scopes"`
+	CreatedBy  string             `bson:"createdBy"`
+	CreatedAt  time.Time          `bson:"createdAt"`
+	ExpiresAt  time.Time          `bson:"expiresAt"`
+	LastUsedAt *time.Time         `bson:"lastUsedAt,omitempty"`
+	RevokedAt  *time.Time         `bson:"revokedAt,omitempty"`
+}
+
+// active reports whether the key can still be used at now
+func (k APIKey) active(now time.Time) bool {
+	return k.RevokedAt == nil && now.Before(k.ExpiresAt)
 }
 
 // Doctor represents the structure of a doctor
@@ -36,6 +256,28 @@ type Doctor struct {
 	Name  string             `bson:"name"`
 	Email string             `bson:"email"`
 	Image string             `bson:"img"`
+	// Specialty is the treatment whose bookings the doctor sees
+	Specialty string `bson:"specialty"`
+	// Schedules are the weekly hours the doctor offers each treatment in
+	Schedules []TreatmentSchedule `bson:"schedules,omitempty"`
+}
+
+// TreatmentSchedule is when a doctor offers a treatment every week. Slots of
+// SlotMinutes are laid out from the start of each working period, with
+// BufferMinutes left free after each one.
+type TreatmentSchedule struct {
+	Treatment     string         `bson:"treatment"`
+	SlotMinutes   int            `bson:"slotMinutes"`
+	BufferMinutes int            `bson:"bufferMinutes"`
+	Hours         []WorkingHours `bson:"hours"`
+}
+
+// WorkingHours is a period of a weekday, with Start and End written as
+// "15:04" wall clock times
+type WorkingHours struct {
+	Weekday time.Weekday `bson:"weekday"` // 0 is Sunday
+	Start   string       `bson:"start"`
+	End     string       `bson:"end"`
 }
 
 // Contact represents the structure of a contact message
@@ -51,9 +293,59 @@ type Contact struct {
 type Payment struct {
 	ID              primitive.ObjectID `bson:"_id,omitempty"`
 	PaymentMethodId string             `bson:"paymentMethodId"`
+	TransactionID   string             `bson:"transactionId"`
+	Amount          int64              `bson:"amount"` // in minor units of Currency
+	Currency        string             `bson:"currency"`
+	Status          PaymentStatus      `bson:"status"`
+	AmountRefunded  int64              `bson:"amountRefunded"`
+	Refunds         []RefundRecord     `bson:"refunds,omitempty"`
 	Booking         PaymentBooking     `bson:"booking"`
 }
 
+// netAmount is what the clinic keeps from the payment after refunds
+func (p Payment) netAmount() int64 {
+	return p.Amount - p.AmountRefunded
+}
+
+// refundedTotal sums the amounts of refunds
+func refundedTotal(refunds []RefundRecord) int64 {
+	var total int64
+	for _, refund := range refunds {
+		total += refund.Amount
+	}
+	return total
+}
+
+// RefundRecord is one refund issued against a payment
+type RefundRecord struct {
+	ID     string    `bson:"id"` // provider refund ID
+	Amount int64     `bson:"amount"`
+	Reason string    `bson:"reason,omitempty"`
+	By     string    `bson:"by,omitempty"`
+	At     time.Time `bson:"at"`
+}
+
+// PaymentStatus tracks whether money collected by a payment was returned
+type PaymentStatus string
+
+const (
+	PaymentSucceeded         PaymentStatus = "succeeded"
+	PaymentPartiallyRefunded PaymentStatus = "partially_refunded"
+	PaymentRefunded          PaymentStatus = "refunded"
+)
+
+// refundStatus returns the payment status for a payment of amount with refunded returned
+func refundStatus(amount, refunded int64) PaymentStatus {
+	switch {
+	case refunded <= 0:
+		return PaymentSucceeded
+	case refunded < amount:
+		return PaymentPartiallyRefunded
+	default:
+		return PaymentRefunded
+	}
+}
+
 // PaymentBooking represents the embedded booking information in the Payment model
 type PaymentBooking struct {
 	ID              string  `bson:"_id"`
@@ -65,3 +357,27 @@ type PaymentBooking struct {
 	Phone           string  `bson:"phone"`
 	Price           float64 `bson:"price"`
 }
+
+// paymentBookingFrom copies the booking details embedded in a payment record
+func paymentBookingFrom(b Booking) PaymentBooking {
+	return PaymentBooking{
+		ID:              b.ID.Hex(),
+		AppointmentDate: b.AppointmentDate,
+		Treatment:       b.Treatment,
+		Patient:         b.Patient,
+		Slot:            b.Slot,
+		Email:           b.Email,
+		Phone:           b.Phone,
+		Price:           b.Price,
+	}
+}
+
+// WebhookEvent is a notification received from the payment provider
+type WebhookEvent struct {
+	ID          string     `bson:"_id"`
+	Type        string     `bson:"type"`
+	Payload     string     `bson:"payload"`
+	ReceivedAt  time.Time  `bson:"receivedAt"`
+	ProcessedAt *time.Time `bson:"processedAt,omitempty"`
+	Error       string     `bson:"error,omitempty"` // why the event could not be applied
+}
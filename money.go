@@ -0,0 +1,21 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+// zeroDecimalCurrencies have no minor unit, so amounts are whole units
+var zeroDecimalCurrencies = map[string]bool{
+	"bif": true, "clp": true, "djf": true, "gnf": true, "jpy": true, "kmf": true, "krw": true, "mga": true,
+	"pyg": true, "rwf": true, "ugx": true, "vnd": true, "vuv": true, "xaf": true, "xof": true, "xpf": true,
+}
+
+// toMinorUnits converts a price stored in major units (e.g. dollars) into an
+// exact integer amount of the currency's minor unit (e.g. cents)
+func toMinorUnits(price float64, currency string) int64 {
+	if zeroDecimalCurrencies[strings.ToLower(currency)] {
+		return int64(math.Round(price))
+	}
+	return int64(math.Round(price * 100))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Notifier delivers messages to users, e.g. by email
+type Notifier interface {
+	Notify(ctx context.Context, to, subject, body string) error
+}
+
+// logNotifier writes messages to the server log instead of sending them. It
+// is meant for local development, since the messages may carry secrets such
+// as password reset links.
+type logNotifier struct{}
+
+func (logNotifier) Notify(ctx context.Context, to, subject, body string) error {
+	log.Printf("Notification to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// smtpNotifier sends messages as plain text email through an SMTP server
+type smtpNotifier struct {
+	addr     string // host:port of the server
+	from     string
+	auth     smtp.Auth // nil when the server needs no login
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newSMTPNotifier(addr, from, username, password string) (*smtpNotifier, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP address %q: %w", addr, err)
+	}
+	if from == "" {
+		return nil, errors.New("no sender address")
+	}
+	notifier := &smtpNotifier{addr: addr, from: from, sendMail: smtp.SendMail}
+	if username != "" {
+		notifier.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return notifier, nil
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, to, subject, body string) error {
+	// Header values must not be able to start headers of their own
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("line break in email header")
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", n.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return n.sendMail(n.addr, n.auth, n.from, []string{to}, []byte(msg.String()))
+}
+
+// notifierFromEnv returns the notifier NOTIFIER selects, "smtp" or "log".
+// Messages carry reset and claim links, so production (APP_ENV=production)
+// refuses to only log them.
+func notifierFromEnv() (Notifier, error) {
+	production := os.Getenv("APP_ENV") == "production"
+	switch name := os.Getenv("NOTIFIER"); name {
+	case "smtp":
+		notifier, err := newSMTPNotifier(os.Getenv("SMTP_ADDR"), os.Getenv("SMTP_FROM"), os.Getenv("SMTP_USERNAME"), os.Getenv("SMTP_PASSWORD"))
+		if err != nil {
+			return nil, err
+		}
+		return notifier, nil
+	case "", "log":
+		if production {
+			return nil, errors.New("messages would only be logged in production, set NOTIFIER=smtp")
+		}
+		return logNotifier{}, nil
+	default:
+		return nil, fmt.Errorf("unknown NOTIFIER %q (expected \"smtp\" or \"log\")", name)
+	}
+}
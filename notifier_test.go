@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestNotifierFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		notifier string // type of the notifier, "" when an error is expected
+	}{
+		{"logs by default", map[string]string{}, "log"},
+		{"logs when asked", map[string]string{"NOTIFIER": "log"}, "log"},
+		{"refuses to log in production", map[string]string{"APP_ENV": "production"}, ""},
+		{"refuses to log in production when asked", map[string]string{"APP_ENV": "production", "NOTIFIER": "log"}, ""},
+		{"sends email", map[string]string{"NOTIFIER": "smtp", "SMTP_ADDR": "mail.example.com:587", "SMTP_FROM": "clinic@example.com"}, "smtp"},
+		{"sends email in production", map[string]string{"APP_ENV": "production", "NOTIFIER": "smtp", "SMTP_ADDR": "mail.example.com:587", "SMTP_FROM": "clinic@example.com"}, "smtp"},
+		{"needs a port", map[string]string{"NOTIFIER": "smtp", "SMTP_ADDR": "mail.example.com", "SMTP_FROM": "clinic@example.com"}, ""},
+		{"needs a sender", map[string]string{"NOTIFIER": "smtp", "SMTP_ADDR": "mail.example.com:587"}, ""},
+		{"rejects unknown notifiers", map[string]string{"NOTIFIER": "pigeon"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"APP_ENV", "NOTIFIER", "SMTP_ADDR", "SMTP_FROM", "SMTP_USERNAME", "SMTP_PASSWORD"} {
+				t.Setenv(key, tt.env[key])
+			}
+			notifier, err := notifierFromEnv()
+			var got string
+			switch notifier.(type) {
+			case logNotifier:
+				got = "log"
+			case *smtpNotifier:
+				got = "smtp"
+			}
+			if got != tt.notifier {
+				t.Errorf("got %s notifier, %v, want %q", got, err, tt.notifier)
+			}
+		})
+	}
+}
+
+func TestSMTPNotifierNotify(t *testing.T) {
+	notifier, err := newSMTPNotifier("mail.example.com:587", "clinic@example.com", "clinic", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent struct {
+		addr, from string
+		to         []string
+		msg        string
+		auth       smtp.Auth
+	}
+	notifier.sendMail = func(addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+		sent.addr, sent.auth, sent.from, sent.to, sent.msg = addr, a, from, to, string(msg)
+		return nil
+	}
+
+	if err := notifier.Notify(context.Background(), "p@x.com", "Reset your password", "Open\nhttps://example.com/reset?token=abc"); err != nil {
+		t.Fatal(err)
+	}
+	if sent.addr != "mail.example.com:587" || sent.auth == nil || sent.from != "clinic@example.com" || len(sent.to) != 1 || sent.to[0] != "p@x.com" {
+		t.Errorf("sent to the wrong place: %+v", sent)
+	}
+	for _, want := range []string{"To: p@x.com\r\n", "Subject: Reset your password\r\n", "\r\n\r\nOpen\r\nhttps://example.com/reset?token=abc"} {
+		if !strings.Contains(sent.msg, want) {
+			t.Errorf("message lacks %q:\n%s", want, sent.msg)
+		}
+	}
+
+	if err := notifier.Notify(context.Background(), "p@x.com\r\nBcc: q@x.com", "Hi", "body"); err == nil {
+		t.Errorf("a line break in a header was sent")
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	jwksMaxAge     = time.Hour   // how long fetched provider keys are used before refetching
+	jwksMinRefetch = time.Minute // unknown key IDs refetch the JWKS at most this often
+)
+
+// OIDCProvider is an identity provider whose ID tokens users can log in with
+type OIDCProvider struct {
+	Name     string `json:"name"`     // used in the login URL and to link users
+	Issuer   string `json:"issuer"`   // iss of the provider's ID tokens
+	Audience string `json:"audience"` // our client ID at the provider
+	JWKSURL  string `json:"jwksUrl"`  // where the provider publishes its signing keys
+	keys     oidcKeySource
+}
+
+// oidcKeySource finds the public key an ID token was signed with
+type oidcKeySource interface {
+	// publicKey returns the key with the given ID and the algorithm it signs
+	// with, or "" when the provider does not say
+	publicKey(ctx context.Context, kid string) (crypto.PublicKey, string, error)
+}
+
+// IDTokenClaims are the claims we read from an OIDC ID token
+type IDTokenClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	jwt.RegisteredClaims
+}
+
+// loadOIDCProviders reads the identity providers listed in a JSON file
+func loadOIDCProviders(path string) (map[string]*OIDCProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var providers []*OIDCProvider
+	if err := json.Unmarshal(data, &providers); err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*OIDCProvider)
+	for _, provider := range providers {
+		if provider.Name == "" || byName[provider.Name] != nil {
+			return nil, fmt.Errorf("provider names must be unique and non-empty, got %q", provider.Name)
+		}
+		if provider.Issuer == "" || provider.Audience == "" || provider.JWKSURL == "" {
+			return nil, fmt.Errorf("provider %s needs an issuer, audience and jwksUrl", provider.Name)
+		}
+		provider.keys = newJWKSCache(provider.JWKSURL)
+		byName[provider.Name] = provider
+	}
+	return byName, nil
+}
+
+// verify checks the signature and claims of an ID token issued to us by the
+// provider
+func (p *OIDCProvider) verify(ctx context.Context, idToken string) (*IDTokenClaims, error) {
+	parser := jwt.NewParser(
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodES256.Alg()}),
+		jwt.WithIssuer(p.Issuer),
+		jwt.WithAudience(p.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(tokenLeeway),
+	)
+	claims := &IDTokenClaims{}
+	_, err := parser.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, alg, err := p.keys.publicKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if alg != "" && alg != token.Method.Alg() {
+			return nil, fmt.Errorf("key %s does not use %s", kid, token.Method.Alg())
+		}
+		return key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+// jwksCache fetches a provider's JWKS and keeps it for jwksMaxAge
+type jwksCache struct {
+	url    string
+	client *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]providerKey
+	fetchedAt time.Time
+}
+
+type providerKey struct {
+	key       crypto.PublicKey
+	algorithm string
+}
+
+func newJWKSCache(url string) *jwksCache {
+	return &jwksCache{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (jc *jwksCache) publicKey(ctx context.Context, kid string) (crypto.PublicKey, string, error) {
+	jc.mu.Lock()
+	defer jc.mu.Unlock()
+
+	now := time.Now()
+	key, ok := jc.keys[kid]
+	stale := now.Sub(jc.fetchedAt) >= jwksMaxAge
+	// Providers publish new keys before using them, so an unknown key ID is
+	// worth one refetch, but not one per request
+	if stale || (!ok && now.Sub(jc.fetchedAt) >= jwksMinRefetch) {
+		if err := jc.fetch(ctx); err != nil {
+			if !ok {
+				return nil, "", err
+			}
+			log.Printf("Failed to refresh JWKS from %s, using cached keys: %v", jc.url, err)
+		} else {
+			key, ok = jc.keys[kid]
+		}
+	}
+	if !ok {
+		return nil, "", fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key.key, key.algorithm, nil
+}
+
+// fetch replaces the cached keys with the ones published at the JWKS URL;
+// the caller holds the lock
+func (jc *jwksCache) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jc.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := jc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS request failed with status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return err
+	}
+	keys := make(map[string]providerKey)
+	for _, entry := range set.Keys {
+		if entry.Use != "" && entry.Use != "sig" {
+			continue
+		}
+		key, err := parsePublicJWK(entry)
+		if err != nil {
+			// Providers may publish key types we do not use
+			continue
+		}
+		keys[entry.KeyID] = providerKey{key: key, algorithm: entry.Algorithm}
+	}
+	jc.keys = keys
+	jc.fetchedAt = time.Now()
+	return nil
+}
+
+// parsePublicJWK reads the public key of an EC P-256 or RSA JSON Web Key
+func parsePublicJWK(key jwk) (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding.DecodeString
+	switch key.KeyType {
+	case "EC":
+		if key.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", key.Curve)
+		}
+		x, err := b64(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		public := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !public.Curve.IsOnCurve(public.X, public.Y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return public, nil
+	case "RSA":
+		n, err := b64(key.Modulus)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64(key.Exponent)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("exponent is too large")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", key.KeyType)
+	}
+}
+
+// OIDCLoginRequest carries the ID token the frontend got from the provider
+type OIDCLoginRequest struct {
+	IDToken string `json:"idToken"`
+}
+
+// handleOIDCLogin starts a session for the user an ID token belongs to. An
+// account seen for the first time is linked to the user with its verified
+// email, or to a new user when there is none.
+func (s *Server) handleOIDCLogin(c *gin.Context) {
+	provider, ok := s.config.OIDCProviders[c.Param("provider")]
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "unknown identity provider"})
+		return
+	}
+	var req OIDCLoginRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims, err := provider.verify(c, req.IDToken)
+	if err != nil {
+		log.Printf("Rejected ID token from %s: %v", provider.Name, err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid ID token"})
+		return
+	}
+
+	identity := Identity{Provider: provider.Name, Subject: claims.Subject}
+	user, err := s.Users.FindByIdentity(c, identity.Provider, identity.Subject)
+	if err == ErrNotFound {
+		user, ok = s.linkIdentity(c, identity, claims)
+		if !ok {
+			return
+		}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
+		return
+	}
+
+	tokens, err := s.startSession(c, user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start session"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// linkIdentity links a new identity provider account to the user with the
+// account's email, creating the user if needed. Only emails the provider
+// verified are trusted, since anyone can put any email on an account.
+func (s *Server) linkIdentity(c *gin.Context, identity Identity, claims *IDTokenClaims) (User, bool) {
+	email := strings.TrimSpace(claims.Email)
+	if email == "" || !claims.EmailVerified {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "the identity provider has not verified this email"})
+		return User{}, false
+	}
+
+	user, err := s.Users.FindByEmail(c, email)
+	if err == ErrNotFound {
+		user = User{Name: claims.Name, Email: email, Identities: []Identity{identity}}
+		err = s.Users.Insert(c, &user)
+		if err == nil {
+			return user, true
+		}
+		if err != ErrDuplicateEmail {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to insert user"})
+			return User{}, false
+		}
+		// Another request created the user first; link the identity to it
+		user, err = s.Users.FindByEmail(c, email)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
+		return User{}, false
+	}
+
+	if err := s.Users.LinkIdentity(c, user.ID, identity); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to link identity"})
+		return User{}, false
+	}
+	user.Identities = append(user.Identities, identity)
+	return user, true
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	fakeIssuerName     = "fake"
+	fakeIssuerURL      = "https://fake-oidc.invalid"
+	fakeIssuerAudience = "go-doctor-fake-client"
+)
+
+// fakeIssuer signs ID tokens for any email, so OIDC logins can be tried
+// locally and in tests without a real identity provider. It must never be
+// enabled in production.
+type fakeIssuer struct {
+	keys *Keyring
+}
+
+func newFakeIssuer() (*fakeIssuer, error) {
+	keys, err := ephemeralKeyring()
+	if err != nil {
+		return nil, err
+	}
+	return &fakeIssuer{keys: keys}, nil
+}
+
+// fakeIssuerFromEnv returns the fake issuer when OIDC_FAKE_ISSUER is "true"
+// and nil otherwise. It lets anyone log in as any email, superadmins
+// included, so production (APP_ENV=production) refuses it.
+func fakeIssuerFromEnv() (*fakeIssuer, error) {
+	if os.Getenv("OIDC_FAKE_ISSUER") != "true" {
+		return nil, nil
+	}
+	if os.Getenv("APP_ENV") == "production" {
+		return nil, errors.New("the fake OIDC issuer lets anyone log in as any email, unset OIDC_FAKE_ISSUER in production")
+	}
+	return newFakeIssuer()
+}
+
+// provider returns the identity provider that accepts the issuer's tokens
+func (f *fakeIssuer) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Name:     fakeIssuerName,
+		Issuer:   fakeIssuerURL,
+		Audience: fakeIssuerAudience,
+		keys:     f,
+	}
+}
+
+func (f *fakeIssuer) publicKey(ctx context.Context, kid string) (crypto.PublicKey, string, error) {
+	key, ok := f.keys.verificationKey(kid, time.Now())
+	if !ok {
+		return nil, "", fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key.private.Public(), key.Algorithm, nil
+}
+
+// issue signs an ID token for a verified email; the subject is derived from
+// the email so the same email always logs in as the same account
+func (f *fakeIssuer) issue(email, name string) (string, error) {
+	now := time.Now()
+	key, err := f.keys.signingKey(now)
+	if err != nil {
+		return "", err
+	}
+	claims := &IDTokenClaims{
+		Email:         email,
+		EmailVerified: true,
+		Name:          name,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    fakeIssuerURL,
+			Subject:   "fake|" + strings.ToLower(email),
+			Audience:  jwt.ClaimStrings{fakeIssuerAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(5 * time.Minute)),
+		},
+	}
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.private)
+}
+
+// FakeIDTokenRequest names the user the fake issuer signs an ID token for
+type FakeIDTokenRequest struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+// handleFakeIDToken returns an ID token from the fake issuer, to be used
+// with POST /auth/oidc/fake
+func (s *Server) handleFakeIDToken(c *gin.Context) {
+	var req FakeIDTokenRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !strings.Contains(req.Email, "@") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "a valid email is required"})
+		return
+	}
+
+	idToken, err := s.config.FakeIssuer.issue(strings.TrimSpace(req.Email), req.Name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to sign ID token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"idToken": idToken})
+}
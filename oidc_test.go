@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// withFakeIssuer enables the fake OIDC issuer on a test server
+func (ts *testServer) withFakeIssuer() *testServer {
+	ts.t.Helper()
+	issuer, err := newFakeIssuer()
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.config.FakeIssuer = issuer
+	ts.config.OIDCProviders = map[string]*OIDCProvider{fakeIssuerName: issuer.provider()}
+	ts.router = gin.New()
+	if err := ts.setupRoutes(ts.router); err != nil {
+		ts.t.Fatal(err)
+	}
+	return ts
+}
+
+// fakeIDToken asks the fake issuer for an ID token for email
+func (ts *testServer) fakeIDToken(email string) string {
+	ts.t.Helper()
+	rec := ts.do("POST", "/fake-oidc/token", "", FakeIDTokenRequest{Email: email, Name: "Pat"})
+	expectStatus(ts.t, rec, http.StatusOK)
+	return decodeJSON[struct{ IDToken string }](ts.t, rec).IDToken
+}
+
+// unverifiedIDToken is an ID token of the fake issuer whose email the issuer
+// has not verified
+func unverifiedIDToken(t *testing.T, issuer *fakeIssuer, email string) string {
+	t.Helper()
+	now := time.Now()
+	key, err := issuer.keys.signingKey(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := jwt.NewWithClaims(key.method(), &IDTokenClaims{
+		Email: email,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    fakeIssuerURL,
+			Subject:   "fake|unverified",
+			Audience:  jwt.ClaimStrings{fakeIssuerAudience},
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute)),
+		},
+	})
+	token.Header["kid"] = key.ID
+	signed, err := token.SignedString(key.private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestOIDCLogin(t *testing.T) {
+	ts := newTestServer(t).withFakeIssuer()
+	other, err := newFakeIssuer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	foreign, err := other.issue("p@x.com", "Pat")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		provider string
+		idToken  string
+		status   int
+	}{
+		{"a token of the issuer", fakeIssuerName, ts.fakeIDToken("p@x.com"), http.StatusOK},
+		{"an unknown provider", "acme", ts.fakeIDToken("p@x.com"), http.StatusNotFound},
+		{"a token signed by someone else", fakeIssuerName, foreign, http.StatusUnauthorized},
+		{"a garbled token", fakeIssuerName, "not.a.token", http.StatusUnauthorized},
+		{"an unverified email", fakeIssuerName, unverifiedIDToken(t, ts.config.FakeIssuer, "q@x.com"), http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := ts.do("POST", "/auth/oidc/"+tt.provider, "", OIDCLoginRequest{IDToken: tt.idToken})
+			expectStatus(t, rec, tt.status)
+			if tt.status != http.StatusOK {
+				return
+			}
+			tokens := decodeJSON[tokens](t, rec)
+			expectStatus(t, ts.do("GET", "/bookings?email=p@x.com", tokens.AccessToken, nil), http.StatusOK)
+		})
+	}
+
+	expectStatus(t, ts.do("POST", "/fake-oidc/token", "", FakeIDTokenRequest{Email: "nobody"}), http.StatusBadRequest)
+}
+
+func TestOIDCLoginLinksAccounts(t *testing.T) {
+	ts := newTestServer(t).withFakeIssuer()
+	ctx := context.Background()
+	ts.register("p@x.com")
+
+	// Logging in twice links the provider account once, to the existing user
+	for i := 0; i < 2; i++ {
+		rec := ts.do("POST", "/auth/oidc/"+fakeIssuerName, "", OIDCLoginRequest{IDToken: ts.fakeIDToken("p@x.com")})
+		expectStatus(t, rec, http.StatusOK)
+	}
+	users, err := ts.Users.List(ctx)
+	if err != nil || len(users) != 1 {
+		t.Fatalf("got users %v, %v, want one", users, err)
+	}
+	if len(users[0].Identities) != 1 || users[0].Identities[0].Provider != fakeIssuerName {
+		t.Errorf("got identities %+v", users[0].Identities)
+	}
+
+	// A new email gets a new user
+	expectStatus(t, ts.do("POST", "/auth/oidc/"+fakeIssuerName, "", OIDCLoginRequest{IDToken: ts.fakeIDToken("q@x.com")}), http.StatusOK)
+	if _, err := ts.Users.FindByIdentity(ctx, fakeIssuerName, "fake|q@x.com"); err != nil {
+		t.Errorf("no user was created for a new email: %v", err)
+	}
+}
+
+func TestFakeIssuerFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		enabled bool
+		err     bool
+	}{
+		{"is off by default", map[string]string{}, false, false},
+		{"is on when asked", map[string]string{"OIDC_FAKE_ISSUER": "true"}, true, false},
+		{"is off in production", map[string]string{"APP_ENV": "production"}, false, false},
+		{"is refused in production", map[string]string{"APP_ENV": "production", "OIDC_FAKE_ISSUER": "true"}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"APP_ENV", "OIDC_FAKE_ISSUER"} {
+				t.Setenv(key, tt.env[key])
+			}
+			issuer, err := fakeIssuerFromEnv()
+			if (issuer != nil) != tt.enabled || (err != nil) != tt.err {
+				t.Errorf("got issuer %v, error %v; want enabled %v, error %v", issuer != nil, err, tt.enabled, tt.err)
+			}
+		})
+	}
+}
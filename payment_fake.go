@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Payment methods understood by fakeProvider. They follow the names of the
+// Stripe test payment methods so the same fixtures work against both.
+const (
+	fakeMethodSucceeds     = "pm_card_visa"
+	fakeMethodDeclined     = "pm_card_chargeDeclined"
+	fakeMethodRequires3DS  = "pm_card_authenticationRequired"
+	fakeMethodNetworkError = "pm_card_networkError"
+)
+
+// fakeProvider is a deterministic in-process PaymentProvider for local
+// development and tests. Intent and refund IDs are numbered in creation order
+// and the outcome of a confirmation depends only on the payment method used.
+type fakeProvider struct {
+	mu      sync.Mutex
+	intents map[string]*PaymentIntent
+	keys    map[string]string // idempotency key -> intent ID
+	seq     int
+}
+
+// newFakeProvider creates an empty fake payment provider
+func newFakeProvider() *fakeProvider {
+	return &fakeProvider{
+		intents: make(map[string]*PaymentIntent),
+		keys:    make(map[string]string),
+	}
+}
+
+func (p *fakeProvider) CreateIntent(ctx context.Context, params IntentParams) (PaymentIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if id, ok := p.keys[params.IdempotencyKey]; ok && params.IdempotencyKey != "" {
+		return *p.intents[id], nil
+	}
+	if params.Amount <= 0 {
+		return PaymentIntent{}, &PaymentError{Code: "parameter_invalid_integer", Message: "amount must be positive"}
+	}
+
+	p.seq++
+	id := fmt.Sprintf("pi_fake_%d", p.seq)
+	intent := &PaymentIntent{
+		ID:           id,
+		Amount:       params.Amount,
+		Currency:     params.Currency,
+		Status:       IntentRequiresPaymentMethod,
+		ClientSecret: id + "_secret_fake",
+		Metadata:     params.Metadata,
+	}
+	p.intents[id] = intent
+	if params.IdempotencyKey != "" {
+		p.keys[params.IdempotencyKey] = id
+	}
+	return *intent, nil
+}
+
+// Confirm charges the intent according to the payment method. A second
+// confirmation of an intent that required 3D Secure stands for the customer
+// completing the challenge and succeeds.
+func (p *fakeProvider) Confirm(ctx context.Context, intentID, paymentMethodID string) (PaymentIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return PaymentIntent{}, &PaymentError{Code: "resource_missing", Message: "no such payment intent"}
+	}
+	if intent.Status == IntentSucceeded || intent.Status == IntentCanceled {
+		return PaymentIntent{}, &PaymentError{Code: "payment_intent_unexpected_state", Message: fmt.Sprintf("payment intent is %s", intent.Status)}
+	}
+
+	switch paymentMethodID {
+	case fakeMethodNetworkError:
+		return PaymentIntent{}, fmt.Errorf("%w: simulated network error", ErrProviderUnavailable)
+	case fakeMethodDeclined:
+		intent.Status = IntentRequiresPaymentMethod
+		return PaymentIntent{}, &PaymentError{Code: "card_declined", DeclineCode: "generic_decline", Message: "Your card was declined."}
+	case fakeMethodRequires3DS:
+		if intent.Status == IntentRequiresAction {
+			intent.Status = IntentSucceeded
+		} else {
+			intent.Status = IntentRequiresAction
+		}
+	default:
+		intent.Status = IntentSucceeded
+	}
+	return *intent, nil
+}
+
+func (p *fakeProvider) Refund(ctx context.Context, intentID string, amount int64) (Refund, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return Refund{}, &PaymentError{Code: "resource_missing", Message: "no such payment intent"}
+	}
+	if intent.Status != IntentSucceeded {
+		return Refund{}, &PaymentError{Code: "charge_not_refundable", Message: "payment intent has not succeeded"}
+	}
+
+	remaining := intent.Amount - intent.AmountRefunded
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount <= 0 || amount > remaining {
+		return Refund{}, &PaymentError{Code: "amount_too_large", Message: "refund exceeds the amount left on the charge"}
+	}
+
+	intent.AmountRefunded += amount
+	p.seq++
+	return Refund{ID: fmt.Sprintf("re_fake_%d", p.seq), PaymentIntentID: intentID, Amount: amount, Status: "succeeded"}, nil
+}
+
+func (p *fakeProvider) Retrieve(ctx context.Context, intentID string) (PaymentIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	intent, ok := p.intents[intentID]
+	if !ok {
+		return PaymentIntent{}, &PaymentError{Code: "resource_missing", Message: "no such payment intent"}
+	}
+	return *intent, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestFakeProviderConfirm(t *testing.T) {
+	tests := []struct {
+		name    string
+		methods []string // confirmed in order; the last one decides the outcome
+		status  PaymentIntentStatus
+		code    string // code of the PaymentError, if one is expected
+		network bool   // whether ErrProviderUnavailable is expected
+	}{
+		{"a good card succeeds", []string{fakeMethodSucceeds}, IntentSucceeded, "", false},
+		{"a declined card fails", []string{fakeMethodDeclined}, "", "card_declined", false},
+		{"3D Secure needs action", []string{fakeMethodRequires3DS}, IntentRequiresAction, "", false},
+		{"3D Secure succeeds once completed", []string{fakeMethodRequires3DS, fakeMethodRequires3DS}, IntentSucceeded, "", false},
+		{"a decline can be retried with another card", []string{fakeMethodDeclined, fakeMethodSucceeds}, IntentSucceeded, "", false},
+		{"a network error is retryable", []string{fakeMethodNetworkError}, "", "", true},
+		{"a succeeded intent cannot be confirmed again", []string{fakeMethodSucceeds, fakeMethodSucceeds}, "", "payment_intent_unexpected_state", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			provider := newFakeProvider()
+			intent, err := provider.CreateIntent(ctx, IntentParams{Amount: 2000, Currency: "usd"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			id := intent.ID
+			for _, method := range tt.methods {
+				intent, err = provider.Confirm(ctx, id, method)
+			}
+			var paymentErr *PaymentError
+			switch {
+			case tt.network:
+				if !errors.Is(err, ErrProviderUnavailable) {
+					t.Fatalf("got %v, want a network error", err)
+				}
+			case tt.code != "":
+				if !errors.As(err, &paymentErr) || paymentErr.Code != tt.code {
+					t.Fatalf("got %v, want %s", err, tt.code)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case intent.Status != tt.status:
+				t.Fatalf("got status %s, want %s", intent.Status, tt.status)
+			}
+		})
+	}
+}
+
+func TestFakeProviderIdempotentIntents(t *testing.T) {
+	ctx := context.Background()
+	provider := newFakeProvider()
+	params := IntentParams{Amount: 2000, Currency: "usd", IdempotencyKey: "intent-1"}
+	first, _ := provider.CreateIntent(ctx, params)
+	second, _ := provider.CreateIntent(ctx, params)
+	if first.ID != second.ID {
+		t.Errorf("a retried request created a second intent: %s and %s", first.ID, second.ID)
+	}
+	other, _ := provider.CreateIntent(ctx, IntentParams{Amount: 2000, Currency: "usd"})
+	if other.ID == first.ID {
+		t.Errorf("intents without a key were merged")
+	}
+	if _, err := provider.CreateIntent(ctx, IntentParams{Amount: 0, Currency: "usd"}); err == nil {
+		t.Errorf("an intent for nothing was created")
+	}
+}
+
+func TestFakeProviderRefund(t *testing.T) {
+	tests := []struct {
+		name    string
+		amounts []int64 // refunded in order
+		ok      bool    // whether the last refund succeeds
+		left    int64   // refundable afterwards
+	}{
+		{"a partial refund", []int64{500}, true, 1500},
+		{"a zero amount refunds the rest", []int64{500, 0}, true, 0},
+		{"refunds cannot exceed the charge", []int64{1500, 1000}, false, 500},
+		{"a full refund", []int64{2000}, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			provider := newFakeProvider()
+			intent, _ := provider.CreateIntent(ctx, IntentParams{Amount: 2000, Currency: "usd"})
+			if _, err := provider.Confirm(ctx, intent.ID, fakeMethodSucceeds); err != nil {
+				t.Fatal(err)
+			}
+
+			var err error
+			for _, amount := range tt.amounts {
+				_, err = provider.Refund(ctx, intent.ID, amount)
+			}
+			if (err == nil) != tt.ok {
+				t.Fatalf("got %v, want success %v", err, tt.ok)
+			}
+			intent, _ = provider.Retrieve(ctx, intent.ID)
+			if left := intent.Amount - intent.AmountRefunded; left != tt.left {
+				t.Errorf("%d left to refund, want %d", left, tt.left)
+			}
+		})
+	}
+
+	provider := newFakeProvider()
+	intent, _ := provider.CreateIntent(context.Background(), IntentParams{Amount: 2000, Currency: "usd"})
+	if _, err := provider.Refund(context.Background(), intent.ID, 0); err == nil {
+		t.Errorf("an unpaid intent was refunded")
+	}
+}
+
+func TestPaymentProviderFromEnv(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		provider string // type of the provider, "" when an error is expected
+	}{
+		{"fakes payments by default", map[string]string{}, "fake"},
+		{"fakes payments when asked", map[string]string{"PAYMENT_PROVIDER": "fake"}, "fake"},
+		{"refuses to fake payments in production", map[string]string{"APP_ENV": "production"}, ""},
+		{"refuses to fake payments in production when asked", map[string]string{"APP_ENV": "production", "PAYMENT_PROVIDER": "fake"}, ""},
+		{"charges through stripe in production", map[string]string{"APP_ENV": "production", "PAYMENT_PROVIDER": "stripe", "STRIPE_KEY": "sk_test"}, "stripe"},
+		{"needs a stripe key", map[string]string{"PAYMENT_PROVIDER": "stripe"}, ""},
+		{"rejects unknown providers", map[string]string{"PAYMENT_PROVIDER": "barter"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"APP_ENV", "PAYMENT_PROVIDER", "STRIPE_KEY", "STRIPE_API_BASE"} {
+				t.Setenv(key, tt.env[key])
+			}
+			provider, err := paymentProviderFromEnv()
+			var got string
+			switch provider.(type) {
+			case *fakeProvider:
+				got = "fake"
+			case *stripeProvider:
+				got = "stripe"
+			}
+			if got != tt.provider {
+				t.Errorf("got %s provider, %v, want %q", got, err, tt.provider)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// PaymentIntentStatus mirrors the lifecycle of a Stripe payment intent
+type PaymentIntentStatus string
+
+const (
+	IntentRequiresPaymentMethod PaymentIntentStatus = "requires_payment_method"
+	IntentRequiresConfirmation  PaymentIntentStatus = "requires_confirmation"
+	IntentRequiresAction        PaymentIntentStatus = "requires_action" // e.g. 3D Secure
+	IntentProcessing            PaymentIntentStatus = "processing"
+	IntentSucceeded             PaymentIntentStatus = "succeeded"
+	IntentCanceled              PaymentIntentStatus = "canceled"
+)
+
+// PaymentIntent is a provider-side attempt to collect an amount
+type PaymentIntent struct {
+	ID             string              `json:"id"`
+	Amount         int64               `json:"amount"` // in minor units, e.g. cents
+	AmountRefunded int64               `json:"amountRefunded"`
+	Currency       string              `json:"currency"`
+	Status         PaymentIntentStatus `json:"status"`
+	ClientSecret   string              `json:"clientSecret"`
+	Metadata       map[string]string   `json:"metadata,omitempty"`
+}
+
+// IntentParams describes the payment intent to create
+type IntentParams struct {
+	Amount   int64 // in minor units
+	Currency string
+	Metadata map[string]string
+	// IdempotencyKey lets a retried request return the intent created by the first attempt
+	IdempotencyKey string
+}
+
+// Refund is money returned to the payer of an intent
+type Refund struct {
+	ID              string `json:"id"`
+	PaymentIntentID string `json:"paymentIntentId"`
+	Amount          int64  `json:"amount"` // in minor units
+	Status          string `json:"status"`
+}
+
+// PaymentProvider is the payment processor used to charge and refund patients
+type PaymentProvider interface {
+	CreateIntent(ctx context.Context, params IntentParams) (PaymentIntent, error)
+	// Confirm attempts to charge the intent with a payment method. An intent
+	// needing customer authentication comes back with IntentRequiresAction.
+	Confirm(ctx context.Context, intentID, paymentMethodID string) (PaymentIntent, error)
+	// Refund returns amount to the payer; an amount of 0 refunds whatever is left
+	Refund(ctx context.Context, intentID string, amount int64) (Refund, error)
+	Retrieve(ctx context.Context, intentID string) (PaymentIntent, error)
+}
+
+// ErrProviderUnavailable is returned when the provider cannot be reached or
+// fails on its side; the request may be retried
+var ErrProviderUnavailable = errors.New("payment provider unavailable")
+
+// PaymentError is returned when the provider rejects a request, for instance
+// because the card was declined
+type PaymentError struct {
+	Code        string `json:"code"`
+	DeclineCode string `json:"declineCode,omitempty"`
+	Message     string `json:"message"`
+}
+
+func (e *PaymentError) Error() string {
+	if e.DeclineCode != "" {
+		return fmt.Sprintf("%s (%s): %s", e.Code, e.DeclineCode, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// paymentProviderFromEnv returns the provider PAYMENT_PROVIDER selects,
+// "stripe" or "fake". The fake provider marks bookings paid without charging
+// anyone, so production (APP_ENV=production) refuses it.
+func paymentProviderFromEnv() (PaymentProvider, error) {
+	production := os.Getenv("APP_ENV") == "production"
+	switch name := os.Getenv("PAYMENT_PROVIDER"); name {
+	case "stripe":
+		stripeKey := os.Getenv("STRIPE_KEY")
+		if stripeKey == "" {
+			return nil, errors.New("STRIPE_KEY environment variable not set")
+		}
+		return newStripeProvider(stripeKey, os.Getenv("STRIPE_API_BASE")), nil
+	case "", "fake":
+		if production {
+			return nil, errors.New("the fake payment provider charges no one in production, set PAYMENT_PROVIDER=stripe")
+		}
+		// Deterministic in-process payments for local development and tests
+		return newFakeProvider(), nil
+	default:
+		return nil, fmt.Errorf("unknown PAYMENT_PROVIDER %q (expected \"stripe\" or \"fake\")", name)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const stripeAPIBase = "https://api.stripe.com/v1"
+
+// stripeProvider talks to the Stripe REST API, or any server speaking the same protocol
+type stripeProvider struct {
+	key     string
+	baseURL string
+	client  *http.Client
+}
+
+// newStripeProvider creates a provider authenticating with the given secret key
+func newStripeProvider(key, baseURL string) *stripeProvider {
+	if baseURL == "" {
+		baseURL = stripeAPIBase
+	}
+	return &stripeProvider{
+		key:     key,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// stripeIntent is the wire format of a Stripe payment intent
+type stripeIntent struct {
+	ID           string              `json:"id"`
+	Amount       int64               `json:"amount"`
+	Currency     string              `json:"currency"`
+	Status       PaymentIntentStatus `json:"status"`
+	ClientSecret string              `json:"client_secret"`
+	Metadata     map[string]string   `json:"metadata"`
+	// LatestCharge is the charge ID, or the charge object when expanded
+	LatestCharge json.RawMessage `json:"latest_charge"`
+}
+
+func (i stripeIntent) toIntent() PaymentIntent {
+	intent := PaymentIntent{
+		ID:           i.ID,
+		Amount:       i.Amount,
+		Currency:     i.Currency,
+		Status:       i.Status,
+		ClientSecret: i.ClientSecret,
+		Metadata:     i.Metadata,
+	}
+	var charge struct {
+		AmountRefunded int64 `json:"amount_refunded"`
+	}
+	if len(i.LatestCharge) > 0 && i.LatestCharge[0] == '{' && json.Unmarshal(i.LatestCharge, &charge) == nil {
+		intent.AmountRefunded = charge.AmountRefunded
+	}
+	return intent
+}
+
+func (p *stripeProvider) CreateIntent(ctx context.Context, params IntentParams) (PaymentIntent, error) {
+	form := url.Values{}
+	form.Set("amount", strconv.FormatInt(params.Amount, 10))
+	form.Set("currency", params.Currency)
+	form.Add("payment_method_types[]", "card")
+	for k, v := range params.Metadata {
+		form.Set("metadata["+k+"]", v)
+	}
+
+	var intent stripeIntent
+	if err := p.do(ctx, http.MethodPost, "/payment_intents", form, params.IdempotencyKey, &intent); err != nil {
+		return PaymentIntent{}, err
+	}
+	return intent.toIntent(), nil
+}
+
+func (p *stripeProvider) Confirm(ctx context.Context, intentID, paymentMethodID string) (PaymentIntent, error) {
+	form := url.Values{}
+	form.Set("payment_method", paymentMethodID)
+
+	var intent stripeIntent
+	if err := p.do(ctx, http.MethodPost, "/payment_intents/"+url.PathEscape(intentID)+"/confirm", form, "", &intent); err != nil {
+		return PaymentIntent{}, err
+	}
+	return intent.toIntent(), nil
+}
+
+func (p *stripeProvider) Refund(ctx context.Context, intentID string, amount int64) (Refund, error) {
+	form := url.Values{}
+	form.Set("payment_intent", intentID)
+	if amount > 0 {
+		form.Set("amount", strconv.FormatInt(amount, 10))
+	}
+
+	var refund struct {
+		ID            string `json:"id"`
+		Amount        int64  `json:"amount"`
+		Status        string `json:"status"`
+		PaymentIntent string `json:"payment_intent"`
+	}
+	if err := p.do(ctx, http.MethodPost, "/refunds", form, "", &refund); err != nil {
+		return Refund{}, err
+	}
+	return Refund{ID: refund.ID, PaymentIntentID: refund.PaymentIntent, Amount: refund.Amount, Status: refund.Status}, nil
+}
+
+func (p *stripeProvider) Retrieve(ctx context.Context, intentID string) (PaymentIntent, error) {
+	form := url.Values{}
+	form.Add("expand[]", "latest_charge")
+
+	var intent stripeIntent
+	if err := p.do(ctx, http.MethodGet, "/payment_intents/"+url.PathEscape(intentID), form, "", &intent); err != nil {
+		return PaymentIntent{}, err
+	}
+	return intent.toIntent(), nil
+}
+
+// do sends a form encoded request and decodes the JSON response into out,
+// turning Stripe error bodies into *PaymentError
+func (p *stripeProvider) do(ctx context.Context, method, path string, form url.Values, idempotencyKey string, out interface{}) error {
+	target := p.baseURL + path
+	var body *strings.Reader
+	if method == http.MethodGet {
+		target += "?" + form.Encode()
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(form.Encode())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.key, "")
+	if method != http.MethodGet {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrProviderUnavailable, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%w: status %d", ErrProviderUnavailable, resp.StatusCode)
+	}
+	if resp.StatusCode >= 400 {
+		var errBody struct {
+			Error struct {
+				Code        string `json:"code"`
+				DeclineCode string `json:"decline_code"`
+				Message     string `json:"message"`
+				Type        string `json:"type"`
+			} `json:"error"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&errBody); err != nil {
+			return fmt.Errorf("payment provider returned status %d", resp.StatusCode)
+		}
+		code := errBody.Error.Code
+		if code == "" {
+			code = errBody.Error.Type
+		}
+		return &PaymentError{Code: code, DeclineCode: errBody.Error.DeclineCode, Message: errBody.Error.Message}
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
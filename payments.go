@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	errHoldExpired       = errors.New("slot hold has expired")
+	errAmountMismatch    = errors.New("payment amount does not match booking price")
+	errInvalidTransition = errors.New("invalid booking status transition")
+	// errChargeRefunded is returned when a charge arrived after its hold
+	// lapsed and the slot was gone, so the charge was refunded
+	errChargeRefunded = errors.New("slot hold has expired, the payment was refunded")
+)
+
+// recordPayment checks payment against the booking it pays for, then stores it
+// and marks the booking paid. It is shared by the payments endpoint and the
+// payment webhook.
+func (s *Server) recordPayment(ctx context.Context, booking Booking, payment *Payment) error {
+	now := time.Now()
+	if booking.Paid {
+		return ErrDuplicatePayment
+	}
+	if booking.holdExpired(now) {
+		return errHoldExpired
+	}
+	if payment.Currency != s.config.Currency || payment.Amount != toMinorUnits(booking.Price, payment.Currency) {
+		return errAmountMismatch
+	}
+	payment.Status = PaymentSucceeded
+	payment.AmountRefunded = 0
+	payment.Refunds = nil
+	payment.Booking = paymentBookingFrom(booking)
+
+	from := booking.currentStatus()
+	if !canTransition(from, StatusPaid) {
+		return fmt.Errorf("%w: cannot move a %s booking to %s", errInvalidTransition, from, StatusPaid)
+	}
+	change := StatusChange{From: from, To: StatusPaid, At: now, By: booking.Email, Reason: "payment recorded"}
+
+	// The payment is stored and the booking marked paid in one atomic step;
+	// a duplicate payment for the booking is rejected by the store
+	err := s.Payments.Record(ctx, payment, change)
+	if err == ErrNotFound {
+		return errHoldExpired
+	}
+	return err
+}
+
+// settleIntent fetches a payment intent and, if it still needs a payment
+// method, confirms it with paymentMethodID
+func (s *Server) settleIntent(ctx context.Context, intentID, paymentMethodID string) (PaymentIntent, error) {
+	intent, err := s.provider.Retrieve(ctx, intentID)
+	if err != nil {
+		return intent, err
+	}
+	switch intent.Status {
+	case IntentRequiresPaymentMethod, IntentRequiresConfirmation, IntentRequiresAction:
+		if paymentMethodID == "" {
+			return intent, nil
+		}
+		return s.provider.Confirm(ctx, intentID, paymentMethodID)
+	}
+	return intent, nil
+}
+
+// recordLateCharge records a succeeded charge for a booking whose hold lapsed
+// before the charge arrived. The slot is reserved for the booking again when
+// it is still free; otherwise the charge is refunded so the patient does not
+// pay for a slot they do not have.
+func (s *Server) recordLateCharge(ctx context.Context, booking Booking, payment *Payment) error {
+	now := time.Now()
+	expiresAt := now.Add(s.config.HoldTTL)
+	booking.HoldExpiresAt = &expiresAt
+	err := s.Bookings.Insert(ctx, &booking)
+	if err == ErrSlotTaken {
+		// Another delivery of the same charge may have reserved it again first
+		if current, findErr := s.Bookings.FindByID(ctx, booking.ID); findErr == nil && current.occupiesSlot(now) {
+			booking, err = current, nil
+		}
+	}
+	if err == nil {
+		err = s.recordPayment(ctx, booking, payment)
+		if err == nil || err == ErrDuplicatePayment {
+			return err
+		}
+	}
+
+	log.Printf("Refunding charge %s for booking %s, its slot could not be reserved again: %v", payment.TransactionID, booking.ID.Hex(), err)
+	if err := s.refundCharge(ctx, payment.TransactionID); err != nil {
+		return fmt.Errorf("refunding charge %s: %w", payment.TransactionID, err)
+	}
+	return errChargeRefunded
+}
+
+// refundCharge returns whatever is left of a succeeded charge to the payer
+func (s *Server) refundCharge(ctx context.Context, intentID string) error {
+	intent, err := s.provider.Retrieve(ctx, intentID)
+	if err != nil {
+		return err
+	}
+	if intent.Status != IntentSucceeded || intent.AmountRefunded >= intent.Amount {
+		return nil
+	}
+	_, err = s.provider.Refund(ctx, intentID, 0)
+	return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// RefundTier gives back Percent of a payment when a booking is cancelled at
+// least MinNotice before the appointment starts
+type RefundTier struct {
+	MinNotice time.Duration
+	Percent   int64
+}
+
+// CancellationPolicy decides how much a patient gets back when cancelling a
+// paid booking
+type CancellationPolicy []RefundTier
+
+// defaultCancellationPolicy refunds in full up to 24h before the appointment and half after that
+var defaultCancellationPolicy = CancellationPolicy{
+	{MinNotice: 24 * time.Hour, Percent: 100},
+	{MinNotice: 0, Percent: 50},
+}
+
+// parseCancellationPolicy reads a policy written as comma separated
+// "<notice>:<percent>" tiers, e.g. "24h:100,0:50"
+func parseCancellationPolicy(spec string) (CancellationPolicy, error) {
+	var policy CancellationPolicy
+	for _, part := range strings.Split(spec, ",") {
+		notice, percent, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid refund tier %q", part)
+		}
+		minNotice, err := time.ParseDuration(notice)
+		if err != nil {
+			return nil, fmt.Errorf("invalid refund tier %q: %v", part, err)
+		}
+		pct, err := strconv.ParseInt(percent, 10, 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return nil, fmt.Errorf("invalid refund percentage in %q", part)
+		}
+		policy = append(policy, RefundTier{MinNotice: minNotice, Percent: pct})
+	}
+	sort.Slice(policy, func(i, j int) bool { return policy[i].MinNotice > policy[j].MinNotice })
+	return policy, nil
+}
+
+// refundPercent returns the share of the payment refunded with the given notice
+func (p CancellationPolicy) refundPercent(notice time.Duration) int64 {
+	for _, tier := range p {
+		if notice >= tier.MinNotice {
+			return tier.Percent
+		}
+	}
+	return 0
+}
+
+// RefundRequest is the body accepted by the admin refund endpoint
+type RefundRequest struct {
+	Amount int64  `json:"amount"` // in minor units; 0 refunds what is left
+	Reason string `json:"reason"`
+}
+
+var errNothingToRefund = errors.New("nothing left to refund")
+
+// refundPayment returns amount of payment through the payment provider and
+// records it in the payment's refund history
+func (s *Server) refundPayment(ctx context.Context, payment Payment, amount int64, by, reason string) (Payment, error) {
+	if amount <= 0 || amount > payment.netAmount() {
+		return payment, errNothingToRefund
+	}
+
+	refund, err := s.provider.Refund(ctx, payment.TransactionID, amount)
+	if err != nil {
+		return payment, err
+	}
+	return s.Payments.AddRefund(ctx, payment.ID, RefundRecord{
+		ID:     refund.ID,
+		Amount: refund.Amount,
+		Reason: reason,
+		By:     by,
+		At:     time.Now(),
+	})
+}
+
+// refundCancelledBooking refunds a cancelled paid booking. Cancellations by
+// staff are refunded in full; patients get the share set by the cancellation
+// policy.
+func (s *Server) refundCancelledBooking(ctx context.Context, booking Booking, by string) (Payment, error) {
+	payment, err := s.Payments.FindByBooking(ctx, booking.ID)
+	if err != nil {
+		return payment, err
+	}
+
+	amount := payment.netAmount()
+	reason := "cancelled by clinic"
+	if by == booking.Email {
+		start, err := booking.startTime(s.config.ClinicLocation)
+		if err != nil {
+			return payment, err
+		}
+		percent := s.config.CancellationPolicy.refundPercent(time.Until(start))
+		amount = payment.Amount * percent / 100
+		if amount > payment.netAmount() {
+			amount = payment.netAmount()
+		}
+		reason = fmt.Sprintf("cancelled by patient, %d%% refund", percent)
+	}
+	if amount == 0 {
+		return payment, nil
+	}
+	return s.refundPayment(ctx, payment, amount, by, reason)
+}
+
+func (s *Server) handleRefundBooking(c *gin.Context) {
+	bookingID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid booking ID"})
+		return
+	}
+
+	var req RefundRequest
+	if err := c.ShouldBindJSON(&req); err != nil && c.Request.ContentLength > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Amount < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "refund amount cannot be negative"})
+		return
+	}
+
+	payment, err := s.Payments.FindByBooking(c, bookingID)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "booking has no payment"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch payment"})
+		}
+		return
+	}
+
+	amount := req.Amount
+	if amount == 0 {
+		amount = payment.netAmount()
+	}
+	payment, err = s.refundPayment(c, payment, amount, callerName(c), req.Reason)
+	if err != nil {
+		if err == errNothingToRefund {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "refund exceeds the amount left on the payment"})
+		} else if err == ErrRefundExceeded {
+			c.JSON(http.StatusConflict, gin.H{"error": "payment was refunded meanwhile, please retry"})
+		} else {
+			respondPaymentError(c, err, "failed to refund payment")
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment": payment, "netAmount": payment.netAmount()})
+}
+
+func (s *Server) handleGetBookingPayment(c *gin.Context) {
+	booking, _, ok := s.loadAccessibleBooking(c, PermPaymentsReadAny)
+	if !ok {
+		return
+	}
+
+	payment, err := s.Payments.FindByBooking(c, booking.ID)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "booking has no payment"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch payment"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"payment": payment, "netAmount": payment.netAmount()})
+}
+
+// handleGetPaymentsReport lists the net amount collected for every paid booking
+func (s *Server) handleGetPaymentsReport(c *gin.Context) {
+	payments, err := s.Payments.List(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch payments"})
+		return
+	}
+
+	report := []gin.H{}
+	for _, payment := range payments {
+		report = append(report, gin.H{
+			"bookingId":     payment.Booking.ID,
+			"transactionId": payment.TransactionID,
+			"currency":      payment.Currency,
+			"amount":        payment.Amount,
+			"refunded":      payment.AmountRefunded,
+			"netAmount":     payment.netAmount(),
+			"status":        payment.Status,
+		})
+	}
+
+	c.JSON(http.StatusOK, report)
+}
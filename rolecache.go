@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// roleCache decides which roles a request is authorized with without reading
+// the user on every call. Access tokens carry the roles the user had when the
+// token was issued; those are trusted for ttl after issuing, and after that
+// the roles are read from the store and kept for ttl. A role change on this
+// instance takes effect at once, and one made elsewhere within ttl.
+type roleCache struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[primitive.ObjectID]roleCacheEntry
+}
+
+type roleCacheEntry struct {
+	roles     []Role
+	loadedAt  time.Time // zero when the roles have to be read again
+	changedAt time.Time // tokens issued before this carry stale roles
+}
+
+func newRoleCache(ttl time.Duration) *roleCache {
+	return &roleCache{ttl: ttl, entries: make(map[primitive.ObjectID]roleCacheEntry)}
+}
+
+// roles returns the roles of a user who presented a token issued at issuedAt
+// carrying tokenRoles, loading them with load when neither the cache nor the
+// token is fresh enough
+func (rc *roleCache) roles(ctx context.Context, userID primitive.ObjectID, tokenRoles []Role, issuedAt time.Time, load func(context.Context, primitive.ObjectID) (User, error)) ([]Role, error) {
+	now := time.Now()
+	rc.mu.Lock()
+	entry, ok := rc.entries[userID]
+	rc.mu.Unlock()
+
+	if ok && !entry.loadedAt.IsZero() && now.Sub(entry.loadedAt) < rc.ttl {
+		return entry.roles, nil
+	}
+	if now.Sub(issuedAt) < rc.ttl && issuedAt.After(entry.changedAt) {
+		return tokenRoles, nil
+	}
+
+	user, err := load(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	rc.mu.Lock()
+	rc.prune(now)
+	// A change made while loading wins over what was read
+	if current := rc.entries[userID]; !current.changedAt.After(now) {
+		rc.entries[userID] = roleCacheEntry{roles: user.Roles, loadedAt: now, changedAt: current.changedAt}
+	}
+	rc.mu.Unlock()
+	return user.Roles, nil
+}
+
+// invalidate forgets the roles of a user after they changed, including the
+// ones carried by tokens issued before now
+func (rc *roleCache) invalidate(userID primitive.ObjectID) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.prune(time.Now())
+	rc.entries[userID] = roleCacheEntry{changedAt: time.Now()}
+}
+
+// prune drops entries that no longer affect any decision: their roles have
+// expired and every token issued before their change is past ttl
+func (rc *roleCache) prune(now time.Time) {
+	for id, entry := range rc.entries {
+		if now.Sub(entry.loadedAt) >= rc.ttl && now.Sub(entry.changedAt) >= rc.ttl {
+			delete(rc.entries, id)
+		}
+	}
+}
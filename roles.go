@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Role is a set of permissions granted to a user. Every user is a patient;
+// the other roles are granted on top of that.
+type Role string
+
+const (
+	RolePatient      Role = "patient"
+	RoleDoctor       Role = "doctor"
+	RoleReceptionist Role = "receptionist"
+	RoleAdmin        Role = "admin"
+	RoleSuperAdmin   Role = "superadmin"
+)
+
+// Permission allows an action, written as "<resource>:<action>[:<scope>]".
+// Acting on your own bookings needs no permission; the ":any" scope extends
+// the action to everyone's.
+type Permission string
+
+const (
+	PermBookingsReadAny      Permission = "bookings:read:any"
+	PermBookingsReadOwnTreat Permission = "bookings:read:treatment" // bookings for the doctor's specialty
+	PermBookingsWriteAny     Permission = "bookings:write:any"
+	PermBookingsRefund       Permission = "bookings:refund"
+	PermPaymentsReadAny      Permission = "payments:read:any"
+	PermDoctorsRead          Permission = "doctors:read"
+	PermDoctorsWrite         Permission = "doctors:write"
+	PermUsersRead            Permission = "users:read"
+	PermUsersWrite           Permission = "users:write"
+	PermUsersGrantRoles      Permission = "users:roles:grant"
+	PermUsersGrantPrivileged Permission = "users:roles:grant:privileged" // admin and superadmin
+	PermUsersRevokeSessions  Permission = "users:sessions:revoke"
+	PermAPIKeysManage        Permission = "apikeys:manage"
+	PermBlackoutsManage      Permission = "blackouts:manage" // holidays, leave and blocked slots
+)
+
+// rolePermissions lists what each role may do
+var rolePermissions = map[Role][]Permission{
+	RolePatient: {},
+	RoleDoctor: {
+		PermBookingsReadOwnTreat, PermDoctorsRead,
+	},
+	RoleReceptionist: {
+		PermBookingsReadAny, PermBookingsWriteAny, PermDoctorsRead, PermUsersRead, PermUsersWrite,
+	},
+	RoleAdmin: {
+		PermBookingsReadAny, PermBookingsWriteAny, PermBookingsRefund, PermPaymentsReadAny,
+		PermDoctorsRead, PermDoctorsWrite, PermUsersRead, PermUsersWrite,
+		PermUsersGrantRoles, PermUsersRevokeSessions, PermAPIKeysManage, PermBlackoutsManage,
+	},
+	RoleSuperAdmin: {
+		PermBookingsReadAny, PermBookingsWriteAny, PermBookingsRefund, PermPaymentsReadAny,
+		PermDoctorsRead, PermDoctorsWrite, PermUsersRead, PermUsersWrite,
+		PermUsersGrantRoles, PermUsersRevokeSessions, PermUsersGrantPrivileged,
+		PermAPIKeysManage, PermBlackoutsManage,
+	},
+}
+
+// privilegedRoles can only be granted and revoked with PermUsersGrantPrivileged
+var privilegedRoles = map[Role]bool{RoleAdmin: true, RoleSuperAdmin: true}
+
+func (r Role) valid() bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+// hasRole reports whether the user was granted role
+func (u User) hasRole(role Role) bool {
+	if role == RolePatient {
+		return true
+	}
+	for _, r := range u.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// can reports whether any of the user's roles grants perm
+func (u User) can(perm Permission) bool {
+	for _, role := range u.Roles {
+		for _, p := range rolePermissions[role] {
+			if p == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// privileged reports whether the user holds a privileged role
+func (u User) privileged() bool {
+	for _, role := range u.Roles {
+		if privilegedRoles[role] {
+			return true
+		}
+	}
+	return false
+}
+
+// RoleRequest names the role to grant to a user
+type RoleRequest struct {
+	Role Role `json:"role"`
+}
+
+// loadRoleTarget fetches the user whose roles are changed and checks that the
+// caller may change them. Users cannot change their own roles, and only
+// holders of PermUsersGrantPrivileged may touch privileged roles or users.
+func (s *Server) loadRoleTarget(c *gin.Context, roles ...Role) (User, bool) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return User{}, false
+	}
+	target, err := s.Users.FindByID(c, id)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
+		}
+		return User{}, false
+	}
+
+	actor, ok := s.currentUser(c)
+	if !ok {
+		return User{}, false
+	}
+	if actor.ID == target.ID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "you cannot change your own roles"})
+		return User{}, false
+	}
+	needsPrivilege := target.privileged()
+	for _, role := range roles {
+		needsPrivilege = needsPrivilege || privilegedRoles[role]
+	}
+	if needsPrivilege && !actor.can(PermUsersGrantPrivileged) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "forbidden access"})
+		return User{}, false
+	}
+	return target, true
+}
+
+// grantRole adds role to the user in the URL and replies with the number of
+// modified users
+func (s *Server) grantRole(c *gin.Context, role Role) {
+	if !role.valid() || role == RolePatient {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown or implicit role"})
+		return
+	}
+	target, ok := s.loadRoleTarget(c, role)
+	if !ok {
+		return
+	}
+
+	modified, err := s.Users.GrantRole(c, target.ID, role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user role"})
+		return
+	}
+	s.roles.invalidate(target.ID)
+
+	c.JSON(http.StatusOK, gin.H{"ModifiedCount": modified})
+}
+
+func (s *Server) handleGrantRole(c *gin.Context) {
+	var req RoleRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	s.grantRole(c, req.Role)
+}
+
+func (s *Server) handleRevokeRole(c *gin.Context) {
+	role := Role(c.Param("role"))
+	if !role.valid() || role == RolePatient {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown or implicit role"})
+		return
+	}
+	target, ok := s.loadRoleTarget(c, role)
+	if !ok {
+		return
+	}
+
+	modified, err := s.Users.RevokeRole(c, target.ID, role)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user role"})
+		return
+	}
+	s.roles.invalidate(target.ID)
+
+	c.JSON(http.StatusOK, gin.H{"ModifiedCount": modified})
+}
+
+// handleDemoteUser takes every staff role away from a user, leaving a patient
+func (s *Server) handleDemoteUser(c *gin.Context) {
+	target, ok := s.loadRoleTarget(c)
+	if !ok {
+		return
+	}
+
+	if err := s.Users.SetRoles(c, target.ID, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update user role"})
+		return
+	}
+	s.roles.invalidate(target.ID)
+
+	c.JSON(http.StatusOK, gin.H{"roles": []Role{}})
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// workingHoursLayout is how WorkingHours.Start and End are written
+const workingHoursLayout = "15:04"
+
+// validate returns why the schedule cannot be used, or nil if it can
+func (ts TreatmentSchedule) validate() error {
+	if ts.Treatment == "" {
+		return errors.New("schedule needs a treatment")
+	}
+	if ts.SlotMinutes < 5 || ts.SlotMinutes > 8*60 {
+		return fmt.Errorf("%s: slotMinutes must be between 5 and 480", ts.Treatment)
+	}
+	if ts.BufferMinutes < 0 || ts.BufferMinutes > 4*60 {
+		return fmt.Errorf("%s: bufferMinutes must be between 0 and 240", ts.Treatment)
+	}
+	for _, hours := range ts.Hours {
+		if hours.Weekday < time.Sunday || hours.Weekday > time.Saturday {
+			return fmt.Errorf("%s: weekday must be 0 (Sunday) to 6 (Saturday)", ts.Treatment)
+		}
+		start, err := time.Parse(workingHoursLayout, hours.Start)
+		if err != nil {
+			return fmt.Errorf("%s: start %q is not a time like 09:00", ts.Treatment, hours.Start)
+		}
+		end, err := time.Parse(workingHoursLayout, hours.End)
+		if err != nil {
+			return fmt.Errorf("%s: end %q is not a time like 17:00", ts.Treatment, hours.End)
+		}
+		if !end.After(start) {
+			return fmt.Errorf("%s: working hours on %s end before they start", ts.Treatment, hours.Weekday)
+		}
+	}
+	return nil
+}
+
+// generatedSlot is a slot laid out by a schedule
+type generatedSlot struct {
+	start, end time.Time
+	label      string
+}
+
+// slotsOn lays out the slots the schedule offers on day, midnight in the
+// clinic's time zone. Slots last their real length across daylight saving
+// changes, so their wall clock times shift with the change.
+func (ts TreatmentSchedule) slotsOn(day time.Time) []generatedSlot {
+	length := time.Duration(ts.SlotMinutes) * time.Minute
+	step := length + time.Duration(ts.BufferMinutes)*time.Minute
+	var slots []generatedSlot
+	for _, hours := range ts.Hours {
+		if hours.Weekday != day.Weekday() {
+			continue
+		}
+		startClock, err1 := time.Parse(workingHoursLayout, hours.Start)
+		endClock, err2 := time.Parse(workingHoursLayout, hours.End)
+		if err1 != nil || err2 != nil || length <= 0 {
+			continue
+		}
+		end := atClock(day, endClock)
+		for at := atClock(day, startClock); !at.Add(length).After(end); at = at.Add(step) {
+			label := formatSlot(at, at.Add(length))
+			// When clocks go back a label can name two different slots; only
+			// offer slots whose label reads back as the same times
+			if start, finish, err := slotTimes(day, label); err != nil || !start.Equal(at) || !finish.Equal(at.Add(length)) {
+				continue
+			}
+			slots = append(slots, generatedSlot{start: at, end: at.Add(length), label: label})
+		}
+	}
+	return slots
+}
+
+// applySchedules replaces the slots of every option that some doctor has a
+// schedule for with the slots the schedules offer on day, leaving out those
+// of doctors on leave, and records which doctors offer each slot. Options no
+// doctor has a schedule for keep their fixed slots. Options are modified in
+// place.
+func applySchedules(options []AppointmentOption, doctors []Doctor, blackouts []Blackout, day time.Time) {
+	scheduled := make(map[string]map[string]generatedSlot)
+	offering := make(map[string]map[string][]primitive.ObjectID)
+	for _, doctor := range doctors {
+		for _, schedule := range doctor.Schedules {
+			if scheduled[schedule.Treatment] == nil {
+				scheduled[schedule.Treatment] = make(map[string]generatedSlot)
+				offering[schedule.Treatment] = make(map[string][]primitive.ObjectID)
+			}
+			// Doctors offering the same time share its label, and each of
+			// them can be booked for it
+			for _, slot := range schedule.slotsOn(day) {
+				if onLeave(blackouts, doctor.ID, slot.start, slot.end) {
+					continue
+				}
+				scheduled[schedule.Treatment][slot.label] = slot
+				if ids := offering[schedule.Treatment][slot.label]; len(ids) == 0 || ids[len(ids)-1] != doctor.ID {
+					offering[schedule.Treatment][slot.label] = append(ids, doctor.ID)
+				}
+			}
+		}
+	}
+
+	for i := range options {
+		byLabel, ok := scheduled[options[i].Name]
+		if !ok {
+			continue
+		}
+		options[i].doctors = offering[options[i].Name]
+		slots := make([]generatedSlot, 0, len(byLabel))
+		for _, slot := range byLabel {
+			slots = append(slots, slot)
+		}
+		sort.Slice(slots, func(a, b int) bool {
+			if !slots[a].start.Equal(slots[b].start) {
+				return slots[a].start.Before(slots[b].start)
+			}
+			return slots[a].label < slots[b].label
+		})
+		options[i].Slots = make([]string, len(slots))
+		for j, slot := range slots {
+			options[i].Slots[j] = slot.label
+		}
+	}
+}
+
+// scheduleOptions gives options the slots offered on date, which must be a
+// valid appointment date: those the doctors' schedules lay out or the fixed
+// ones, less the slots closed by blackouts
+func (s *Server) scheduleOptions(ctx context.Context, options []AppointmentOption, date string) error {
+	day, doctors, blackouts, err := s.loadDay(ctx, date)
+	if err != nil {
+		return err
+	}
+	applySchedules(options, doctors, blackouts, day)
+	removeClosedSlots(options, doctors, blackouts, day)
+	return nil
+}
+
+// reserveWithDoctor runs reserve, which stores booking in its slot, with
+// each doctor offering the slot in option in turn until one of them is free.
+// Bookings in the slot without a doctor are given one first, so they take up
+// a doctor's place as they do in availability. Fixed slots are reserved once
+// without a doctor. It fails with ErrSlotTaken when every doctor is booked.
+func (s *Server) reserveWithDoctor(ctx context.Context, option AppointmentOption, booking *Booking, reserve func() error) error {
+	doctors := option.doctors[booking.Slot]
+	if len(doctors) == 0 {
+		booking.DoctorID = nil
+		return reserve()
+	}
+	if err := s.Bookings.AssignDoctors(ctx, booking.Treatment, booking.AppointmentDate, booking.Slot, doctors); err != nil {
+		return err
+	}
+	for _, id := range doctors {
+		id := id
+		booking.DoctorID = &id
+		if err := reserve(); err != ErrSlotTaken {
+			return err
+		}
+	}
+	booking.DoctorID = nil
+	return ErrSlotTaken
+}
+
+// handlePutDoctorSchedules replaces the weekly schedules of a doctor
+func (s *Server) handlePutDoctorSchedules(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid doctor ID"})
+		return
+	}
+	var schedules []TreatmentSchedule
+	if err := c.BindJSON(&schedules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !s.checkSchedules(c, schedules) {
+		return
+	}
+
+	if err := s.Doctors.SetSchedules(c, id, schedules); err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "doctor not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update schedules"})
+		}
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"schedules": schedules})
+}
+
+// checkSchedules validates schedules and checks that their treatments exist,
+// replying with an error when they do not
+func (s *Server) checkSchedules(c *gin.Context, schedules []TreatmentSchedule) bool {
+	for _, schedule := range schedules {
+		if err := schedule.validate(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return false
+		}
+		if _, err := s.AppointmentOptions.FindByName(c, schedule.Treatment); err != nil {
+			if err == ErrNotFound {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "unknown treatment " + schedule.Treatment})
+			} else {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment option"})
+			}
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// addDoctor stores a doctor offering Teeth Cleaning in 30 minute slots from
+// 08:00 to 09:00 on the weekday of testDate
+func (ts *testServer) addDoctor(name string) Doctor {
+	ts.t.Helper()
+	day, err := parseAppointmentDate(testDate, ts.config.ClinicLocation)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	doctor := Doctor{Name: name, Email: name + "@clinic.com", Specialty: "Teeth Cleaning", Schedules: []TreatmentSchedule{{
+		Treatment:   "Teeth Cleaning",
+		SlotMinutes: 30,
+		Hours:       []WorkingHours{{Weekday: day.Weekday(), Start: "08:00", End: "09:00"}},
+	}}}
+	if err := ts.Doctors.Insert(context.Background(), &doctor); err != nil {
+		ts.t.Fatal(err)
+	}
+	return doctor
+}
+
+func TestScheduledSlotsBookablePerDoctor(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addDoctor("ann")
+	ts.addDoctor("bob")
+
+	tests := []struct {
+		patient string
+		status  int
+		free    []string // slots listed afterwards
+	}{
+		{"p1@x.com", http.StatusOK, []string{testSlots[0], testSlots[1]}},
+		{"p2@x.com", http.StatusOK, []string{testSlots[1]}},
+		{"p3@x.com", http.StatusConflict, []string{testSlots[1]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.patient, func(t *testing.T) {
+			rec := ts.do("POST", "/bookings", ts.login(tt.patient), bookingRequest{testDate, "Teeth Cleaning", testSlots[0], tt.patient})
+			expectStatus(t, rec, tt.status)
+
+			rec = ts.do("GET", "/v2/appointmentOptions?date=2099-01-05", "", nil)
+			expectStatus(t, rec, http.StatusOK)
+			options := decodeJSON[[]AppointmentOption](t, rec)
+			if got := fmt.Sprint(options[0].Slots); got != fmt.Sprint(tt.free) {
+				t.Errorf("got slots %s, want %v", got, tt.free)
+			}
+		})
+	}
+
+	// The two bookings of the slot went to different doctors
+	bookings, _ := ts.Bookings.FindByDate(context.Background(), testDate)
+	if len(bookings) != 2 || bookings[0].DoctorID == nil || bookings[1].DoctorID == nil || *bookings[0].DoctorID == *bookings[1].DoctorID {
+		t.Errorf("bookings were not spread over the doctors: %+v", bookings)
+	}
+}
+
+func TestScheduledSlotsSkipDoctorsOnLeave(t *testing.T) {
+	ts := newTestServer(t)
+	ann := ts.addDoctor("ann")
+	bob := ts.addDoctor("bob")
+	day, _ := parseAppointmentDate(testDate, ts.config.ClinicLocation)
+	leave := Blackout{Kind: BlackoutLeave, DoctorID: &ann.ID, StartsAt: day, EndsAt: day.AddDate(0, 0, 1), CreatedAt: time.Now()}
+	if err := ts.Blackouts.Insert(context.Background(), &leave); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := ts.do("POST", "/bookings", ts.login("p1@x.com"), bookingRequest{testDate, "Teeth Cleaning", testSlots[0], "p1@x.com"})
+	expectStatus(t, rec, http.StatusOK)
+	rec = ts.do("POST", "/bookings", ts.login("p2@x.com"), bookingRequest{testDate, "Teeth Cleaning", testSlots[0], "p2@x.com"})
+	expectStatus(t, rec, http.StatusConflict)
+
+	bookings, _ := ts.Bookings.FindByDate(context.Background(), testDate)
+	if len(bookings) != 1 || bookings[0].DoctorID == nil || *bookings[0].DoctorID != bob.ID {
+		t.Errorf("the booking did not go to the doctor at work: %+v", bookings)
+	}
+}
+
+func TestScheduledSlotsCountBookingsWithoutDoctor(t *testing.T) {
+	tests := []struct {
+		doctors int
+		booked  int // new bookings of the slot that succeed
+	}{
+		{1, 0},
+		{2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%d doctors", tt.doctors), func(t *testing.T) {
+			ts := newTestServer(t)
+			for i := 0; i < tt.doctors; i++ {
+				ts.addDoctor(fmt.Sprintf("doctor%d", i))
+			}
+			// Booked before the slot came from schedules
+			legacy := Booking{AppointmentDate: testDate, Treatment: "Teeth Cleaning", Slot: testSlots[0], Email: "old@x.com", Status: StatusConfirmed}
+			if err := ts.Bookings.Insert(context.Background(), &legacy); err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i <= tt.booked; i++ {
+				patient := fmt.Sprintf("p%d@x.com", i)
+				want := http.StatusOK
+				if i == tt.booked {
+					want = http.StatusConflict
+				}
+				rec := ts.do("POST", "/bookings", ts.login(patient), bookingRequest{testDate, "Teeth Cleaning", testSlots[0], patient})
+				expectStatus(t, rec, want)
+			}
+
+			legacy, err := ts.Bookings.FindByID(context.Background(), legacy.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if legacy.DoctorID == nil {
+				t.Errorf("the booking without a doctor was not given one")
+			}
+		})
+	}
+}
+
+func TestFreeSlots(t *testing.T) {
+	ann, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	option := AppointmentOption{
+		Slots:   []string{"a", "b", "fixed"},
+		doctors: map[string][]primitive.ObjectID{"a": {ann, bob}, "b": {ann, bob}},
+	}
+	tests := []struct {
+		name   string
+		booked []BookedSlot
+		free   string
+	}{
+		{"nothing booked", nil, "[a b fixed]"},
+		{"one of two doctors", []BookedSlot{{Slot: "a", DoctorID: &ann}}, "[a b fixed]"},
+		{"both doctors", []BookedSlot{{Slot: "a", DoctorID: &ann}, {Slot: "a", DoctorID: &bob}}, "[b fixed]"},
+		{"a booking from before schedules takes a doctor", []BookedSlot{{Slot: "b"}, {Slot: "b", DoctorID: &bob}}, "[a fixed]"},
+		{"a fixed slot", []BookedSlot{{Slot: "fixed"}}, "[a b]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := fmt.Sprint(freeSlots(option, tt.booked)); got != tt.free {
+				t.Errorf("got %s, want %s", got, tt.free)
+			}
+		})
+	}
+}
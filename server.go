@@ -0,0 +1,55 @@
+package main
+
+import "time"
+
+// Config holds the settings the server needs at runtime
+type Config struct {
+	SigningKeys   *Keyring // Keys access tokens are signed and verified with
+	TokenIssuer   string   // iss of our access tokens
+	TokenAudience string   // aud of our access tokens
+	// OIDCProviders are the identity providers users can log in with, by name
+	OIDCProviders map[string]*OIDCProvider
+	// FakeIssuer signs ID tokens for local development when set
+	FakeIssuer *fakeIssuer
+
+	HoldTTL  time.Duration // How long a slot stays held during checkout
+	Currency string        // ISO currency code payments are charged in
+	// WebhookSecret verifies the signatures of payment provider webhooks
+	WebhookSecret string
+	// CancellationPolicy sets the refund patients get when cancelling a paid booking
+	CancellationPolicy CancellationPolicy
+	// PasswordResetURL is the page reset tokens are sent to, as its token query parameter
+	PasswordResetURL string
+	// RoleCacheTTL bounds how long a role change can take to apply everywhere
+	RoleCacheTTL time.Duration
+	// ClinicLocation is the time zone appointment dates and slots are in
+	ClinicLocation *time.Location
+	// WaitlistClaimTTL is how long a freed slot is held for a waitlisted
+	// patient before it is offered to the next one
+	WaitlistClaimTTL time.Duration
+	// WaitlistClaimURL is the page claim tokens are sent to, as its token query parameter
+	WaitlistClaimURL string
+}
+
+// Server holds the dependencies shared by the HTTP handlers
+type Server struct {
+	Stores
+	provider PaymentProvider
+	notifier Notifier
+	config   Config
+	roles    *roleCache
+}
+
+// NewServer creates a server backed by the given stores, payment provider and notifier
+func NewServer(stores Stores, provider PaymentProvider, notifier Notifier, config Config) *Server {
+	if config.ClinicLocation == nil {
+		config.ClinicLocation = time.Local
+	}
+	return &Server{
+		Stores:   stores,
+		provider: provider,
+		notifier: notifier,
+		config:   config,
+		roles:    newRoleCache(config.RoleCacheTTL),
+	}
+}
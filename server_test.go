@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// testDate is a date far enough ahead that bookings on it never start in
+// the past, written the way appointment dates are stored
+const testDate = "Jan 5, 2099"
+
+// testSlots are the slots of the treatment every test server is seeded with
+var testSlots = []string{"08.00 AM - 08.30 AM", "08.30 AM - 09.00 AM", "09.00 AM - 09.30 AM"}
+
+// testOption is the treatment every test server is seeded with
+func testOption() AppointmentOption {
+	return AppointmentOption{Name: "Teeth Cleaning", Slots: append([]string(nil), testSlots...), Price: 20}
+}
+
+// testServer is a server, usually on the in-memory backend, with the fake
+// payment provider and its routes set up
+type testServer struct {
+	*Server
+	t        *testing.T
+	router   *gin.Engine
+	provider *fakeProvider
+	notifier *recordingNotifier
+}
+
+// newTestServer creates a test server seeded with options, or with
+// testOption when none are given
+func newTestServer(t *testing.T, options ...AppointmentOption) *testServer {
+	t.Helper()
+	if len(options) == 0 {
+		options = []AppointmentOption{testOption()}
+	}
+	return newTestServerOn(t, newMemoryStores(options))
+}
+
+// newMongoTestServer creates a test server on a fresh MongoDB database,
+// dropped once the test ends, seeded like newTestServer. The test is skipped
+// when DB_URI does not point at a MongoDB server.
+func newMongoTestServer(t *testing.T, options ...AppointmentOption) *testServer {
+	t.Helper()
+	uri := os.Getenv("DB_URI")
+	if uri == "" {
+		t.Skip("DB_URI not set")
+	}
+	if len(options) == 0 {
+		options = []AppointmentOption{testOption()}
+	}
+	ctx := context.Background()
+	client, err := connectMongoDB(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("go-doctor-test-" + primitive.NewObjectID().Hex())
+	t.Cleanup(func() {
+		db.Drop(ctx)
+		client.Disconnect(ctx)
+	})
+	if err := ensureMongoIndexes(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range options {
+		if _, err := db.Collection("appointmentCollection").InsertOne(ctx, option); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return newTestServerOn(t, newMongoStores(db))
+}
+
+// newTestServerOn creates a test server on stores
+func newTestServerOn(t *testing.T, stores Stores) *testServer {
+	t.Helper()
+	keys, err := ephemeralKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := newFakeProvider()
+	notifier := &recordingNotifier{}
+	server := NewServer(stores, provider, notifier, Config{
+		SigningKeys:        keys,
+		TokenIssuer:        "go-doctor",
+		TokenAudience:      "go-doctor-api",
+		HoldTTL:            10 * time.Minute,
+		Currency:           "usd",
+		WebhookSecret:      "whsec_test",
+		CancellationPolicy: defaultCancellationPolicy,
+		RoleCacheTTL:       time.Minute,
+		ClinicLocation:     time.UTC,
+		WaitlistClaimTTL:   time.Hour,
+	})
+	router := gin.New()
+	if err := server.setupRoutes(router); err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{Server: server, t: t, router: router, provider: provider, notifier: notifier}
+}
+
+// login returns an access token for the user with email, registering the
+// user with roles first if needed. Staff sessions have passed their second
+// factor.
+func (ts *testServer) login(email string, roles ...Role) string {
+	ts.t.Helper()
+	ctx := context.Background()
+	user, err := ts.Users.FindByEmail(ctx, email)
+	if err == ErrNotFound {
+		user = User{Email: email, Roles: roles}
+		err = ts.Users.Insert(ctx, &user)
+	}
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	now := time.Now()
+	session := Session{
+		ID:          primitive.NewObjectID(),
+		UserID:      user.ID,
+		Email:       email,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(sessionTTL),
+	}
+	if len(roles) > 0 {
+		session.MFAVerifiedAt = &now
+	}
+	if err := ts.Sessions.Insert(ctx, &session); err != nil {
+		ts.t.Fatal(err)
+	}
+	token, err := ts.issueAccessToken(session, user.Roles)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return token
+}
+
+// do sends a request through the router. body is sent as is when it is a
+// string and as JSON otherwise; token is sent as a bearer token when set.
+func (ts *testServer) do(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var payload []byte
+	switch body := body.(type) {
+	case nil:
+	case string:
+		payload = []byte(body)
+	default:
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	recorder := httptest.NewRecorder()
+	ts.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// book stores a confirmed booking of slot on testDate for email directly in
+// the store and returns it
+func (ts *testServer) book(email, slot string) Booking {
+	ts.t.Helper()
+	booking := Booking{
+		AppointmentDate: testDate,
+		Treatment:       "Teeth Cleaning",
+		Slot:            slot,
+		Email:           email,
+		Price:           20,
+		Status:          StatusConfirmed,
+	}
+	if err := booking.setTimes(ts.config.ClinicLocation); err != nil {
+		ts.t.Fatal(err)
+	}
+	if err := ts.Bookings.Insert(context.Background(), &booking); err != nil {
+		ts.t.Fatal(err)
+	}
+	return booking
+}
+
+// decodeJSON decodes the body of a response into a T
+func decodeJSON[T any](t *testing.T, recorder *httptest.ResponseRecorder) T {
+	t.Helper()
+	var value T
+	if err := json.Unmarshal(recorder.Body.Bytes(), &value); err != nil {
+		t.Fatalf("decoding %q: %v", recorder.Body.String(), err)
+	}
+	return value
+}
+
+// expectStatus fails the test when a response does not have status
+func expectStatus(t *testing.T, recorder *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if recorder.Code != status {
+		t.Fatalf("got status %d, want %d: %s", recorder.Code, status, recorder.Body.String())
+	}
+}
+
+// recordingNotifier keeps the messages sent through it
+type recordingNotifier struct {
+	mu       sync.Mutex
+	messages []notification
+}
+
+type notification struct {
+	to, subject, body string
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, to, subject, body string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.messages = append(n.messages, notification{to: to, subject: subject, body: body})
+	return nil
+}
+
+// sentTo returns the messages sent to an address
+func (n *recordingNotifier) sentTo(to string) []notification {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var sent []notification
+	for _, message := range n.messages {
+		if message.to == to {
+			sent = append(sent, message)
+		}
+	}
+	return sent
+}
+
+// lastToken returns the value of the token query parameter, or the last
+// word, of the last message sent to an address
+func (n *recordingNotifier) lastToken(t *testing.T, to string) string {
+	t.Helper()
+	sent := n.sentTo(to)
+	if len(sent) == 0 {
+		t.Fatalf("nothing was sent to %s", to)
+	}
+	body := sent[len(sent)-1].body
+	if _, token, ok := strings.Cut(body, "token="); ok {
+		return strings.Fields(token)[0]
+	}
+	fields := strings.Fields(body)
+	return fields[len(fields)-1]
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// sessionTTL is how long a login can be kept alive with refresh tokens
+// before the user has to sign in again
+const sessionTTL = 30 * 24 * time.Hour
+
+// RefreshRequest exchanges a refresh token for a new token pair
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken"`
+}
+
+// newRefreshToken returns a refresh token for the session, written as
+// "<session ID>.<secret>", and the hash it is stored under
+func newRefreshToken(sessionID primitive.ObjectID) (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := sessionID.Hex() + "." + hex.EncodeToString(secret)
+	return token, hashToken(token), nil
+}
+
+// parseRefreshToken returns the session a refresh token belongs to
+func parseRefreshToken(token string) (primitive.ObjectID, bool) {
+	sessionHex, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return primitive.NilObjectID, false
+	}
+	id, err := primitive.ObjectIDFromHex(sessionHex)
+	return id, err == nil
+}
+
+// tokenPair issues the access token for a session together with its refresh token
+func (s *Server) tokenPair(session Session, roles []Role, refreshToken string) (gin.H, error) {
+	accessToken, err := s.issueAccessToken(session, roles)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"accessToken":  accessToken,
+		"refreshToken": refreshToken,
+		"expiresIn":    int(accessTokenTTL.Seconds()),
+	}, nil
+}
+
+// startSession creates a session for a user who just proved their identity
+// and returns its first token pair
+func (s *Server) startSession(c *gin.Context, user User) (gin.H, error) {
+	now := time.Now()
+	session := Session{
+		ID:          primitive.NewObjectID(),
+		UserID:      user.ID,
+		Email:       user.Email,
+		CreatedAt:   now,
+		RefreshedAt: now,
+		ExpiresAt:   now.Add(sessionTTL),
+	}
+	refreshToken, hash, err := newRefreshToken(session.ID)
+	if err != nil {
+		return nil, err
+	}
+	session.RefreshTokenHash = hash
+	if err := s.Sessions.Insert(c, &session); err != nil {
+		return nil, err
+	}
+	tokens, err := s.tokenPair(session, user.Roles, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+	// Staff have to pass their second factor before using their roles
+	if len(user.Roles) > 0 {
+		tokens["mfaRequired"] = true
+		tokens["mfaEnrolled"] = user.TOTP != nil && user.TOTP.Enabled
+	}
+	return tokens, nil
+}
+
+// handleRefreshToken rotates a refresh token. Every refresh token works once;
+// presenting one that was already rotated means it leaked, so the whole
+// session is revoked.
+func (s *Server) handleRefreshToken(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sessionID, ok := parseRefreshToken(req.RefreshToken)
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		return
+	}
+
+	session, err := s.Sessions.FindByID(c, sessionID)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch session"})
+		}
+		return
+	}
+	now := time.Now()
+	if !session.active(now) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "session has ended, please log in again"})
+		return
+	}
+
+	// New tokens carry the roles the user has now
+	user, err := s.Users.FindByID(c, session.UserID)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "session has ended, please log in again"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to find user"})
+		}
+		return
+	}
+
+	refreshToken, hash, err := newRefreshToken(session.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create refresh token"})
+		return
+	}
+	tokenHash := hashToken(req.RefreshToken)
+	err = s.Sessions.Rotate(c, session.ID, tokenHash, hash, now)
+	if err == ErrNotFound {
+		// Only a token the session was rotated away from is a sign of theft;
+		// the session is read again in case a concurrent refresh rotated it
+		if current, findErr := s.Sessions.FindByID(c, session.ID); findErr != nil || !current.usedRefreshToken(tokenHash) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid refresh token"})
+			return
+		}
+		log.Printf("Refresh token reuse on session %s, revoking it", session.ID.Hex())
+		if err := s.Sessions.Revoke(c, session.ID, now, "refresh token reused"); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+			return
+		}
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token was already used, please log in again"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to rotate refresh token"})
+		return
+	}
+
+	tokens, err := s.tokenPair(session, user.Roles, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate JWT"})
+		return
+	}
+	c.JSON(http.StatusOK, tokens)
+}
+
+// handleLogout revokes the session of the access token used to call it
+func (s *Server) handleLogout(c *gin.Context) {
+	sessionID, ok := c.Get("sessionID")
+	if !ok {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized access"})
+		return
+	}
+	if err := s.Sessions.Revoke(c, sessionID.(primitive.ObjectID), time.Now(), "logged out"); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke session"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "logged out"})
+}
+
+// handleRevokeUserSessions signs a user out everywhere
+func (s *Server) handleRevokeUserSessions(c *gin.Context) {
+	userID, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user ID"})
+		return
+	}
+
+	revoked, err := s.Sessions.RevokeAllForUser(c, userID, time.Now(), "revoked by "+callerName(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to revoke sessions"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+)
+
+// tokens is the token pair returned by login and refresh
+type tokens struct {
+	AccessToken  string `json:"accessToken"`
+	RefreshToken string `json:"refreshToken"`
+}
+
+// register creates an account for email and logs in with it
+func (ts *testServer) register(email string) tokens {
+	ts.t.Helper()
+	credentials := map[string]string{"email": email, "password": "correct horse battery"}
+	expectStatus(ts.t, ts.do("POST", "/auth/register", "", credentials), http.StatusOK)
+	rec := ts.do("POST", "/auth/login", "", credentials)
+	expectStatus(ts.t, rec, http.StatusOK)
+	return decodeJSON[tokens](ts.t, rec)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	ts := newTestServer(t)
+	first := ts.register("p@x.com")
+
+	rec := ts.do("POST", "/auth/refresh", "", RefreshRequest{first.RefreshToken})
+	expectStatus(t, rec, http.StatusOK)
+	second := decodeJSON[tokens](t, rec)
+	if second.RefreshToken == first.RefreshToken {
+		t.Fatal("the refresh token was not rotated")
+	}
+	expectStatus(t, ts.do("GET", "/bookings?email=p@x.com", second.AccessToken, nil), http.StatusOK)
+}
+
+func TestRefreshTokenUnknown(t *testing.T) {
+	ts := newTestServer(t)
+	current := ts.register("p@x.com")
+	sessionID, _ := parseRefreshToken(current.RefreshToken)
+
+	// A token the session never issued is refused without ending the session
+	forged, _, err := newRefreshToken(sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{forged, "not a token"} {
+		expectStatus(t, ts.do("POST", "/auth/refresh", "", RefreshRequest{token}), http.StatusUnauthorized)
+	}
+	expectStatus(t, ts.do("POST", "/auth/refresh", "", RefreshRequest{current.RefreshToken}), http.StatusOK)
+}
+
+func TestRefreshTokenReuseRevokesSession(t *testing.T) {
+	ts := newTestServer(t)
+	first := ts.register("p@x.com")
+	rec := ts.do("POST", "/auth/refresh", "", RefreshRequest{first.RefreshToken})
+	expectStatus(t, rec, http.StatusOK)
+	second := decodeJSON[tokens](t, rec)
+
+	// Replaying the rotated token means it leaked, so the whole session ends
+	expectStatus(t, ts.do("POST", "/auth/refresh", "", RefreshRequest{first.RefreshToken}), http.StatusUnauthorized)
+	expectStatus(t, ts.do("POST", "/auth/refresh", "", RefreshRequest{second.RefreshToken}), http.StatusUnauthorized)
+	expectStatus(t, ts.do("GET", "/bookings?email=p@x.com", second.AccessToken, nil), http.StatusUnauthorized)
+}
+
+func TestRegisterConcurrently(t *testing.T) {
+	ts := newTestServer(t)
+	credentials := map[string]string{"email": "p@x.com", "password": "correct horse battery"}
+	statuses := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = ts.do("POST", "/auth/register", "", credentials).Code
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			created++
+		case http.StatusConflict:
+		default:
+			t.Errorf("got status %d, want %d or %d", status, http.StatusOK, http.StatusConflict)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d registrations succeeded, want 1", created)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// ErrNotFound is returned by stores when no document matches the query
+var ErrNotFound = errors.New("not found")
+
+// ErrSlotTaken is returned when a booking would reuse a treatment slot already
+// booked on the same date
+var ErrSlotTaken = errors.New("slot already booked")
+
+// ErrStatusChanged is returned when a booking no longer has the status a
+// transition expected, because another request changed it first
+var ErrStatusChanged = errors.New("booking status changed")
+
+// ErrDuplicatePayment is returned when a booking already has a payment recorded
+var ErrDuplicatePayment = errors.New("payment already recorded for booking")
+
+// ErrRefundExceeded is returned when recording a refund would return more
+// than the payment collected
+var ErrRefundExceeded = errors.New("refund exceeds the payment")
+
+// ErrDuplicateEmail is returned when another user already has the email
+var ErrDuplicateEmail = errors.New("a user with this email already exists")
+
+// ErrDuplicateEvent is returned when a webhook event was already received
+var ErrDuplicateEvent = errors.New("webhook event already received")
+
+// AppointmentOptionStore provides access to the treatments patients can book
+type AppointmentOptionStore interface {
+	List(ctx context.Context) ([]AppointmentOption, error)
+	FindByName(ctx context.Context, name string) (AppointmentOption, error)
+	// Available returns every option along with the slots active bookings and
+	// unexpired holds take on date, in one query
+	Available(ctx context.Context, date string) ([]BookedOption, error)
+}
+
+// BookingStore provides access to patient bookings
+type BookingStore interface {
+	FindByID(ctx context.Context, id primitive.ObjectID) (Booking, error)
+	FindByEmail(ctx context.Context, email string) ([]Booking, error)
+	FindByDate(ctx context.Context, date string) ([]Booking, error)
+	// FindByDates returns the bookings on any of dates, matched by their
+	// appointment date like FindByDate
+	FindByDates(ctx context.Context, dates []string) ([]Booking, error)
+	// FindByPatient returns the active booking a patient holds for a treatment on a date
+	FindByPatient(ctx context.Context, email, date, treatment string) (Booking, error)
+	// Insert atomically reserves the booking's slot, failing with ErrSlotTaken
+	// when the treatment slot is already booked or held on that date. Expired
+	// holds on the slot are released first.
+	Insert(ctx context.Context, booking *Booking) error
+	// AssignDoctors gives each active booking in a slot that has no doctor,
+	// made before the slot came from doctor schedules, the first of doctors
+	// not yet booked for the slot, so it takes up that doctor's place as it
+	// does in availability. Bookings are left without a doctor once every
+	// doctor is booked.
+	AssignDoctors(ctx context.Context, treatment, date, slot string, doctors []primitive.ObjectID) error
+	// Transition moves a booking from change.From to change.To and records the
+	// change, failing with ErrStatusChanged when the booking is no longer in
+	// change.From
+	Transition(ctx context.Context, id primitive.ObjectID, change StatusChange) error
+	// SetPaymentError records why the last payment attempt for a booking failed
+	SetPaymentError(ctx context.Context, id primitive.ObjectID, message string) error
+	// Reschedule applies a transition like Transition while moving the booking
+	// to the date, slot and times of moved and replacing its conflicts, failing
+	// with ErrSlotTaken when that slot is taken
+	Reschedule(ctx context.Context, id primitive.ObjectID, moved Booking, change StatusChange) error
+	// DeleteExpiredHolds releases every hold that expired before now and
+	// returns the number of released holds
+	DeleteExpiredHolds(ctx context.Context, now time.Time) (int64, error)
+	// ConfirmHold applies change to a hold that has not expired and makes it
+	// a booking that no longer expires. It fails with ErrNotFound when the
+	// hold expired and with ErrStatusChanged when it is not in change.From.
+	ConfirmHold(ctx context.Context, id primitive.ObjectID, change StatusChange) error
+	// FindBetween returns the bookings whose times overlap [from, to)
+	FindBetween(ctx context.Context, from, to time.Time) ([]Booking, error)
+	// FindConflicted returns the bookings flagged as falling on a blackout
+	FindConflicted(ctx context.Context) ([]Booking, error)
+	// FlagConflict flags bookings as falling on a blackout
+	FlagConflict(ctx context.Context, ids []primitive.ObjectID, blackoutID primitive.ObjectID) error
+	// ClearConflict removes the flags of a blackout from every booking
+	ClearConflict(ctx context.Context, blackoutID primitive.ObjectID) error
+}
+
+// UserStore provides access to registered users
+type UserStore interface {
+	List(ctx context.Context) ([]User, error)
+	FindByEmail(ctx context.Context, email string) (User, error)
+	// Insert stores a new user, failing with ErrDuplicateEmail when another
+	// user has the same email
+	Insert(ctx context.Context, user *User) error
+	FindByID(ctx context.Context, id primitive.ObjectID) (User, error)
+	// FindByIdentity returns the user linked to an identity provider account
+	FindByIdentity(ctx context.Context, provider, subject string) (User, error)
+	// LinkIdentity links an identity provider account to a user
+	LinkIdentity(ctx context.Context, id primitive.ObjectID, identity Identity) error
+	// GrantRole adds a role to a user and returns the number of modified
+	// documents, which is 0 when the user already had it
+	GrantRole(ctx context.Context, id primitive.ObjectID, role Role) (int64, error)
+	// RevokeRole removes a role from a user and returns the number of modified documents
+	RevokeRole(ctx context.Context, id primitive.ObjectID, role Role) (int64, error)
+	// SetRoles replaces all roles of a user
+	SetRoles(ctx context.Context, id primitive.ObjectID, roles []Role) error
+	// SetPassword stores a new password hash and clears failed logins and any lockout
+	SetPassword(ctx context.Context, id primitive.ObjectID, hash string) error
+	// RecordLoginFailure counts a failed login and returns the number of
+	// failures since the last successful login or lockout
+	RecordLoginFailure(ctx context.Context, id primitive.ObjectID) (int, error)
+	// SetTOTP replaces the user's TOTP second factor, or removes it when totp is nil
+	SetTOTP(ctx context.Context, id primitive.ObjectID, totp *TOTP) error
+	// UseTOTPStep records that a code for step was accepted, failing with
+	// ErrNotFound when a code for the same or a later step was used before
+	UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) error
+	// ConsumeRecoveryCode removes a recovery code hash, failing with
+	// ErrNotFound when the user has no such code
+	ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) error
+	// SetLockout locks the user out until the given time, or unlocks it when
+	// until is nil, and resets its failed login count
+	SetLockout(ctx context.Context, id primitive.ObjectID, until *time.Time) error
+}
+
+// SessionStore keeps the login sessions that refresh tokens belong to
+type SessionStore interface {
+	Insert(ctx context.Context, session *Session) error
+	FindByID(ctx context.Context, id primitive.ObjectID) (Session, error)
+	// Rotate replaces the refresh token of an active session whose current
+	// token hash is oldHash and keeps oldHash among the used ones. It gives
+	// ErrNotFound when there is no such session.
+	Rotate(ctx context.Context, id primitive.ObjectID, oldHash, newHash string, now time.Time) error
+	// Revoke ends a session; revoking an ended session does nothing
+	Revoke(ctx context.Context, id primitive.ObjectID, now time.Time, reason string) error
+	// RevokeAllForUser ends every active session of a user and returns how many there were
+	RevokeAllForUser(ctx context.Context, userID primitive.ObjectID, now time.Time, reason string) (int64, error)
+	// SetMFAVerified records that the user passed their second factor in the session at at
+	SetMFAVerified(ctx context.Context, id primitive.ObjectID, at time.Time) error
+}
+
+// PasswordResetStore keeps the outstanding password reset tokens
+type PasswordResetStore interface {
+	Insert(ctx context.Context, reset *PasswordReset) error
+	// Consume marks the reset with the given token hash used and returns it.
+	// Unknown, used and expired tokens give ErrNotFound.
+	Consume(ctx context.Context, tokenHash string, now time.Time) (PasswordReset, error)
+}
+
+// APIKeyStore keeps the API keys of machine clients
+type APIKeyStore interface {
+	List(ctx context.Context) ([]APIKey, error)
+	Insert(ctx context.Context, key *APIKey) error
+	FindByID(ctx context.Context, id primitive.ObjectID) (APIKey, error)
+	// Revoke stops a key from working; revoking a revoked key does nothing
+	Revoke(ctx context.Context, id primitive.ObjectID, now time.Time) error
+	// Touch records when a key was last used
+	Touch(ctx context.Context, id primitive.ObjectID, at time.Time) error
+}
+
+// DoctorStore provides access to doctors
+type DoctorStore interface {
+	List(ctx context.Context) ([]Doctor, error)
+	FindByEmail(ctx context.Context, email string) (Doctor, error)
+	Insert(ctx context.Context, doctor *Doctor) error
+	// SetSchedules replaces the weekly schedules of a doctor
+	SetSchedules(ctx context.Context, id primitive.ObjectID, schedules []TreatmentSchedule) error
+	// Delete removes a doctor and returns the number of deleted documents
+	Delete(ctx context.Context, id primitive.ObjectID) (int64, error)
+}
+
+// BlackoutStore keeps clinic holidays, doctor leave and blocked slots
+type BlackoutStore interface {
+	// List returns the blackouts overlapping [from, to); a zero time leaves
+	// that end of the range open
+	List(ctx context.Context, from, to time.Time) ([]Blackout, error)
+	Insert(ctx context.Context, blackout *Blackout) error
+	// Delete removes a blackout and returns the number of deleted documents
+	Delete(ctx context.Context, id primitive.ObjectID) (int64, error)
+}
+
+// WaitlistStore keeps the patients waiting for slots to free up
+type WaitlistStore interface {
+	Insert(ctx context.Context, entry *WaitlistEntry) error
+	FindByID(ctx context.Context, id primitive.ObjectID) (WaitlistEntry, error)
+	FindByEmail(ctx context.Context, email string) ([]WaitlistEntry, error)
+	// Waiting returns the waiting entries for treatment whose dates include
+	// at, oldest first
+	Waiting(ctx context.Context, treatment string, at time.Time) ([]WaitlistEntry, error)
+	// FindByClaimHash returns the offered entry whose claim token has the hash
+	FindByClaimHash(ctx context.Context, hash string) (WaitlistEntry, error)
+	// ExpiredOffers returns the offered entries whose offer expired before now
+	ExpiredOffers(ctx context.Context, now time.Time) ([]WaitlistEntry, error)
+	// Offer moves a waiting entry to offered, failing with ErrStatusChanged
+	// when it is no longer waiting
+	Offer(ctx context.Context, id primitive.ObjectID, offer WaitlistOffer) error
+	// Withdraw puts an offered entry back to waiting, recording the start of
+	// the offered slot as passed when passed is set. It fails with
+	// ErrStatusChanged when the entry is no longer offered.
+	Withdraw(ctx context.Context, id primitive.ObjectID, passed bool) error
+	// Claim moves an offered entry to claimed, failing with ErrStatusChanged
+	// when it is no longer offered
+	Claim(ctx context.Context, id primitive.ObjectID) error
+	// Delete removes an entry and returns the number of deleted documents
+	Delete(ctx context.Context, id primitive.ObjectID) (int64, error)
+}
+
+// PaymentStore provides access to payment records
+type PaymentStore interface {
+	// Record stores payment and applies change to the booking it pays for,
+	// marking the booking paid, as one atomic step. It fails with
+	// ErrDuplicatePayment when the booking already has a payment or the
+	// charge already paid for a booking, and with ErrNotFound when the
+	// booking is a hold that has expired.
+	Record(ctx context.Context, payment *Payment, change StatusChange) error
+	List(ctx context.Context) ([]Payment, error)
+	FindByTransaction(ctx context.Context, transactionID string) (Payment, error)
+	FindByBooking(ctx context.Context, bookingID primitive.ObjectID) (Payment, error)
+	// AddRefund appends refund to the refund history of a payment and raises
+	// its refunded total to at least the sum of the history, which a refund
+	// webhook may already have done. It fails with ErrRefundExceeded, without
+	// changing the payment, when the history would add up to more than the
+	// payment. A booking whose payment is fully refunded is no longer paid.
+	AddRefund(ctx context.Context, id primitive.ObjectID, refund RefundRecord) (Payment, error)
+	// SetAmountRefunded raises the refunded total of a payment to amount and
+	// updates its status. A booking whose payment is fully refunded is no
+	// longer paid. Lower totals, e.g. from events delivered out of order, are
+	// ignored.
+	SetAmountRefunded(ctx context.Context, transactionID string, amount int64) (Payment, error)
+}
+
+// WebhookEventStore keeps payment provider events so each is applied once
+type WebhookEventStore interface {
+	// Insert stores a new event, failing with ErrDuplicateEvent when an event
+	// with the same ID was already received
+	Insert(ctx context.Context, event *WebhookEvent) error
+	FindByID(ctx context.Context, id string) (WebhookEvent, error)
+	// MarkProcessed records that the event was handled, with the reason it
+	// could not be applied if any
+	MarkProcessed(ctx context.Context, id string, at time.Time, reason string) error
+}
+
+// ContactStore provides access to contact messages
+type ContactStore interface {
+	Insert(ctx context.Context, contact *Contact) error
+}
+
+// Stores groups the storage backends used by the server
+type Stores struct {
+	AppointmentOptions AppointmentOptionStore
+	Bookings           BookingStore
+	Users              UserStore
+	Doctors            DoctorStore
+	Blackouts          BlackoutStore
+	Waitlist           WaitlistStore
+	Payments           PaymentStore
+	Contacts           ContactStore
+	WebhookEvents      WebhookEventStore
+	PasswordResets     PasswordResetStore
+	Sessions           SessionStore
+	APIKeys            APIKeyStore
+}
@@ -0,0 +1,1179 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// memoryDB holds every collection of the in-memory backend behind a single lock
+type memoryDB struct {
+	mu                 sync.RWMutex
+	appointmentOptions []AppointmentOption
+	bookings           []Booking
+	users              []User
+	doctors            []Doctor
+	blackouts          []Blackout
+	waitlist           []WaitlistEntry
+	payments           []Payment
+	contacts           []Contact
+	webhookEvents      map[string]WebhookEvent
+	passwordResets     []PasswordReset
+	sessions           []Session
+	apiKeys            []APIKey
+}
+
+// newMemoryStores builds in-memory stores seeded with the given appointment options
+func newMemoryStores(options []AppointmentOption) Stores {
+	db := &memoryDB{webhookEvents: make(map[string]WebhookEvent)}
+	for _, option := range options {
+		option.ID = newObjectID(option.ID)
+		option.Slots = append([]string(nil), option.Slots...)
+		db.appointmentOptions = append(db.appointmentOptions, option)
+	}
+	return Stores{
+		AppointmentOptions: &memoryAppointmentOptionStore{db: db},
+		Bookings:           &memoryBookingStore{db: db},
+		Users:              &memoryUserStore{db: db},
+		Doctors:            &memoryDoctorStore{db: db},
+		Blackouts:          &memoryBlackoutStore{db: db},
+		Waitlist:           &memoryWaitlistStore{db: db},
+		Payments:           &memoryPaymentStore{db: db},
+		Contacts:           &memoryContactStore{db: db},
+		WebhookEvents:      &memoryWebhookEventStore{db: db},
+		PasswordResets:     &memoryPasswordResetStore{db: db},
+		Sessions:           &memorySessionStore{db: db},
+		APIKeys:            &memoryAPIKeyStore{db: db},
+	}
+}
+
+// filterDocs returns the documents for which match reports true
+func filterDocs[T any](docs []T, match func(T) bool) []T {
+	var result []T
+	for _, doc := range docs {
+		if match(doc) {
+			result = append(result, doc)
+		}
+	}
+	return result
+}
+
+// copyOption returns an option whose slots do not alias the stored slice
+func copyOption(option AppointmentOption) AppointmentOption {
+	option.Slots = append([]string(nil), option.Slots...)
+	return option
+}
+
+type memoryAppointmentOptionStore struct {
+	db *memoryDB
+}
+
+func (s *memoryAppointmentOptionStore) List(ctx context.Context) ([]AppointmentOption, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	var options []AppointmentOption
+	for _, option := range s.db.appointmentOptions {
+		options = append(options, copyOption(option))
+	}
+	return options, nil
+}
+
+func (s *memoryAppointmentOptionStore) FindByName(ctx context.Context, name string) (AppointmentOption, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, option := range s.db.appointmentOptions {
+		if option.Name == name {
+			return copyOption(option), nil
+		}
+	}
+	return AppointmentOption{}, ErrNotFound
+}
+
+func (s *memoryAppointmentOptionStore) Available(ctx context.Context, date string) ([]BookedOption, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	now := time.Now()
+	var options []BookedOption
+	for _, option := range s.db.appointmentOptions {
+		booked := BookedOption{AppointmentOption: copyOption(option)}
+		for _, b := range s.db.bookings {
+			if b.Treatment == option.Name && b.AppointmentDate == date && b.occupiesSlot(now) {
+				booked.Booked = append(booked.Booked, BookedSlot{Slot: b.Slot, DoctorID: b.DoctorID})
+			}
+		}
+		options = append(options, booked)
+	}
+	return options, nil
+}
+
+type memoryBookingStore struct {
+	db *memoryDB
+}
+
+func (s *memoryBookingStore) FindByID(ctx context.Context, id primitive.ObjectID) (Booking, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, booking := range s.db.bookings {
+		if booking.ID == id {
+			return booking, nil
+		}
+	}
+	return Booking{}, ErrNotFound
+}
+
+func (s *memoryBookingStore) FindByEmail(ctx context.Context, email string) ([]Booking, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return filterDocs(s.db.bookings, func(b Booking) bool { return b.Email == email }), nil
+}
+
+func (s *memoryBookingStore) FindByDate(ctx context.Context, date string) ([]Booking, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return filterDocs(s.db.bookings, func(b Booking) bool { return b.AppointmentDate == date }), nil
+}
+
+func (s *memoryBookingStore) FindByDates(ctx context.Context, dates []string) ([]Booking, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	wanted := make(map[string]bool, len(dates))
+	for _, date := range dates {
+		wanted[date] = true
+	}
+	return filterDocs(s.db.bookings, func(b Booking) bool { return wanted[b.AppointmentDate] }), nil
+}
+
+func (s *memoryBookingStore) FindByPatient(ctx context.Context, email, date, treatment string) (Booking, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, booking := range s.db.bookings {
+		if booking.Email == email && booking.AppointmentDate == date && booking.Treatment == treatment && booking.currentStatus() != StatusCancelled {
+			return booking, nil
+		}
+	}
+	return Booking{}, ErrNotFound
+}
+
+func (s *memoryBookingStore) Insert(ctx context.Context, booking *Booking) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if s.slotTaken(booking.Treatment, booking.AppointmentDate, booking.Slot, booking.DoctorID) {
+		return ErrSlotTaken
+	}
+	booking.ID = newObjectID(booking.ID)
+	s.db.bookings = append(s.db.bookings, *booking)
+	return nil
+}
+
+func (s *memoryBookingStore) AssignDoctors(ctx context.Context, treatment, date, slot string, doctors []primitive.ObjectID) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	now := time.Now()
+	s.releaseExpiredHolds(now)
+	for i := range s.db.bookings {
+		booking := &s.db.bookings[i]
+		if booking.Treatment != treatment || booking.AppointmentDate != date || booking.Slot != slot ||
+			booking.DoctorID != nil || !booking.occupiesSlot(now) {
+			continue
+		}
+		for _, id := range doctors {
+			if !s.occupied(treatment, date, slot, &id, now) {
+				id := id
+				booking.DoctorID = &id
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// slotTaken releases expired holds and reports whether an active booking
+// occupies the slot with doctor, nil for fixed slots. The caller must hold
+// the write lock.
+func (s *memoryBookingStore) slotTaken(treatment, date, slot string, doctor *primitive.ObjectID) bool {
+	now := time.Now()
+	s.releaseExpiredHolds(now)
+	return s.occupied(treatment, date, slot, doctor, now)
+}
+
+// releaseExpiredHolds drops the holds that expired before now. The caller
+// must hold the write lock.
+func (s *memoryBookingStore) releaseExpiredHolds(now time.Time) {
+	s.db.bookings = filterDocs(s.db.bookings, func(b Booking) bool { return !b.holdExpired(now) })
+}
+
+// occupied reports whether an active booking occupies the slot with doctor.
+// The caller must hold the lock.
+func (s *memoryBookingStore) occupied(treatment, date, slot string, doctor *primitive.ObjectID, now time.Time) bool {
+	for _, existing := range s.db.bookings {
+		if existing.Treatment == treatment && existing.AppointmentDate == date && existing.Slot == slot &&
+			sameDoctor(existing.DoctorID, doctor) && existing.occupiesSlot(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameDoctor reports whether two bookings are with the same doctor, or both
+// with none
+func sameDoctor(a, b *primitive.ObjectID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// find returns the stored booking with id. The caller must hold the lock.
+func (s *memoryBookingStore) find(id primitive.ObjectID) *Booking {
+	for i := range s.db.bookings {
+		if s.db.bookings[i].ID == id {
+			return &s.db.bookings[i]
+		}
+	}
+	return nil
+}
+
+func (s *memoryBookingStore) Transition(ctx context.Context, id primitive.ObjectID, change StatusChange) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	booking := s.find(id)
+	if booking == nil {
+		return ErrNotFound
+	}
+	if booking.currentStatus() != change.From {
+		return ErrStatusChanged
+	}
+	booking.Status = change.To
+	booking.StatusHistory = append(booking.StatusHistory, change)
+	return nil
+}
+
+func (s *memoryBookingStore) SetPaymentError(ctx context.Context, id primitive.ObjectID, message string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	booking := s.find(id)
+	if booking == nil {
+		return ErrNotFound
+	}
+	booking.PaymentError = message
+	return nil
+}
+
+func (s *memoryBookingStore) Reschedule(ctx context.Context, id primitive.ObjectID, moved Booking, change StatusChange) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	booking := s.find(id)
+	if booking == nil {
+		return ErrNotFound
+	}
+	if booking.currentStatus() != change.From {
+		return ErrStatusChanged
+	}
+	if s.slotTaken(booking.Treatment, moved.AppointmentDate, moved.Slot, moved.DoctorID) {
+		return ErrSlotTaken
+	}
+	// slotTaken may have compacted the slice, so look the booking up again
+	booking = s.find(id)
+	booking.AppointmentDate = moved.AppointmentDate
+	booking.Slot = moved.Slot
+	booking.DoctorID = moved.DoctorID
+	booking.StartsAt = moved.StartsAt
+	booking.EndsAt = moved.EndsAt
+	booking.Conflicts = append([]primitive.ObjectID(nil), moved.Conflicts...)
+	booking.Status = change.To
+	booking.StatusHistory = append(booking.StatusHistory, change)
+	return nil
+}
+
+func (s *memoryBookingStore) DeleteExpiredHolds(ctx context.Context, now time.Time) (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	before := len(s.db.bookings)
+	s.releaseExpiredHolds(now)
+	return int64(before - len(s.db.bookings)), nil
+}
+
+func (s *memoryBookingStore) ConfirmHold(ctx context.Context, id primitive.ObjectID, change StatusChange) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	booking := s.find(id)
+	if booking == nil || booking.holdExpired(change.At) {
+		return ErrNotFound
+	}
+	if booking.currentStatus() != change.From {
+		return ErrStatusChanged
+	}
+	booking.Status = change.To
+	booking.StatusHistory = append(booking.StatusHistory, change)
+	booking.HoldExpiresAt = nil
+	return nil
+}
+
+func (s *memoryBookingStore) FindBetween(ctx context.Context, from, to time.Time) ([]Booking, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return filterDocs(s.db.bookings, func(b Booking) bool {
+		return b.StartsAt != nil && b.EndsAt != nil && b.StartsAt.Before(to) && from.Before(*b.EndsAt)
+	}), nil
+}
+
+func (s *memoryBookingStore) FindConflicted(ctx context.Context) ([]Booking, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return filterDocs(s.db.bookings, func(b Booking) bool { return len(b.Conflicts) > 0 }), nil
+}
+
+func (s *memoryBookingStore) FlagConflict(ctx context.Context, ids []primitive.ObjectID, blackoutID primitive.ObjectID) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, id := range ids {
+		booking := s.find(id)
+		if booking == nil || containsID(booking.Conflicts, blackoutID) {
+			continue
+		}
+		booking.Conflicts = append(booking.Conflicts, blackoutID)
+	}
+	return nil
+}
+
+func (s *memoryBookingStore) ClearConflict(ctx context.Context, blackoutID primitive.ObjectID) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i := range s.db.bookings {
+		s.db.bookings[i].Conflicts = filterDocs(s.db.bookings[i].Conflicts, func(id primitive.ObjectID) bool { return id != blackoutID })
+	}
+	return nil
+}
+
+// containsID reports whether ids contains id
+func containsID(ids []primitive.ObjectID, id primitive.ObjectID) bool {
+	for _, candidate := range ids {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+type memoryUserStore struct {
+	db *memoryDB
+}
+
+func (s *memoryUserStore) List(ctx context.Context) ([]User, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return append([]User(nil), s.db.users...), nil
+}
+
+func (s *memoryUserStore) FindByEmail(ctx context.Context, email string) (User, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, user := range s.db.users {
+		if user.Email == email {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memoryUserStore) Insert(ctx context.Context, user *User) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, existing := range s.db.users {
+		if user.Email != "" && existing.Email == user.Email {
+			return ErrDuplicateEmail
+		}
+	}
+	user.ID = newObjectID(user.ID)
+	s.db.users = append(s.db.users, *user)
+	return nil
+}
+
+func (s *memoryUserStore) FindByID(ctx context.Context, id primitive.ObjectID) (User, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, user := range s.db.users {
+		if user.ID == id {
+			return user, nil
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memoryUserStore) FindByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, user := range s.db.users {
+		for _, identity := range user.Identities {
+			if identity.Provider == provider && identity.Subject == subject {
+				return user, nil
+			}
+		}
+	}
+	return User{}, ErrNotFound
+}
+
+func (s *memoryUserStore) LinkIdentity(ctx context.Context, id primitive.ObjectID, identity Identity) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.updateUser(id, func(user *User) {
+		for _, linked := range user.Identities {
+			if linked == identity {
+				return
+			}
+		}
+		user.Identities = append(append([]Identity(nil), user.Identities...), identity)
+	})
+}
+
+func (s *memoryUserStore) GrantRole(ctx context.Context, id primitive.ObjectID, role Role) (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var modified int64
+	err := s.updateUser(id, func(user *User) {
+		if !user.hasRole(role) {
+			user.Roles = append(append([]Role(nil), user.Roles...), role)
+			modified = 1
+		}
+	})
+	return modified, err
+}
+
+func (s *memoryUserStore) RevokeRole(ctx context.Context, id primitive.ObjectID, role Role) (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var modified int64
+	err := s.updateUser(id, func(user *User) {
+		roles := filterDocs(user.Roles, func(r Role) bool { return r != role })
+		if len(roles) != len(user.Roles) {
+			user.Roles = roles
+			modified = 1
+		}
+	})
+	return modified, err
+}
+
+func (s *memoryUserStore) SetRoles(ctx context.Context, id primitive.ObjectID, roles []Role) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.updateUser(id, func(user *User) {
+		user.Roles = append([]Role(nil), roles...)
+	})
+}
+
+// updateUser applies update to the user with the given ID; the caller holds the lock
+func (s *memoryUserStore) updateUser(id primitive.ObjectID, update func(*User)) error {
+	for i := range s.db.users {
+		if s.db.users[i].ID == id {
+			update(&s.db.users[i])
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryUserStore) SetPassword(ctx context.Context, id primitive.ObjectID, hash string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.updateUser(id, func(user *User) {
+		user.PasswordHash = hash
+		user.FailedLogins = 0
+		user.LockedUntil = nil
+	})
+}
+
+func (s *memoryUserStore) RecordLoginFailure(ctx context.Context, id primitive.ObjectID) (int, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var failures int
+	err := s.updateUser(id, func(user *User) {
+		user.FailedLogins++
+		failures = user.FailedLogins
+	})
+	return failures, err
+}
+
+func (s *memoryUserStore) SetTOTP(ctx context.Context, id primitive.ObjectID, totp *TOTP) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.updateUser(id, func(user *User) {
+		if totp == nil {
+			user.TOTP = nil
+			return
+		}
+		stored := *totp
+		stored.RecoveryCodeHashes = append([]string(nil), totp.RecoveryCodeHashes...)
+		user.TOTP = &stored
+	})
+}
+
+func (s *memoryUserStore) UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	used := false
+	err := s.updateUser(id, func(user *User) {
+		if user.TOTP != nil && user.TOTP.LastStep < step {
+			totp := *user.TOTP
+			totp.LastStep = step
+			user.TOTP = &totp
+			used = true
+		}
+	})
+	if err == nil && !used {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *memoryUserStore) ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	consumed := false
+	err := s.updateUser(id, func(user *User) {
+		if user.TOTP == nil {
+			return
+		}
+		hashes := filterDocs(user.TOTP.RecoveryCodeHashes, func(h string) bool { return h != hash })
+		if len(hashes) != len(user.TOTP.RecoveryCodeHashes) {
+			totp := *user.TOTP
+			totp.RecoveryCodeHashes = hashes
+			user.TOTP = &totp
+			consumed = true
+		}
+	})
+	if err == nil && !consumed {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *memoryUserStore) SetLockout(ctx context.Context, id primitive.ObjectID, until *time.Time) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	return s.updateUser(id, func(user *User) {
+		user.FailedLogins = 0
+		user.LockedUntil = until
+	})
+}
+
+type memoryDoctorStore struct {
+	db *memoryDB
+}
+
+func (s *memoryDoctorStore) List(ctx context.Context) ([]Doctor, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return append([]Doctor(nil), s.db.doctors...), nil
+}
+
+func (s *memoryDoctorStore) FindByEmail(ctx context.Context, email string) (Doctor, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, doctor := range s.db.doctors {
+		if doctor.Email == email {
+			return doctor, nil
+		}
+	}
+	return Doctor{}, ErrNotFound
+}
+
+func (s *memoryDoctorStore) Insert(ctx context.Context, doctor *Doctor) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	doctor.ID = newObjectID(doctor.ID)
+	s.db.doctors = append(s.db.doctors, *doctor)
+	return nil
+}
+
+func (s *memoryDoctorStore) SetSchedules(ctx context.Context, id primitive.ObjectID, schedules []TreatmentSchedule) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i, doctor := range s.db.doctors {
+		if doctor.ID == id {
+			s.db.doctors[i].Schedules = append([]TreatmentSchedule(nil), schedules...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryDoctorStore) Delete(ctx context.Context, id primitive.ObjectID) (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i, doctor := range s.db.doctors {
+		if doctor.ID == id {
+			s.db.doctors = append(s.db.doctors[:i], s.db.doctors[i+1:]...)
+			return 1, nil
+		}
+	}
+	return 0, nil
+}
+
+type memoryPaymentStore struct {
+	db *memoryDB
+}
+
+func (s *memoryPaymentStore) Record(ctx context.Context, payment *Payment, change StatusChange) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for _, existing := range s.db.payments {
+		if existing.Booking.ID == payment.Booking.ID || existing.TransactionID == payment.TransactionID && payment.TransactionID != "" {
+			return ErrDuplicatePayment
+		}
+	}
+
+	bookings := &memoryBookingStore{db: s.db}
+	id, _ := primitive.ObjectIDFromHex(payment.Booking.ID)
+	booking := bookings.find(id)
+	if booking == nil || booking.holdExpired(change.At) {
+		return ErrNotFound
+	}
+	if booking.currentStatus() != change.From {
+		return ErrStatusChanged
+	}
+
+	booking.Status = change.To
+	booking.StatusHistory = append(booking.StatusHistory, change)
+	booking.HoldExpiresAt = nil
+	booking.Paid = true
+	booking.TransactionID = payment.TransactionID
+	booking.PaymentError = ""
+
+	payment.ID = newObjectID(payment.ID)
+	s.db.payments = append(s.db.payments, *payment)
+	return nil
+}
+
+func (s *memoryPaymentStore) FindByTransaction(ctx context.Context, transactionID string) (Payment, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, payment := range s.db.payments {
+		if payment.TransactionID == transactionID {
+			return payment, nil
+		}
+	}
+	return Payment{}, ErrNotFound
+}
+
+func (s *memoryPaymentStore) List(ctx context.Context) ([]Payment, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return append([]Payment(nil), s.db.payments...), nil
+}
+
+func (s *memoryPaymentStore) FindByBooking(ctx context.Context, bookingID primitive.ObjectID) (Payment, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, payment := range s.db.payments {
+		if payment.Booking.ID == bookingID.Hex() {
+			return payment, nil
+		}
+	}
+	return Payment{}, ErrNotFound
+}
+
+func (s *memoryPaymentStore) AddRefund(ctx context.Context, id primitive.ObjectID, refund RefundRecord) (Payment, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i := range s.db.payments {
+		payment := &s.db.payments[i]
+		if payment.ID != id {
+			continue
+		}
+		if refundedTotal(payment.Refunds)+refund.Amount > payment.Amount {
+			return *payment, ErrRefundExceeded
+		}
+		payment.Refunds = append(payment.Refunds, refund)
+		if total := refundedTotal(payment.Refunds); total > payment.AmountRefunded {
+			payment.AmountRefunded = total
+		}
+		payment.Status = refundStatus(payment.Amount, payment.AmountRefunded)
+		s.markUnpaidIfRefunded(*payment)
+		return *payment, nil
+	}
+	return Payment{}, ErrNotFound
+}
+
+// markUnpaidIfRefunded clears the paid flag of the booking of a fully refunded
+// payment. The caller must hold the write lock.
+func (s *memoryPaymentStore) markUnpaidIfRefunded(payment Payment) {
+	if payment.Status != PaymentRefunded {
+		return
+	}
+	id, _ := primitive.ObjectIDFromHex(payment.Booking.ID)
+	if booking := (&memoryBookingStore{db: s.db}).find(id); booking != nil {
+		booking.Paid = false
+	}
+}
+
+func (s *memoryPaymentStore) SetAmountRefunded(ctx context.Context, transactionID string, amount int64) (Payment, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i := range s.db.payments {
+		payment := &s.db.payments[i]
+		if payment.TransactionID != transactionID {
+			continue
+		}
+		if amount > payment.AmountRefunded {
+			payment.AmountRefunded = amount
+			payment.Status = refundStatus(payment.Amount, amount)
+		}
+		s.markUnpaidIfRefunded(*payment)
+		return *payment, nil
+	}
+	return Payment{}, ErrNotFound
+}
+
+type memoryContactStore struct {
+	db *memoryDB
+}
+
+func (s *memoryContactStore) Insert(ctx context.Context, contact *Contact) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	contact.ID = newObjectID(contact.ID)
+	s.db.contacts = append(s.db.contacts, *contact)
+	return nil
+}
+
+type memoryWebhookEventStore struct {
+	db *memoryDB
+}
+
+func (s *memoryWebhookEventStore) Insert(ctx context.Context, event *WebhookEvent) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	if _, ok := s.db.webhookEvents[event.ID]; ok {
+		return ErrDuplicateEvent
+	}
+	s.db.webhookEvents[event.ID] = *event
+	return nil
+}
+
+func (s *memoryWebhookEventStore) FindByID(ctx context.Context, id string) (WebhookEvent, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	event, ok := s.db.webhookEvents[id]
+	if !ok {
+		return WebhookEvent{}, ErrNotFound
+	}
+	return event, nil
+}
+
+func (s *memoryWebhookEventStore) MarkProcessed(ctx context.Context, id string, at time.Time, reason string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	event, ok := s.db.webhookEvents[id]
+	if !ok {
+		return ErrNotFound
+	}
+	event.ProcessedAt = &at
+	event.Error = reason
+	s.db.webhookEvents[id] = event
+	return nil
+}
+
+type memoryPasswordResetStore struct {
+	db *memoryDB
+}
+
+func (s *memoryPasswordResetStore) Insert(ctx context.Context, reset *PasswordReset) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	reset.ID = newObjectID(reset.ID)
+	s.db.passwordResets = append(s.db.passwordResets, *reset)
+	return nil
+}
+
+func (s *memoryPasswordResetStore) Consume(ctx context.Context, tokenHash string, now time.Time) (PasswordReset, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i, reset := range s.db.passwordResets {
+		if reset.TokenHash == tokenHash && reset.UsedAt == nil && now.Before(reset.ExpiresAt) {
+			s.db.passwordResets[i].UsedAt = &now
+			return s.db.passwordResets[i], nil
+		}
+	}
+	return PasswordReset{}, ErrNotFound
+}
+
+type memorySessionStore struct {
+	db *memoryDB
+}
+
+func (s *memorySessionStore) Insert(ctx context.Context, session *Session) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	session.ID = newObjectID(session.ID)
+	s.db.sessions = append(s.db.sessions, *session)
+	return nil
+}
+
+func (s *memorySessionStore) FindByID(ctx context.Context, id primitive.ObjectID) (Session, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, session := range s.db.sessions {
+		if session.ID == id {
+			return session, nil
+		}
+	}
+	return Session{}, ErrNotFound
+}
+
+func (s *memorySessionStore) Rotate(ctx context.Context, id primitive.ObjectID, oldHash, newHash string, now time.Time) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i, session := range s.db.sessions {
+		if session.ID == id && session.RefreshTokenHash == oldHash && session.active(now) {
+			s.db.sessions[i].UsedTokenHashes = append(s.db.sessions[i].UsedTokenHashes, oldHash)
+			s.db.sessions[i].RefreshTokenHash = newHash
+			s.db.sessions[i].RefreshedAt = now
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memorySessionStore) Revoke(ctx context.Context, id primitive.ObjectID, now time.Time, reason string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i, session := range s.db.sessions {
+		if session.ID == id && session.RevokedAt == nil {
+			s.db.sessions[i].RevokedAt = &now
+			s.db.sessions[i].RevokedReason = reason
+		}
+	}
+	return nil
+}
+
+func (s *memorySessionStore) RevokeAllForUser(ctx context.Context, userID primitive.ObjectID, now time.Time, reason string) (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var revoked int64
+	for i, session := range s.db.sessions {
+		if session.UserID == userID && session.active(now) {
+			s.db.sessions[i].RevokedAt = &now
+			s.db.sessions[i].RevokedReason = reason
+			revoked++
+		}
+	}
+	return revoked, nil
+}
+
+func (s *memorySessionStore) SetMFAVerified(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i, session := range s.db.sessions {
+		if session.ID == id {
+			s.db.sessions[i].MFAVerifiedAt = &at
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+type memoryAPIKeyStore struct {
+	db *memoryDB
+}
+
+func (s *memoryAPIKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return append([]APIKey(nil), s.db.apiKeys...), nil
+}
+
+func (s *memoryAPIKeyStore) Insert(ctx context.Context, key *APIKey) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	key.ID = newObjectID(key.ID)
+	stored := *key
+	stored.Scopes = append([]Permission(nil), key.Scopes...)
+	s.db.apiKeys = append(s.db.apiKeys, stored)
+	return nil
+}
+
+func (s *memoryAPIKeyStore) FindByID(ctx context.Context, id primitive.ObjectID) (APIKey, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, key := range s.db.apiKeys {
+		if key.ID == id {
+			return key, nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (s *memoryAPIKeyStore) Revoke(ctx context.Context, id primitive.ObjectID, now time.Time) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i, key := range s.db.apiKeys {
+		if key.ID == id {
+			if key.RevokedAt == nil {
+				s.db.apiKeys[i].RevokedAt = &now
+			}
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *memoryAPIKeyStore) Touch(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	for i, key := range s.db.apiKeys {
+		if key.ID == id {
+			s.db.apiKeys[i].LastUsedAt = &at
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+type memoryBlackoutStore struct {
+	db *memoryDB
+}
+
+func (s *memoryBlackoutStore) List(ctx context.Context, from, to time.Time) ([]Blackout, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	blackouts := filterDocs(s.db.blackouts, func(b Blackout) bool {
+		return (to.IsZero() || b.StartsAt.Before(to)) && (from.IsZero() || from.Before(b.EndsAt))
+	})
+	sort.Slice(blackouts, func(i, j int) bool { return blackouts[i].StartsAt.Before(blackouts[j].StartsAt) })
+	return blackouts, nil
+}
+
+func (s *memoryBlackoutStore) Insert(ctx context.Context, blackout *Blackout) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	blackout.ID = newObjectID(blackout.ID)
+	s.db.blackouts = append(s.db.blackouts, *blackout)
+	return nil
+}
+
+func (s *memoryBlackoutStore) Delete(ctx context.Context, id primitive.ObjectID) (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	before := len(s.db.blackouts)
+	s.db.blackouts = filterDocs(s.db.blackouts, func(b Blackout) bool { return b.ID != id })
+	return int64(before - len(s.db.blackouts)), nil
+}
+
+type memoryWaitlistStore struct {
+	db *memoryDB
+}
+
+// copyEntry returns an entry that does not alias stored slices or offers
+func copyEntry(entry WaitlistEntry) WaitlistEntry {
+	entry.Passed = append([]time.Time(nil), entry.Passed...)
+	if entry.Offer != nil {
+		offer := *entry.Offer
+		entry.Offer = &offer
+	}
+	return entry
+}
+
+func (s *memoryWaitlistStore) find(id primitive.ObjectID) *WaitlistEntry {
+	for i := range s.db.waitlist {
+		if s.db.waitlist[i].ID == id {
+			return &s.db.waitlist[i]
+		}
+	}
+	return nil
+}
+
+// matching returns copies of the entries for which match reports true
+func (s *memoryWaitlistStore) matching(match func(WaitlistEntry) bool) []WaitlistEntry {
+	var entries []WaitlistEntry
+	for _, entry := range s.db.waitlist {
+		if match(entry) {
+			entries = append(entries, copyEntry(entry))
+		}
+	}
+	return entries
+}
+
+func (s *memoryWaitlistStore) Insert(ctx context.Context, entry *WaitlistEntry) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	entry.ID = newObjectID(entry.ID)
+	s.db.waitlist = append(s.db.waitlist, copyEntry(*entry))
+	return nil
+}
+
+func (s *memoryWaitlistStore) FindByID(ctx context.Context, id primitive.ObjectID) (WaitlistEntry, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	if entry := s.find(id); entry != nil {
+		return copyEntry(*entry), nil
+	}
+	return WaitlistEntry{}, ErrNotFound
+}
+
+func (s *memoryWaitlistStore) FindByEmail(ctx context.Context, email string) ([]WaitlistEntry, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return s.matching(func(e WaitlistEntry) bool { return e.Email == email }), nil
+}
+
+func (s *memoryWaitlistStore) Waiting(ctx context.Context, treatment string, at time.Time) ([]WaitlistEntry, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	entries := s.matching(func(e WaitlistEntry) bool {
+		return e.Status == WaitlistWaiting && e.Treatment == treatment && !at.Before(e.From) && at.Before(e.To)
+	})
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].CreatedAt.Before(entries[j].CreatedAt) })
+	return entries, nil
+}
+
+func (s *memoryWaitlistStore) FindByClaimHash(ctx context.Context, hash string) (WaitlistEntry, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	for _, entry := range s.db.waitlist {
+		if entry.Status == WaitlistOffered && entry.Offer != nil && entry.Offer.ClaimTokenHash == hash {
+			return copyEntry(entry), nil
+		}
+	}
+	return WaitlistEntry{}, ErrNotFound
+}
+
+func (s *memoryWaitlistStore) ExpiredOffers(ctx context.Context, now time.Time) ([]WaitlistEntry, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+
+	return s.matching(func(e WaitlistEntry) bool {
+		return e.Status == WaitlistOffered && e.Offer != nil && !e.Offer.ExpiresAt.After(now)
+	}), nil
+}
+
+func (s *memoryWaitlistStore) Offer(ctx context.Context, id primitive.ObjectID, offer WaitlistOffer) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	entry := s.find(id)
+	if entry == nil {
+		return ErrNotFound
+	}
+	if entry.Status != WaitlistWaiting {
+		return ErrStatusChanged
+	}
+	entry.Status = WaitlistOffered
+	entry.Offer = &offer
+	return nil
+}
+
+func (s *memoryWaitlistStore) Withdraw(ctx context.Context, id primitive.ObjectID, passed bool) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	entry := s.find(id)
+	if entry == nil {
+		return ErrNotFound
+	}
+	if entry.Status != WaitlistOffered {
+		return ErrStatusChanged
+	}
+	if passed && entry.Offer != nil {
+		entry.Passed = append(entry.Passed, entry.Offer.StartsAt)
+	}
+	entry.Status = WaitlistWaiting
+	entry.Offer = nil
+	return nil
+}
+
+func (s *memoryWaitlistStore) Claim(ctx context.Context, id primitive.ObjectID) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	entry := s.find(id)
+	if entry == nil {
+		return ErrNotFound
+	}
+	if entry.Status != WaitlistOffered {
+		return ErrStatusChanged
+	}
+	entry.Status = WaitlistClaimed
+	return nil
+}
+
+func (s *memoryWaitlistStore) Delete(ctx context.Context, id primitive.ObjectID) (int64, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	before := len(s.db.waitlist)
+	s.db.waitlist = filterDocs(s.db.waitlist, func(e WaitlistEntry) bool { return e.ID != id })
+	return int64(before - len(s.db.waitlist)), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryBookingInsertReservesSlots(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+	tests := []struct {
+		name     string
+		existing Booking
+		err      error
+	}{
+		{"a confirmed booking takes the slot", Booking{Status: StatusConfirmed}, ErrSlotTaken},
+		{"a legacy booking without status takes the slot", Booking{}, ErrSlotTaken},
+		{"a live hold takes the slot", Booking{Status: StatusPending, HoldExpiresAt: &future}, ErrSlotTaken},
+		{"an expired hold is released", Booking{Status: StatusPending, HoldExpiresAt: &past}, nil},
+		{"a cancelled booking frees the slot", Booking{Status: StatusCancelled}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			stores := newMemoryStores([]AppointmentOption{testOption()})
+			existing := tt.existing
+			existing.AppointmentDate, existing.Treatment, existing.Slot = testDate, "Teeth Cleaning", testSlots[0]
+			existing.Email = "p@x.com"
+			if err := stores.Bookings.Insert(ctx, &existing); err != nil {
+				t.Fatal(err)
+			}
+
+			booking := Booking{AppointmentDate: testDate, Treatment: "Teeth Cleaning", Slot: testSlots[0], Email: "q@x.com", Status: StatusConfirmed}
+			if err := stores.Bookings.Insert(ctx, &booking); err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMemoryBookingQueries(t *testing.T) {
+	ctx := context.Background()
+	stores := newMemoryStores([]AppointmentOption{testOption()})
+	for _, b := range []Booking{
+		{AppointmentDate: testDate, Treatment: "Teeth Cleaning", Slot: testSlots[0], Email: "p@x.com", Status: StatusCancelled},
+		{AppointmentDate: testDate, Treatment: "Teeth Cleaning", Slot: testSlots[1], Email: "p@x.com", Status: StatusConfirmed},
+		{AppointmentDate: "Jan 6, 2099", Treatment: "Teeth Cleaning", Slot: testSlots[0], Email: "q@x.com", Status: StatusConfirmed},
+	} {
+		if err := stores.Bookings.Insert(ctx, &b); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	byDate, _ := stores.Bookings.FindByDate(ctx, testDate)
+	if len(byDate) != 2 {
+		t.Errorf("FindByDate returned %d bookings, want 2", len(byDate))
+	}
+	byEmail, _ := stores.Bookings.FindByEmail(ctx, "q@x.com")
+	if len(byEmail) != 1 {
+		t.Errorf("FindByEmail returned %d bookings, want 1", len(byEmail))
+	}
+
+	// The cancelled booking is skipped for the active one
+	active, err := stores.Bookings.FindByPatient(ctx, "p@x.com", testDate, "Teeth Cleaning")
+	if err != nil || active.Slot != testSlots[1] {
+		t.Errorf("FindByPatient returned %v, %v", active, err)
+	}
+	if _, err := stores.Bookings.FindByPatient(ctx, "p@x.com", "Jan 6, 2099", "Teeth Cleaning"); err != ErrNotFound {
+		t.Errorf("FindByPatient on a day without bookings returned %v", err)
+	}
+
+	options, err := stores.AppointmentOptions.Available(ctx, testDate)
+	if err != nil || len(options) != 1 {
+		t.Fatalf("Available returned %v, %v", options, err)
+	}
+	if booked := options[0].Booked; len(booked) != 1 || booked[0].Slot != testSlots[1] {
+		t.Errorf("Available booked %v, want only %s", booked, testSlots[1])
+	}
+}
+
+func TestMemoryOptionsAreCopies(t *testing.T) {
+	ctx := context.Background()
+	stores := newMemoryStores([]AppointmentOption{testOption()})
+	option, _ := stores.AppointmentOptions.FindByName(ctx, "Teeth Cleaning")
+	option.Slots[0] = "changed"
+
+	again, _ := stores.AppointmentOptions.FindByName(ctx, "Teeth Cleaning")
+	if again.Slots[0] != testSlots[0] {
+		t.Errorf("changing a returned option changed the store: %v", again.Slots)
+	}
+}
+
+func TestLoadSeedOptions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seed.json")
+	seed := `[{"Name": "Teeth Cleaning", "Slots": ["08.00 AM - 08.30 AM"], "Price": 20}]`
+	if err := os.WriteFile(path, []byte(seed), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	options, err := loadSeedOptions(path)
+	if err != nil || len(options) != 1 || options[0].Name != "Teeth Cleaning" || options[0].Price != 20 {
+		t.Fatalf("got %v, %v", options, err)
+	}
+	if options, err := loadSeedOptions(""); err != nil || options != nil {
+		t.Errorf("an empty path gave %v, %v", options, err)
+	}
+}
+
+func TestMemoryPaymentRecordOncePerCharge(t *testing.T) {
+	ctx := context.Background()
+	stores := newMemoryStores([]AppointmentOption{testOption()})
+	change := StatusChange{From: StatusConfirmed, To: StatusPaid, At: time.Now()}
+	tests := []struct {
+		name        string
+		slot        string
+		transaction string
+		err         error
+	}{
+		{"a first charge", testSlots[0], "pi_1", nil},
+		{"the same booking again", testSlots[0], "pi_2", ErrDuplicatePayment},
+		{"the same charge for another booking", testSlots[1], "pi_1", ErrDuplicatePayment},
+		{"another charge for another booking", testSlots[1], "pi_2", nil},
+	}
+	bookings := map[string]Booking{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			booking, ok := bookings[tt.slot]
+			if !ok {
+				booking = Booking{AppointmentDate: testDate, Treatment: "Teeth Cleaning", Slot: tt.slot, Email: "p@x.com", Status: StatusConfirmed}
+				if err := stores.Bookings.Insert(ctx, &booking); err != nil {
+					t.Fatal(err)
+				}
+				bookings[tt.slot] = booking
+			}
+			payment := Payment{TransactionID: tt.transaction, Amount: 2000, Currency: "usd", Booking: paymentBookingFrom(booking)}
+			if err := stores.Payments.Record(ctx, &payment, change); err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMemoryPaymentAddRefund(t *testing.T) {
+	ctx := context.Background()
+	stores := newMemoryStores([]AppointmentOption{testOption()})
+	booking := Booking{AppointmentDate: testDate, Treatment: "Teeth Cleaning", Slot: testSlots[0], Email: "p@x.com", Status: StatusConfirmed}
+	if err := stores.Bookings.Insert(ctx, &booking); err != nil {
+		t.Fatal(err)
+	}
+	payment := Payment{TransactionID: "pi_1", Amount: 2000, Currency: "usd", Booking: paymentBookingFrom(booking)}
+	change := StatusChange{From: StatusConfirmed, To: StatusPaid, At: time.Now()}
+	if err := stores.Payments.Record(ctx, &payment, change); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		amount int64
+		err    error
+		left   int64
+	}{
+		{"a partial refund", 1500, nil, 500},
+		{"more than is left", 1000, ErrRefundExceeded, 500},
+		{"the rest", 500, nil, 0},
+		{"anything after a full refund", 1, ErrRefundExceeded, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stores.Payments.AddRefund(ctx, payment.ID, RefundRecord{Amount: tt.amount, At: time.Now()})
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+			if got.netAmount() != tt.left {
+				t.Errorf("%d left, want %d", got.netAmount(), tt.left)
+			}
+		})
+	}
+}
+
+func TestMemoryUserInsertOncePerEmail(t *testing.T) {
+	ctx := context.Background()
+	stores := newMemoryStores([]AppointmentOption{testOption()})
+	if err := stores.Users.Insert(ctx, &User{Email: "p@x.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := stores.Users.Insert(ctx, &User{Email: "p@x.com"}); err != ErrDuplicateEmail {
+		t.Fatalf("got %v, want %v", err, ErrDuplicateEmail)
+	}
+	if err := stores.Users.Insert(ctx, &User{Email: "q@x.com"}); err != nil {
+		t.Fatal(err)
+	}
+}
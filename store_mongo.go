@@ -0,0 +1,1113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// newMongoStores builds MongoDB backed stores on top of the given database
+func newMongoStores(db *mongo.Database) Stores {
+	bookings := db.Collection("bookingCollaction")
+	return Stores{
+		AppointmentOptions: &mongoAppointmentOptionStore{coll: db.Collection("appointmentCollection"), bookings: bookings},
+		Bookings:           &mongoBookingStore{coll: bookings},
+		Users:              &mongoUserStore{coll: db.Collection("usersCollaction")},
+		Doctors:            &mongoDoctorStore{coll: db.Collection("doctorsCollactions")},
+		Blackouts:          &mongoBlackoutStore{coll: db.Collection("blackouts")},
+		Waitlist:           &mongoWaitlistStore{coll: db.Collection("waitlist")},
+		Payments:           &mongoPaymentStore{client: db.Client(), coll: db.Collection("paymentCollection"), bookings: bookings},
+		Contacts:           &mongoContactStore{coll: db.Collection("contactCollection")},
+		WebhookEvents:      &mongoWebhookEventStore{coll: db.Collection("paymentWebhookEvents")},
+		PasswordResets:     &mongoPasswordResetStore{coll: db.Collection("passwordResets")},
+		Sessions:           &mongoSessionStore{coll: db.Collection("sessions")},
+		APIKeys:            &mongoAPIKeyStore{coll: db.Collection("apiKeys")},
+	}
+}
+
+// ensureMongoIndexes migrates stored documents and creates the indexes the
+// stores rely on for correctness
+func ensureMongoIndexes(ctx context.Context, db *mongo.Database) error {
+	// Users used to have a single role string; only "admin" was ever meaningful
+	users := db.Collection("usersCollaction")
+	_, err := users.UpdateMany(ctx,
+		bson.M{"role": RoleAdmin, "roles": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"roles": []Role{RoleAdmin}}},
+	)
+	if err != nil {
+		return err
+	}
+	if _, err := users.UpdateMany(ctx, bson.M{"role": bson.M{"$exists": true}}, bson.M{"$unset": bson.M{"role": ""}}); err != nil {
+		return err
+	}
+
+	// An identity provider account can only be linked to one user
+	_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "identities", Value: 1}},
+		Options: options.Index().SetName("unique_identity").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"identities": bson.M{"$exists": true}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Registration checks for an existing account before inserting one, which
+	// two concurrent requests can both pass. Index creation fails while
+	// duplicate accounts are stored; merge them first.
+	_, err = users.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "email", Value: 1}},
+		Options: options.Index().SetName("unique_email").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"email": bson.M{"$gt": ""}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	bookings := db.Collection("bookingCollaction")
+
+	// Bookings stored before statuses existed are confirmed; give them a status
+	// so the partial unique index below covers them
+	_, err = bookings.UpdateMany(ctx,
+		bson.M{"status": bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{"status": StatusConfirmed}},
+	)
+	if err != nil {
+		return err
+	}
+
+	// Superseded by unique_active_slot, which lets cancelled slots be rebooked,
+	// and that by unique_active_doctor_slot, which lets every doctor offering a
+	// slot be booked for it
+	for _, name := range []string{"unique_slot", "unique_active_slot"} {
+		if _, err := bookings.Indexes().DropOne(ctx, name); err != nil {
+			if cmdErr, ok := err.(mongo.CommandError); !ok || cmdErr.Name != "IndexNotFound" {
+				return err
+			}
+		}
+	}
+
+	// A treatment slot can only be held by one active booking per date and
+	// doctor; fixed slots have no doctor, so one booking per date.
+	// Partial indexes using $in need MongoDB 6.0 or newer.
+	_, err = bookings.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "treatment", Value: 1}, {Key: "appointmentDate", Value: 1}, {Key: "slot", Value: 1}, {Key: "doctorId", Value: 1}},
+		Options: options.Index().SetName("unique_active_doctor_slot").SetUnique(true).
+			SetPartialFilterExpression(bson.M{"status": bson.M{"$in": activeBookingStatuses}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Lets bookings be queried by time range
+	_, err = bookings.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "startsAt", Value: 1}},
+		Options: options.Index().SetName("bookings_by_start"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// A booking can only be paid once, and a charge can only pay one booking.
+	// Payments recorded before charges were required have no transaction.
+	_, err = db.Collection("paymentCollection").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "booking._id", Value: 1}},
+			Options: options.Index().SetName("unique_booking_payment").SetUnique(true),
+		},
+		{
+			Keys: bson.D{{Key: "transactionId", Value: 1}},
+			Options: options.Index().SetName("unique_transaction").SetUnique(true).
+				SetPartialFilterExpression(bson.M{"transactionId": bson.M{"$gt": ""}}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Reset tokens are looked up by hash and removed by MongoDB once expired
+	_, err = db.Collection("passwordResets").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "tokenHash", Value: 1}},
+			Options: options.Index().SetName("unique_token_hash").SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetName("expire_resets").SetExpireAfterSeconds(0),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Waiting patients are queued per treatment in the order they joined, and
+	// claim links are looked up by token hash
+	_, err = db.Collection("waitlist").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "treatment", Value: 1}, {Key: "status", Value: 1}, {Key: "createdAt", Value: 1}},
+			Options: options.Index().SetName("waitlist_queue"),
+		},
+		{
+			Keys:    bson.D{{Key: "offer.claimTokenHash", Value: 1}},
+			Options: options.Index().SetName("waitlist_claims").SetSparse(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sessions are revoked per user and removed by MongoDB once expired
+	_, err = db.Collection("sessions").Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "userId", Value: 1}},
+			Options: options.Index().SetName("sessions_by_user"),
+		},
+		{
+			Keys:    bson.D{{Key: "expiresAt", Value: 1}},
+			Options: options.Index().SetName("expire_sessions").SetExpireAfterSeconds(0),
+		},
+	})
+	return err
+}
+
+// migrateBookingTimes gives bookings stored before StartsAt and EndsAt existed
+// their times, read in the clinic's time zone loc, and rewrites their dates
+// in the format used for comparisons. Bookings whose date or slot cannot be
+// parsed are logged and left as they are.
+func migrateBookingTimes(ctx context.Context, db *mongo.Database, loc *time.Location) error {
+	bookings := db.Collection("bookingCollaction")
+	legacy, err := findAll[Booking](ctx, bookings, bson.M{"startsAt": bson.M{"$exists": false}})
+	if err != nil {
+		return err
+	}
+
+	for _, booking := range legacy {
+		if err := booking.setTimes(loc); err != nil {
+			log.Printf("Cannot migrate times of booking %s: %v", booking.ID.Hex(), err)
+			continue
+		}
+		_, err := bookings.UpdateOne(ctx, bson.M{"_id": booking.ID}, bson.M{"$set": bson.M{
+			"appointmentDate": booking.AppointmentDate,
+			"startsAt":        booking.StartsAt,
+			"endsAt":          booking.EndsAt,
+		}})
+		// The same slot may have been booked under two spellings of its date
+		if mongo.IsDuplicateKeyError(err) {
+			log.Printf("Cannot migrate times of booking %s: its slot is also booked as %s", booking.ID.Hex(), booking.AppointmentDate)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findAll runs a query and decodes every matching document into T
+func findAll[T any](ctx context.Context, coll *mongo.Collection, filter interface{}, opts ...*options.FindOptions) ([]T, error) {
+	cursor, err := coll.Find(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var docs []T
+	if err = cursor.All(ctx, &docs); err != nil {
+		return nil, err
+	}
+	return docs, nil
+}
+
+// findOne decodes the first document matching filter, mapping a missing document to ErrNotFound
+func findOne[T any](ctx context.Context, coll *mongo.Collection, filter interface{}) (T, error) {
+	var doc T
+	err := coll.FindOne(ctx, filter).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return doc, ErrNotFound
+	}
+	return doc, err
+}
+
+// newObjectID returns id, or a freshly generated ID when id is unset
+func newObjectID(id primitive.ObjectID) primitive.ObjectID {
+	if id.IsZero() {
+		return primitive.NewObjectID()
+	}
+	return id
+}
+
+type mongoAppointmentOptionStore struct {
+	coll     *mongo.Collection
+	bookings *mongo.Collection
+}
+
+func (s *mongoAppointmentOptionStore) List(ctx context.Context) ([]AppointmentOption, error) {
+	return findAll[AppointmentOption](ctx, s.coll, bson.M{})
+}
+
+func (s *mongoAppointmentOptionStore) FindByName(ctx context.Context, name string) (AppointmentOption, error) {
+	return findOne[AppointmentOption](ctx, s.coll, bson.M{"name": name})
+}
+
+func (s *mongoAppointmentOptionStore) Available(ctx context.Context, date string) ([]BookedOption, error) {
+	// Slots are subtracted by the caller, which keeps their order; a
+	// $setDifference here would not
+	pipeline := []bson.M{
+		{"$lookup": bson.M{
+			"from":         s.bookings.Name(),
+			"localField":   "name",
+			"foreignField": "treatment",
+			"pipeline": []bson.M{
+				{"$match": bson.M{
+					"appointmentDate": date,
+					"holdExpiresAt":   bson.M{"$not": bson.M{"$lte": time.Now()}},
+					"status":          bson.M{"$ne": StatusCancelled},
+				}},
+				{"$project": bson.M{"_id": 0, "slot": 1, "doctorId": 1}},
+			},
+			"as": "booked",
+		}},
+		{"$project": bson.M{
+			"name":   1,
+			"slots":  1,
+			"price":  1,
+			"booked": 1,
+		}},
+	}
+
+	cursor, err := s.coll.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var options []BookedOption
+	if err = cursor.All(ctx, &options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+type mongoBookingStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoBookingStore) FindByID(ctx context.Context, id primitive.ObjectID) (Booking, error) {
+	return findOne[Booking](ctx, s.coll, bson.M{"_id": id})
+}
+
+func (s *mongoBookingStore) FindByEmail(ctx context.Context, email string) ([]Booking, error) {
+	return findAll[Booking](ctx, s.coll, bson.M{"email": email})
+}
+
+func (s *mongoBookingStore) FindByDate(ctx context.Context, date string) ([]Booking, error) {
+	return findAll[Booking](ctx, s.coll, bson.M{"appointmentDate": date})
+}
+
+func (s *mongoBookingStore) FindByDates(ctx context.Context, dates []string) ([]Booking, error) {
+	return findAll[Booking](ctx, s.coll, bson.M{"appointmentDate": bson.M{"$in": dates}})
+}
+
+func (s *mongoBookingStore) FindByPatient(ctx context.Context, email, date, treatment string) (Booking, error) {
+	return findOne[Booking](ctx, s.coll, bson.M{
+		"appointmentDate": date,
+		"email":           email,
+		"treatment":       treatment,
+		"status":          bson.M{"$ne": StatusCancelled},
+	})
+}
+
+// releaseExpiredHolds deletes lapsed holds on a slot so they cannot block a new booking
+func (s *mongoBookingStore) releaseExpiredHolds(ctx context.Context, treatment, date, slot string) error {
+	_, err := s.coll.DeleteMany(ctx, bson.M{
+		"treatment":       treatment,
+		"appointmentDate": date,
+		"slot":            slot,
+		"holdExpiresAt":   bson.M{"$lte": time.Now()},
+	})
+	return err
+}
+
+func (s *mongoBookingStore) Insert(ctx context.Context, booking *Booking) error {
+	if err := s.releaseExpiredHolds(ctx, booking.Treatment, booking.AppointmentDate, booking.Slot); err != nil {
+		return err
+	}
+
+	booking.ID = newObjectID(booking.ID)
+	_, err := s.coll.InsertOne(ctx, booking)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrSlotTaken
+	}
+	return err
+}
+
+func (s *mongoBookingStore) AssignDoctors(ctx context.Context, treatment, date, slot string, doctors []primitive.ObjectID) error {
+	if err := s.releaseExpiredHolds(ctx, treatment, date, slot); err != nil {
+		return err
+	}
+	withoutDoctor, err := findAll[Booking](ctx, s.coll, bson.M{
+		"treatment":       treatment,
+		"appointmentDate": date,
+		"slot":            slot,
+		"status":          bson.M{"$in": activeBookingStatuses},
+		"doctorId":        bson.M{"$exists": false},
+	})
+	if err != nil {
+		return err
+	}
+	for _, booking := range withoutDoctor {
+		for _, id := range doctors {
+			// unique_active_doctor_slot rejects doctors already booked for the slot
+			_, err := s.coll.UpdateOne(ctx,
+				bson.M{"_id": booking.ID, "doctorId": bson.M{"$exists": false}},
+				bson.M{"$set": bson.M{"doctorId": id}},
+			)
+			if mongo.IsDuplicateKeyError(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			// Assigned, or another request assigned it first
+			break
+		}
+	}
+	return nil
+}
+
+func (s *mongoBookingStore) Transition(ctx context.Context, id primitive.ObjectID, change StatusChange) error {
+	return s.applyTransition(ctx, id, change, bson.M{"status": change.To})
+}
+
+func (s *mongoBookingStore) SetPaymentError(ctx context.Context, id primitive.ObjectID, message string) error {
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"paymentError": message}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoBookingStore) Reschedule(ctx context.Context, id primitive.ObjectID, moved Booking, change StatusChange) error {
+	booking, err := s.FindByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := s.releaseExpiredHolds(ctx, booking.Treatment, moved.AppointmentDate, moved.Slot); err != nil {
+		return err
+	}
+
+	err = s.applyTransition(ctx, id, change, bson.M{
+		"status":          change.To,
+		"appointmentDate": moved.AppointmentDate,
+		"slot":            moved.Slot,
+		"doctorId":        moved.DoctorID,
+		"startsAt":        moved.StartsAt,
+		"endsAt":          moved.EndsAt,
+		"conflicts":       moved.Conflicts,
+	})
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrSlotTaken
+	}
+	return err
+}
+
+// applyTransition sets fields on a booking that is still in change.From and records the change
+func (s *mongoBookingStore) applyTransition(ctx context.Context, id primitive.ObjectID, change StatusChange, set bson.M) error {
+	filter := bson.M{"_id": id, "status": change.From}
+	update := bson.M{"$set": set, "$push": bson.M{"statusHistory": change}}
+	result, err := s.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := s.FindByID(ctx, id); err != nil {
+			return err
+		}
+		return ErrStatusChanged
+	}
+	return nil
+}
+
+func (s *mongoBookingStore) DeleteExpiredHolds(ctx context.Context, now time.Time) (int64, error) {
+	result, err := s.coll.DeleteMany(ctx, bson.M{"holdExpiresAt": bson.M{"$lte": now}})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+func (s *mongoBookingStore) ConfirmHold(ctx context.Context, id primitive.ObjectID, change StatusChange) error {
+	filter := bson.M{
+		"_id":           id,
+		"status":        change.From,
+		"holdExpiresAt": bson.M{"$not": bson.M{"$lte": change.At}},
+	}
+	update := bson.M{
+		"$set":   bson.M{"status": change.To},
+		"$unset": bson.M{"holdExpiresAt": ""},
+		"$push":  bson.M{"statusHistory": change},
+	}
+	result, err := s.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		booking, err := s.FindByID(ctx, id)
+		if err != nil {
+			return err
+		}
+		if booking.holdExpired(change.At) {
+			return ErrNotFound
+		}
+		return ErrStatusChanged
+	}
+	return nil
+}
+
+func (s *mongoBookingStore) FindBetween(ctx context.Context, from, to time.Time) ([]Booking, error) {
+	return findAll[Booking](ctx, s.coll, bson.M{"startsAt": bson.M{"$lt": to}, "endsAt": bson.M{"$gt": from}})
+}
+
+func (s *mongoBookingStore) FindConflicted(ctx context.Context) ([]Booking, error) {
+	return findAll[Booking](ctx, s.coll, bson.M{"conflicts.0": bson.M{"$exists": true}})
+}
+
+func (s *mongoBookingStore) FlagConflict(ctx context.Context, ids []primitive.ObjectID, blackoutID primitive.ObjectID) error {
+	_, err := s.coll.UpdateMany(ctx, bson.M{"_id": bson.M{"$in": ids}}, bson.M{"$addToSet": bson.M{"conflicts": blackoutID}})
+	return err
+}
+
+func (s *mongoBookingStore) ClearConflict(ctx context.Context, blackoutID primitive.ObjectID) error {
+	_, err := s.coll.UpdateMany(ctx, bson.M{"conflicts": blackoutID}, bson.M{"$pull": bson.M{"conflicts": blackoutID}})
+	return err
+}
+
+type mongoUserStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoUserStore) List(ctx context.Context) ([]User, error) {
+	return findAll[User](ctx, s.coll, bson.M{})
+}
+
+func (s *mongoUserStore) FindByEmail(ctx context.Context, email string) (User, error) {
+	return findOne[User](ctx, s.coll, bson.M{"email": email})
+}
+
+func (s *mongoUserStore) Insert(ctx context.Context, user *User) error {
+	user.ID = newObjectID(user.ID)
+	_, err := s.coll.InsertOne(ctx, user)
+	if mongo.IsDuplicateKeyError(err) && strings.Contains(err.Error(), "unique_email") {
+		return ErrDuplicateEmail
+	}
+	return err
+}
+
+func (s *mongoUserStore) FindByID(ctx context.Context, id primitive.ObjectID) (User, error) {
+	return findOne[User](ctx, s.coll, bson.M{"_id": id})
+}
+
+func (s *mongoUserStore) FindByIdentity(ctx context.Context, provider, subject string) (User, error) {
+	// Matches whole identity documents, so the unique_identity index is used
+	return findOne[User](ctx, s.coll, bson.M{"identities": Identity{Provider: provider, Subject: subject}})
+}
+
+func (s *mongoUserStore) LinkIdentity(ctx context.Context, id primitive.ObjectID, identity Identity) error {
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$addToSet": bson.M{"identities": identity}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// updateRoles applies update to the user's roles, without creating missing users
+func (s *mongoUserStore) updateRoles(ctx context.Context, id primitive.ObjectID, update bson.M) (int64, error) {
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return 0, err
+	}
+	if result.MatchedCount == 0 {
+		return 0, ErrNotFound
+	}
+	return result.ModifiedCount, nil
+}
+
+func (s *mongoUserStore) GrantRole(ctx context.Context, id primitive.ObjectID, role Role) (int64, error) {
+	return s.updateRoles(ctx, id, bson.M{"$addToSet": bson.M{"roles": role}})
+}
+
+func (s *mongoUserStore) RevokeRole(ctx context.Context, id primitive.ObjectID, role Role) (int64, error) {
+	return s.updateRoles(ctx, id, bson.M{"$pull": bson.M{"roles": role}})
+}
+
+func (s *mongoUserStore) SetRoles(ctx context.Context, id primitive.ObjectID, roles []Role) error {
+	if roles == nil {
+		roles = []Role{}
+	}
+	_, err := s.updateRoles(ctx, id, bson.M{"$set": bson.M{"roles": roles}})
+	return err
+}
+
+func (s *mongoUserStore) SetPassword(ctx context.Context, id primitive.ObjectID, hash string) error {
+	update := bson.M{
+		"$set":   bson.M{"passwordHash": hash},
+		"$unset": bson.M{"failedLogins": "", "lockedUntil": ""},
+	}
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) RecordLoginFailure(ctx context.Context, id primitive.ObjectID) (int, error) {
+	var user User
+	err := s.coll.FindOneAndUpdate(ctx,
+		bson.M{"_id": id},
+		bson.M{"$inc": bson.M{"failedLogins": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&user)
+	if err == mongo.ErrNoDocuments {
+		return 0, ErrNotFound
+	}
+	return user.FailedLogins, err
+}
+
+func (s *mongoUserStore) SetTOTP(ctx context.Context, id primitive.ObjectID, totp *TOTP) error {
+	update := bson.M{"$unset": bson.M{"totp": ""}}
+	if totp != nil {
+		update = bson.M{"$set": bson.M{"totp": totp}}
+	}
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) UseTOTPStep(ctx context.Context, id primitive.ObjectID, step int64) error {
+	// A missing lastStep compares below any number
+	filter := bson.M{"_id": id, "totp": bson.M{"$exists": true}, "totp.lastStep": bson.M{"$not": bson.M{"$gte": step}}}
+	result, err := s.coll.UpdateOne(ctx, filter, bson.M{"$set": bson.M{"totp.lastStep": step}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) ConsumeRecoveryCode(ctx context.Context, id primitive.ObjectID, hash string) error {
+	filter := bson.M{"_id": id, "totp.recoveryCodeHashes": hash}
+	result, err := s.coll.UpdateOne(ctx, filter, bson.M{"$pull": bson.M{"totp.recoveryCodeHashes": hash}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoUserStore) SetLockout(ctx context.Context, id primitive.ObjectID, until *time.Time) error {
+	update := bson.M{"$unset": bson.M{"failedLogins": "", "lockedUntil": ""}}
+	if until != nil {
+		update = bson.M{"$set": bson.M{"lockedUntil": *until}, "$unset": bson.M{"failedLogins": ""}}
+	}
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoDoctorStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoDoctorStore) List(ctx context.Context) ([]Doctor, error) {
+	return findAll[Doctor](ctx, s.coll, bson.M{})
+}
+
+func (s *mongoDoctorStore) FindByEmail(ctx context.Context, email string) (Doctor, error) {
+	return findOne[Doctor](ctx, s.coll, bson.M{"email": email})
+}
+
+func (s *mongoDoctorStore) Insert(ctx context.Context, doctor *Doctor) error {
+	doctor.ID = newObjectID(doctor.ID)
+	_, err := s.coll.InsertOne(ctx, doctor)
+	return err
+}
+
+func (s *mongoDoctorStore) SetSchedules(ctx context.Context, id primitive.ObjectID, schedules []TreatmentSchedule) error {
+	if schedules == nil {
+		schedules = []TreatmentSchedule{}
+	}
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"schedules": schedules}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoDoctorStore) Delete(ctx context.Context, id primitive.ObjectID) (int64, error) {
+	result, err := s.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+type mongoBlackoutStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoBlackoutStore) List(ctx context.Context, from, to time.Time) ([]Blackout, error) {
+	filter := bson.M{}
+	if !to.IsZero() {
+		filter["startsAt"] = bson.M{"$lt": to}
+	}
+	if !from.IsZero() {
+		filter["endsAt"] = bson.M{"$gt": from}
+	}
+	return findAll[Blackout](ctx, s.coll, filter, options.Find().SetSort(bson.D{{Key: "startsAt", Value: 1}}))
+}
+
+func (s *mongoBlackoutStore) Insert(ctx context.Context, blackout *Blackout) error {
+	blackout.ID = newObjectID(blackout.ID)
+	_, err := s.coll.InsertOne(ctx, blackout)
+	return err
+}
+
+func (s *mongoBlackoutStore) Delete(ctx context.Context, id primitive.ObjectID) (int64, error) {
+	result, err := s.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+type mongoWaitlistStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoWaitlistStore) Insert(ctx context.Context, entry *WaitlistEntry) error {
+	entry.ID = newObjectID(entry.ID)
+	_, err := s.coll.InsertOne(ctx, entry)
+	return err
+}
+
+func (s *mongoWaitlistStore) FindByID(ctx context.Context, id primitive.ObjectID) (WaitlistEntry, error) {
+	return findOne[WaitlistEntry](ctx, s.coll, bson.M{"_id": id})
+}
+
+func (s *mongoWaitlistStore) FindByEmail(ctx context.Context, email string) ([]WaitlistEntry, error) {
+	return findAll[WaitlistEntry](ctx, s.coll, bson.M{"email": email})
+}
+
+func (s *mongoWaitlistStore) Waiting(ctx context.Context, treatment string, at time.Time) ([]WaitlistEntry, error) {
+	filter := bson.M{
+		"treatment": treatment,
+		"status":    WaitlistWaiting,
+		"from":      bson.M{"$lte": at},
+		"to":        bson.M{"$gt": at},
+	}
+	return findAll[WaitlistEntry](ctx, s.coll, filter, options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}}))
+}
+
+func (s *mongoWaitlistStore) FindByClaimHash(ctx context.Context, hash string) (WaitlistEntry, error) {
+	return findOne[WaitlistEntry](ctx, s.coll, bson.M{"status": WaitlistOffered, "offer.claimTokenHash": hash})
+}
+
+func (s *mongoWaitlistStore) ExpiredOffers(ctx context.Context, now time.Time) ([]WaitlistEntry, error) {
+	return findAll[WaitlistEntry](ctx, s.coll, bson.M{"status": WaitlistOffered, "offer.expiresAt": bson.M{"$lte": now}})
+}
+
+// transition applies update to an entry still in status from
+func (s *mongoWaitlistStore) transition(ctx context.Context, id primitive.ObjectID, from WaitlistStatus, update interface{}) error {
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id, "status": from}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		if _, err := s.FindByID(ctx, id); err != nil {
+			return err
+		}
+		return ErrStatusChanged
+	}
+	return nil
+}
+
+func (s *mongoWaitlistStore) Offer(ctx context.Context, id primitive.ObjectID, offer WaitlistOffer) error {
+	return s.transition(ctx, id, WaitlistWaiting, bson.M{"$set": bson.M{"status": WaitlistOffered, "offer": offer}})
+}
+
+func (s *mongoWaitlistStore) Withdraw(ctx context.Context, id primitive.ObjectID, passed bool) error {
+	set := bson.M{"status": WaitlistWaiting}
+	if passed {
+		set["passed"] = bson.M{"$concatArrays": bson.A{bson.M{"$ifNull": bson.A{"$passed", bson.A{}}}, bson.A{"$offer.startsAt"}}}
+	}
+	return s.transition(ctx, id, WaitlistOffered, []bson.M{{"$set": set}, {"$unset": "offer"}})
+}
+
+func (s *mongoWaitlistStore) Claim(ctx context.Context, id primitive.ObjectID) error {
+	return s.transition(ctx, id, WaitlistOffered, bson.M{"$set": bson.M{"status": WaitlistClaimed}})
+}
+
+func (s *mongoWaitlistStore) Delete(ctx context.Context, id primitive.ObjectID) (int64, error) {
+	result, err := s.coll.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return 0, err
+	}
+	return result.DeletedCount, nil
+}
+
+type mongoPaymentStore struct {
+	client   *mongo.Client
+	coll     *mongo.Collection
+	bookings *mongo.Collection
+}
+
+func (s *mongoPaymentStore) Record(ctx context.Context, payment *Payment, change StatusChange) error {
+	payment.ID = newObjectID(payment.ID)
+
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, s.record(sc, payment, change)
+	})
+	if !transactionsUnsupported(err) {
+		return err
+	}
+
+	// Standalone servers cannot run transactions. The unique index on the
+	// booking still rejects duplicates; undo the insert if the booking update fails.
+	if err := s.record(ctx, payment, change); err != nil {
+		if _, delErr := s.coll.DeleteOne(ctx, bson.M{"_id": payment.ID}); delErr != nil {
+			return delErr
+		}
+		return err
+	}
+	return nil
+}
+
+// record inserts the payment and marks its booking paid
+func (s *mongoPaymentStore) record(ctx context.Context, payment *Payment, change StatusChange) error {
+	bookingID, err := primitive.ObjectIDFromHex(payment.Booking.ID)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	if _, err := s.coll.InsertOne(ctx, payment); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return ErrDuplicatePayment
+		}
+		return err
+	}
+
+	filter := bson.M{
+		"_id":           bookingID,
+		"status":        change.From,
+		"holdExpiresAt": bson.M{"$not": bson.M{"$lte": change.At}},
+	}
+	update := bson.M{
+		"$set":   bson.M{"status": change.To, "paid": true, "transactionId": payment.TransactionID},
+		"$unset": bson.M{"holdExpiresAt": "", "paymentError": ""},
+		"$push":  bson.M{"statusHistory": change},
+	}
+	result, err := s.bookings.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		booking, err := findOne[Booking](ctx, s.bookings, bson.M{"_id": bookingID})
+		if err != nil {
+			return err
+		}
+		if booking.holdExpired(change.At) {
+			return ErrNotFound
+		}
+		return ErrStatusChanged
+	}
+	return nil
+}
+
+func (s *mongoPaymentStore) FindByTransaction(ctx context.Context, transactionID string) (Payment, error) {
+	return findOne[Payment](ctx, s.coll, bson.M{"transactionId": transactionID})
+}
+
+func (s *mongoPaymentStore) List(ctx context.Context) ([]Payment, error) {
+	return findAll[Payment](ctx, s.coll, bson.M{})
+}
+
+func (s *mongoPaymentStore) FindByBooking(ctx context.Context, bookingID primitive.ObjectID) (Payment, error) {
+	return findOne[Payment](ctx, s.coll, bson.M{"booking._id": bookingID.Hex()})
+}
+
+func (s *mongoPaymentStore) AddRefund(ctx context.Context, id primitive.ObjectID, refund RefundRecord) (Payment, error) {
+	// The refund is only added while the history stays within the payment
+	filter := bson.M{"_id": id, "$expr": bson.M{"$lte": bson.A{
+		bson.M{"$add": bson.A{bson.M{"$sum": "$refunds.amount"}, refund.Amount}},
+		"$amount",
+	}}}
+	var payment Payment
+	err := s.coll.FindOneAndUpdate(ctx, filter, bson.M{"$push": bson.M{"refunds": refund}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&payment)
+	if err == mongo.ErrNoDocuments {
+		if payment, err = findOne[Payment](ctx, s.coll, bson.M{"_id": id}); err != nil {
+			return payment, err
+		}
+		return payment, ErrRefundExceeded
+	}
+	if err != nil {
+		return payment, err
+	}
+
+	if total := refundedTotal(payment.Refunds); total > payment.AmountRefunded {
+		payment.AmountRefunded = total
+	}
+	payment.Status = refundStatus(payment.Amount, payment.AmountRefunded)
+	update := bson.M{
+		"$max": bson.M{"amountRefunded": payment.AmountRefunded},
+		"$set": bson.M{"status": payment.Status},
+	}
+	if _, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, update); err != nil {
+		return payment, err
+	}
+	return payment, s.markUnpaidIfRefunded(ctx, payment)
+}
+
+func (s *mongoPaymentStore) SetAmountRefunded(ctx context.Context, transactionID string, amount int64) (Payment, error) {
+	payment, err := s.FindByTransaction(ctx, transactionID)
+	if err != nil {
+		return payment, err
+	}
+
+	if amount > payment.AmountRefunded {
+		status := refundStatus(payment.Amount, amount)
+		filter := bson.M{"_id": payment.ID, "$or": []bson.M{
+			{"amountRefunded": bson.M{"$lt": amount}},
+			{"amountRefunded": bson.M{"$exists": false}},
+		}}
+		update := bson.M{"$set": bson.M{"amountRefunded": amount, "status": status}}
+		if _, err := s.coll.UpdateOne(ctx, filter, update); err != nil {
+			return payment, err
+		}
+		payment.AmountRefunded = amount
+		payment.Status = status
+	}
+	return payment, s.markUnpaidIfRefunded(ctx, payment)
+}
+
+// markUnpaidIfRefunded clears the paid flag of the booking of a fully refunded payment
+func (s *mongoPaymentStore) markUnpaidIfRefunded(ctx context.Context, payment Payment) error {
+	if payment.Status != PaymentRefunded {
+		return nil
+	}
+	bookingID, err := primitive.ObjectIDFromHex(payment.Booking.ID)
+	if err != nil {
+		return nil
+	}
+	_, err = s.bookings.UpdateOne(ctx, bson.M{"_id": bookingID}, bson.M{"$set": bson.M{"paid": false}})
+	return err
+}
+
+// transactionsUnsupported reports whether err means the server cannot run
+// multi-document transactions, as is the case for standalone deployments
+func transactionsUnsupported(err error) bool {
+	var cmdErr mongo.CommandError
+	return errors.As(err, &cmdErr) && cmdErr.Code == 20 // IllegalOperation
+}
+
+type mongoContactStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoContactStore) Insert(ctx context.Context, contact *Contact) error {
+	contact.ID = newObjectID(contact.ID)
+	_, err := s.coll.InsertOne(ctx, contact)
+	return err
+}
+
+type mongoWebhookEventStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoWebhookEventStore) Insert(ctx context.Context, event *WebhookEvent) error {
+	_, err := s.coll.InsertOne(ctx, event)
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrDuplicateEvent
+	}
+	return err
+}
+
+func (s *mongoWebhookEventStore) FindByID(ctx context.Context, id string) (WebhookEvent, error) {
+	return findOne[WebhookEvent](ctx, s.coll, bson.M{"_id": id})
+}
+
+func (s *mongoWebhookEventStore) MarkProcessed(ctx context.Context, id string, at time.Time, reason string) error {
+	update := bson.M{"$set": bson.M{"processedAt": at, "error": reason}}
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoPasswordResetStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoPasswordResetStore) Insert(ctx context.Context, reset *PasswordReset) error {
+	reset.ID = newObjectID(reset.ID)
+	_, err := s.coll.InsertOne(ctx, reset)
+	return err
+}
+
+func (s *mongoPasswordResetStore) Consume(ctx context.Context, tokenHash string, now time.Time) (PasswordReset, error) {
+	var reset PasswordReset
+	err := s.coll.FindOneAndUpdate(ctx,
+		bson.M{"tokenHash": tokenHash, "usedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}},
+		bson.M{"$set": bson.M{"usedAt": now}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&reset)
+	if err == mongo.ErrNoDocuments {
+		return reset, ErrNotFound
+	}
+	return reset, err
+}
+
+type mongoSessionStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoSessionStore) Insert(ctx context.Context, session *Session) error {
+	session.ID = newObjectID(session.ID)
+	_, err := s.coll.InsertOne(ctx, session)
+	return err
+}
+
+func (s *mongoSessionStore) FindByID(ctx context.Context, id primitive.ObjectID) (Session, error) {
+	return findOne[Session](ctx, s.coll, bson.M{"_id": id})
+}
+
+func (s *mongoSessionStore) Rotate(ctx context.Context, id primitive.ObjectID, oldHash, newHash string, now time.Time) error {
+	filter := bson.M{
+		"_id":              id,
+		"refreshTokenHash": oldHash,
+		"revokedAt":        bson.M{"$exists": false},
+		"expiresAt":        bson.M{"$gt": now},
+	}
+	update := bson.M{
+		"$set":  bson.M{"refreshTokenHash": newHash, "refreshedAt": now},
+		"$push": bson.M{"usedTokenHashes": oldHash},
+	}
+	result, err := s.coll.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoSessionStore) Revoke(ctx context.Context, id primitive.ObjectID, now time.Time, reason string) error {
+	filter := bson.M{"_id": id, "revokedAt": bson.M{"$exists": false}}
+	update := bson.M{"$set": bson.M{"revokedAt": now, "revokedReason": reason}}
+	_, err := s.coll.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (s *mongoSessionStore) RevokeAllForUser(ctx context.Context, userID primitive.ObjectID, now time.Time, reason string) (int64, error) {
+	filter := bson.M{"userId": userID, "revokedAt": bson.M{"$exists": false}, "expiresAt": bson.M{"$gt": now}}
+	update := bson.M{"$set": bson.M{"revokedAt": now, "revokedReason": reason}}
+	result, err := s.coll.UpdateMany(ctx, filter, update)
+	if err != nil {
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (s *mongoSessionStore) SetMFAVerified(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"mfaVerifiedAt": at}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+type mongoAPIKeyStore struct {
+	coll *mongo.Collection
+}
+
+func (s *mongoAPIKeyStore) List(ctx context.Context) ([]APIKey, error) {
+	return findAll[APIKey](ctx, s.coll, bson.M{})
+}
+
+func (s *mongoAPIKeyStore) Insert(ctx context.Context, key *APIKey) error {
+	key.ID = newObjectID(key.ID)
+	_, err := s.coll.InsertOne(ctx, key)
+	return err
+}
+
+func (s *mongoAPIKeyStore) FindByID(ctx context.Context, id primitive.ObjectID) (APIKey, error) {
+	return findOne[APIKey](ctx, s.coll, bson.M{"_id": id})
+}
+
+func (s *mongoAPIKeyStore) Revoke(ctx context.Context, id primitive.ObjectID, now time.Time) error {
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, []bson.M{
+		{"$set": bson.M{"revokedAt": bson.M{"$ifNull": bson.A{"$revokedAt", now}}}},
+	})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *mongoAPIKeyStore) Touch(ctx context.Context, id primitive.ObjectID, at time.Time) error {
+	result, err := s.coll.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"lastUsedAt": at}})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
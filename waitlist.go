@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// maxWaitlistDays bounds the dates a patient can wait for at once
+const maxWaitlistDays = 92
+
+// WaitlistRequest is the body accepted when joining the waitlist
+type WaitlistRequest struct {
+	Email     string `json:"email"`
+	Treatment string `json:"treatment"`
+	From      string `json:"from"`
+	To        string `json:"to"` // defaults to From
+}
+
+// WaitlistClaimRequest carries the token from a claim link
+type WaitlistClaimRequest struct {
+	Token string `json:"token"`
+}
+
+// handlePostWaitlist puts a patient on the waitlist for a treatment between
+// two dates
+func (s *Server) handlePostWaitlist(c *gin.Context) {
+	var req WaitlistRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !s.authorizeEmail(c, req.Email, PermBookingsWriteAny) {
+		return
+	}
+	if _, err := s.AppointmentOptions.FindByName(c, req.Treatment); err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown treatment"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch appointment option"})
+		}
+		return
+	}
+
+	if req.To == "" {
+		req.To = req.From
+	}
+	first, err := parseAppointmentDate(req.From, s.config.ClinicLocation)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	last, err := parseAppointmentDate(req.To, s.config.ClinicLocation)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	now := time.Now()
+	end := last.AddDate(0, 0, 1)
+	if !end.After(now) || !end.After(first) || end.After(first.AddDate(0, 0, maxWaitlistDays)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("to must be on or after from, not in the past and at most %d days after it", maxWaitlistDays-1)})
+		return
+	}
+
+	entry := WaitlistEntry{
+		Email:     req.Email,
+		Treatment: req.Treatment,
+		From:      first.UTC(),
+		To:        end.UTC(),
+		Status:    WaitlistWaiting,
+		CreatedAt: now,
+	}
+	if err := s.Waitlist.Insert(c, &entry); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to join waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"InsertedID": entry.ID})
+}
+
+// handleGetWaitlist lists the waitlist entries of a patient, who must be the
+// caller unless they may read any booking
+func (s *Server) handleGetWaitlist(c *gin.Context) {
+	email := c.Query("email")
+	if !s.authorizeEmail(c, email, PermBookingsReadAny) {
+		return
+	}
+
+	entries, err := s.Waitlist.FindByEmail(c, email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch waitlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
+
+// handleDeleteWaitlist takes a patient off the waitlist. A slot held for them
+// is released and offered to the next patient.
+func (s *Server) handleDeleteWaitlist(c *gin.Context) {
+	id, err := primitive.ObjectIDFromHex(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid waitlist entry ID"})
+		return
+	}
+	entry, err := s.Waitlist.FindByID(c, id)
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "waitlist entry not found"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch waitlist entry"})
+		}
+		return
+	}
+	if !s.authorizeEmail(c, entry.Email, PermBookingsWriteAny) {
+		return
+	}
+
+	deleted, err := s.Waitlist.Delete(c, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to leave waitlist"})
+		return
+	}
+	if entry.Status == WaitlistOffered && entry.Offer != nil {
+		s.releaseOffer(c, entry, "left the waitlist")
+	}
+
+	c.JSON(http.StatusOK, gin.H{"DeletedCount": deleted})
+}
+
+// handleClaimWaitlistOffer turns the slot held for a waitlisted patient into
+// their booking. The token from the claim link is all that is needed.
+func (s *Server) handleClaimWaitlistOffer(c *gin.Context) {
+	var req WaitlistClaimRequest
+	if err := c.BindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	entry, err := s.Waitlist.FindByClaimHash(c, hashToken(req.Token))
+	if err != nil {
+		if err == ErrNotFound {
+			c.JSON(http.StatusNotFound, gin.H{"error": "invalid or already used claim link"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch waitlist entry"})
+		}
+		return
+	}
+	now := time.Now()
+	if !entry.Offer.ExpiresAt.After(now) {
+		c.JSON(http.StatusGone, gin.H{"error": "the offer has expired"})
+		return
+	}
+
+	change := StatusChange{From: StatusPending, To: StatusConfirmed, At: now, By: entry.Email, Reason: "claimed from waitlist"}
+	if err := s.Bookings.ConfirmHold(c, entry.Offer.BookingID, change); err != nil {
+		if err == ErrNotFound || err == ErrStatusChanged {
+			c.JSON(http.StatusGone, gin.H{"error": "the offer has expired"})
+		} else {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to book slot"})
+		}
+		return
+	}
+	if err := s.Waitlist.Claim(c, entry.ID); err != nil {
+		log.Printf("Failed to mark waitlist entry %s claimed: %v", entry.ID.Hex(), err)
+	}
+
+	booking, err := s.Bookings.FindByID(c, entry.Offer.BookingID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"bookingId": entry.Offer.BookingID})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"bookingId": booking.ID, "booking": s.viewBooking(booking)})
+}
+
+// offerFreedSlot offers the slot a booking left, when it was cancelled or
+// rescheduled, to the patients waiting for it, first come first served. The
+// slot is held for the patient it is offered to, so it only becomes public
+// again once nobody claims it.
+func (s *Server) offerFreedSlot(ctx context.Context, freed Booking) {
+	start, err := freed.startTime(s.config.ClinicLocation)
+	if err != nil || !start.After(time.Now()) {
+		return
+	}
+	entries, err := s.Waitlist.Waiting(ctx, freed.Treatment, start)
+	if err != nil {
+		log.Printf("Failed to fetch waitlist for %s: %v", freed.Treatment, err)
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.Email == freed.Email || passedSlot(entry, start) {
+			continue
+		}
+		existing, err := s.Bookings.FindByPatient(ctx, entry.Email, freed.AppointmentDate, freed.Treatment)
+		if err == nil && !existing.holdExpired(time.Now()) {
+			continue
+		}
+		offered, err := s.offerSlot(ctx, entry, freed)
+		if err != nil {
+			log.Printf("Failed to offer freed slot to waitlist entry %s: %v", entry.ID.Hex(), err)
+			return
+		}
+		if offered {
+			return
+		}
+	}
+}
+
+// passedSlot reports whether the patient let an offer of the slot starting
+// at start expire before
+func passedSlot(entry WaitlistEntry, start time.Time) bool {
+	for _, passed := range entry.Passed {
+		if passed.Equal(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// offerSlot holds the slot of freed for the patient of entry and sends them
+// a claim link. It reports false when the entry or the slot was taken by
+// someone else first.
+func (s *Server) offerSlot(ctx context.Context, entry WaitlistEntry, freed Booking) (bool, error) {
+	option, err := s.AppointmentOptions.FindByName(ctx, freed.Treatment)
+	if err != nil {
+		return false, err
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return false, err
+	}
+	token := hex.EncodeToString(secret)
+
+	now := time.Now()
+	expiresAt := now.Add(s.config.WaitlistClaimTTL)
+	hold := Booking{
+		AppointmentDate: freed.AppointmentDate,
+		Treatment:       freed.Treatment,
+		Slot:            freed.Slot,
+		DoctorID:        freed.DoctorID,
+		StartsAt:        freed.StartsAt,
+		EndsAt:          freed.EndsAt,
+		Email:           entry.Email,
+		Price:           option.Price,
+		HoldExpiresAt:   &expiresAt,
+		Status:          StatusPending,
+		ID:              primitive.NewObjectID(),
+	}
+	offer := WaitlistOffer{
+		BookingID:       hold.ID,
+		AppointmentDate: hold.AppointmentDate,
+		Slot:            hold.Slot,
+		ExpiresAt:       expiresAt,
+		ClaimTokenHash:  hashToken(token),
+	}
+	if hold.StartsAt != nil {
+		offer.StartsAt = *hold.StartsAt
+	}
+
+	// The entry is claimed for the offer first, so two freed slots cannot
+	// both go to the same patient
+	if err := s.Waitlist.Offer(ctx, entry.ID, offer); err != nil {
+		if err == ErrStatusChanged || err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	if insertErr := s.Bookings.Insert(ctx, &hold); insertErr != nil {
+		if err := s.Waitlist.Withdraw(ctx, entry.ID, false); err != nil {
+			log.Printf("Failed to put waitlist entry %s back in the queue: %v", entry.ID.Hex(), err)
+		}
+		if insertErr == ErrSlotTaken {
+			return true, nil // someone booked the slot meanwhile; nothing left to offer
+		}
+		return false, insertErr
+	}
+
+	link := token
+	if s.config.WaitlistClaimURL != "" {
+		link = s.config.WaitlistClaimURL + "?token=" + url.QueryEscape(token)
+	}
+	local := expiresAt.In(s.config.ClinicLocation)
+	body := fmt.Sprintf("A %s slot opened up on %s at %s. It is held for you until %s; claim it here: %s",
+		hold.Treatment, hold.AppointmentDate, hold.Slot, local.Format("Jan 2, 2006 03:04 PM MST"), link)
+	if err := s.notifier.Notify(ctx, entry.Email, "A slot you were waiting for is available", body); err != nil {
+		log.Printf("Failed to send waitlist offer to %s: %v", entry.Email, err)
+	}
+	return true, nil
+}
+
+// releaseOffer cancels the hold of an entry's offer and passes the slot on to
+// the next waiting patient. The hold may already be gone, since lapsed holds
+// are swept separately, so the slot is worked out from the offer.
+func (s *Server) releaseOffer(ctx context.Context, entry WaitlistEntry, reason string) {
+	hold, err := s.Bookings.FindByID(ctx, entry.Offer.BookingID)
+	switch {
+	case err == nil:
+		if hold.currentStatus() == StatusConfirmed {
+			return
+		}
+		if hold.currentStatus() == StatusPending && !hold.holdExpired(time.Now()) {
+			change := StatusChange{From: StatusPending, To: StatusCancelled, At: time.Now(), By: entry.Email, Reason: reason}
+			if err := s.Bookings.Transition(ctx, hold.ID, change); err != nil {
+				log.Printf("Failed to release waitlist hold %s: %v", hold.ID.Hex(), err)
+				return
+			}
+		}
+	case err != ErrNotFound:
+		log.Printf("Failed to fetch waitlist hold %s: %v", entry.Offer.BookingID.Hex(), err)
+		return
+	}
+
+	freed := Booking{
+		AppointmentDate: entry.Offer.AppointmentDate,
+		Treatment:       entry.Treatment,
+		Slot:            entry.Offer.Slot,
+		Email:           entry.Email,
+	}
+	if err := freed.setTimes(s.config.ClinicLocation); err != nil {
+		log.Printf("Failed to read offered slot of waitlist entry %s: %v", entry.ID.Hex(), err)
+		return
+	}
+	s.offerFreedSlot(ctx, freed)
+}
+
+// sweepWaitlistOffers periodically passes slots whose offer expired
+// unclaimed on to the next waiting patient until ctx is cancelled
+func (s *Server) sweepWaitlistOffers(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			expired, err := s.Waitlist.ExpiredOffers(ctx, now)
+			if err != nil {
+				log.Printf("Failed to fetch expired waitlist offers: %v", err)
+				continue
+			}
+			for _, entry := range expired {
+				if err := s.Waitlist.Withdraw(ctx, entry.ID, true); err != nil {
+					if err != ErrStatusChanged {
+						log.Printf("Failed to expire waitlist offer %s: %v", entry.ID.Hex(), err)
+					}
+					continue
+				}
+				s.releaseOffer(ctx, entry, "waitlist offer expired")
+			}
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+)
+
+func TestFreedSlotsAreOffered(t *testing.T) {
+	tests := []struct {
+		name string
+		path string // appended to the booking path
+		body interface{}
+	}{
+		{"a cancelled booking", "/cancel", nil},
+		{"a rescheduled booking", "/reschedule", BookingChangeRequest{AppointmentDate: testDate, Slot: testSlots[1]}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			booking := ts.book("p@x.com", testSlots[0])
+			wait := WaitlistRequest{Email: "q@x.com", Treatment: "Teeth Cleaning", From: testDate}
+			expectStatus(t, ts.do("POST", "/waitlist", ts.login("q@x.com"), wait), http.StatusOK)
+
+			expectStatus(t, ts.do("POST", "/bookings/"+booking.ID.Hex()+tt.path, ts.login("p@x.com"), tt.body), http.StatusOK)
+			if len(ts.notifier.sentTo("q@x.com")) != 1 {
+				t.Fatal("the waiting patient was not offered the freed slot")
+			}
+			held, err := ts.Bookings.FindByPatient(context.Background(), "q@x.com", testDate, "Teeth Cleaning")
+			if err != nil || held.Slot != testSlots[0] || held.HoldExpiresAt == nil {
+				t.Errorf("the freed slot is not held for the waiting patient: %+v, %v", held, err)
+			}
+
+			// The claim link books the slot
+			claim := WaitlistClaimRequest{Token: ts.notifier.lastToken(t, "q@x.com")}
+			expectStatus(t, ts.do("POST", "/waitlist/claim", "", claim), http.StatusOK)
+		})
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// webhookTolerance is how far the signed timestamp of a webhook may be from
+// now; older deliveries are treated as replays
+const webhookTolerance = 5 * time.Minute
+
+// webhookSignatureHeader carries the signature of a webhook payload, in the
+// Stripe format "t=<unix time>,v1=<hex hmac>"
+const webhookSignatureHeader = "Stripe-Signature"
+
+// errEventRejected marks webhook events that are valid but cannot be applied;
+// they are acknowledged so the provider does not retry them
+var errEventRejected = errors.New("event rejected")
+
+// webhookEvent is the envelope of a payment provider event
+type webhookEvent struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Data struct {
+		Object json.RawMessage `json:"object"`
+	} `json:"data"`
+}
+
+// webhookIntent is the payment intent carried by payment_intent.* events
+type webhookIntent struct {
+	ID               string            `json:"id"`
+	Amount           int64             `json:"amount"`
+	Currency         string            `json:"currency"`
+	PaymentMethod    string            `json:"payment_method"`
+	Metadata         map[string]string `json:"metadata"`
+	LastPaymentError *struct {
+		Message string `json:"message"`
+	} `json:"last_payment_error"`
+}
+
+// webhookCharge is the charge carried by charge.* events
+type webhookCharge struct {
+	PaymentIntent  string `json:"payment_intent"`
+	AmountRefunded int64  `json:"amount_refunded"`
+}
+
+// signWebhookPayload returns the hex HMAC-SHA256 of a payload signed at timestamp
+func signWebhookPayload(secret string, timestamp int64, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookSignature builds the signature header value for payload, so local
+// payloads can be signed for testing
+func webhookSignature(secret string, at time.Time, payload []byte) string {
+	return fmt.Sprintf("t=%d,v1=%s", at.Unix(), signWebhookPayload(secret, at.Unix(), payload))
+}
+
+// verifyWebhookSignature checks the signature header of payload and that it
+// was signed within webhookTolerance of now
+func verifyWebhookSignature(payload []byte, header, secret string, now time.Time) error {
+	var timestamp int64
+	var signatures []string
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			ts, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return errors.New("invalid signature timestamp")
+			}
+			timestamp = ts
+		case "v1":
+			signatures = append(signatures, value)
+		}
+	}
+	if timestamp == 0 || len(signatures) == 0 {
+		return errors.New("missing signature")
+	}
+
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > webhookTolerance || age < -webhookTolerance {
+		return errors.New("signature timestamp outside tolerance")
+	}
+
+	expected := []byte(signWebhookPayload(secret, timestamp, payload))
+	for _, signature := range signatures {
+		if hmac.Equal(expected, []byte(signature)) {
+			return nil
+		}
+	}
+	return errors.New("signature mismatch")
+}
+
+// handlePaymentWebhook receives events from the payment provider. Every event
+// is stored once by ID; deliveries of an event that was already processed are
+// acknowledged without applying it again.
+func (s *Server) handlePaymentWebhook(c *gin.Context) {
+	if s.config.WebhookSecret == "" {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "payment webhooks are not configured"})
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to read payload"})
+		return
+	}
+	now := time.Now()
+	if err := verifyWebhookSignature(payload, c.GetHeader(webhookSignatureHeader), s.config.WebhookSecret, now); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var event webhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid event payload"})
+		return
+	}
+
+	err = s.WebhookEvents.Insert(c, &WebhookEvent{ID: event.ID, Type: event.Type, Payload: string(payload), ReceivedAt: now})
+	if err == ErrDuplicateEvent {
+		stored, err := s.WebhookEvents.FindByID(c, event.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to fetch event"})
+			return
+		}
+		if stored.ProcessedAt != nil {
+			c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+			return
+		}
+		// An earlier delivery failed midway; applying events is idempotent so retry it
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store event"})
+		return
+	}
+
+	reason := ""
+	if err := s.applyPaymentEvent(c, event); err != nil {
+		if !errors.Is(err, errEventRejected) {
+			log.Printf("Failed to apply payment event %s: %v", event.ID, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to apply event"})
+			return
+		}
+		log.Printf("Payment event %s not applied: %v", event.ID, err)
+		reason = err.Error()
+	}
+
+	if err := s.WebhookEvents.MarkProcessed(c, event.ID, time.Now(), reason); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to update event"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+// applyPaymentEvent moves the booking and payment linked to event to the state
+// the event reports
+func (s *Server) applyPaymentEvent(ctx context.Context, event webhookEvent) error {
+	switch event.Type {
+	case "payment_intent.succeeded":
+		var intent webhookIntent
+		if err := json.Unmarshal(event.Data.Object, &intent); err != nil {
+			return fmt.Errorf("%w: invalid payment intent", errEventRejected)
+		}
+		booking, err := s.webhookBooking(ctx, intent)
+		if err == ErrNotFound {
+			// The hold lapsed and was swept before the charge arrived
+			if err := s.refundCharge(ctx, intent.ID); err != nil {
+				return err
+			}
+			return fmt.Errorf("%w: booking of %s not found, charge refunded", errEventRejected, intent.ID)
+		} else if err != nil {
+			return err
+		}
+
+		payment := Payment{
+			PaymentMethodId: intent.PaymentMethod,
+			TransactionID:   intent.ID,
+			Amount:          intent.Amount,
+			Currency:        strings.ToLower(intent.Currency),
+			Booking:         paymentBookingFrom(booking),
+		}
+		err = s.recordPayment(ctx, booking, &payment)
+		if err == errHoldExpired {
+			err = s.recordLateCharge(ctx, booking, &payment)
+		}
+		switch {
+		case err == nil, err == ErrDuplicatePayment:
+			return nil
+		case err == errChargeRefunded, err == errAmountMismatch, errors.Is(err, errInvalidTransition):
+			return fmt.Errorf("%w: %v", errEventRejected, err)
+		default:
+			return err
+		}
+
+	case "payment_intent.payment_failed":
+		var intent webhookIntent
+		if err := json.Unmarshal(event.Data.Object, &intent); err != nil {
+			return fmt.Errorf("%w: invalid payment intent", errEventRejected)
+		}
+		booking, err := s.webhookBooking(ctx, intent)
+		if err == ErrNotFound {
+			return fmt.Errorf("%w: booking of %s not found", errEventRejected, intent.ID)
+		} else if err != nil {
+			return err
+		}
+		message := "payment failed"
+		if intent.LastPaymentError != nil && intent.LastPaymentError.Message != "" {
+			message = intent.LastPaymentError.Message
+		}
+		return s.Bookings.SetPaymentError(ctx, booking.ID, message)
+
+	case "charge.refunded":
+		var charge webhookCharge
+		if err := json.Unmarshal(event.Data.Object, &charge); err != nil {
+			return fmt.Errorf("%w: invalid charge", errEventRejected)
+		}
+		_, err := s.Payments.SetAmountRefunded(ctx, charge.PaymentIntent, charge.AmountRefunded)
+		if err == ErrNotFound {
+			return fmt.Errorf("%w: no payment for %s", errEventRejected, charge.PaymentIntent)
+		}
+		return err
+
+	default:
+		return fmt.Errorf("%w: unhandled event type %s", errEventRejected, event.Type)
+	}
+}
+
+// webhookBooking fetches the booking an intent was created for, failing with
+// ErrNotFound when it no longer exists
+func (s *Server) webhookBooking(ctx context.Context, intent webhookIntent) (Booking, error) {
+	bookingID, err := primitive.ObjectIDFromHex(intent.Metadata["bookingId"])
+	if err != nil {
+		return Booking{}, fmt.Errorf("%w: intent %s has no booking", errEventRejected, intent.ID)
+	}
+	return s.Bookings.FindByID(ctx, bookingID)
+}
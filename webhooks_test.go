@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	const secret = "whsec_test"
+	payload := []byte(`{"id":"evt_1"}`)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		header string
+		ok     bool
+	}{
+		{"a valid signature", webhookSignature(secret, now, payload), true},
+		{"one of several signatures matches", webhookSignature(secret, now, payload) + ",v1=00", true},
+		{"another secret", webhookSignature("whsec_other", now, payload), false},
+		{"another payload", webhookSignature(secret, now, []byte(`{"id":"evt_2"}`)), false},
+		{"a replayed delivery", webhookSignature(secret, now.Add(-time.Hour), payload), false},
+		{"a timestamp in the future", webhookSignature(secret, now.Add(time.Hour), payload), false},
+		{"no signature", "", false},
+		{"a garbled header", "t=soon,v1=abc", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyWebhookSignature(payload, tt.header, secret, now)
+			if (err == nil) != tt.ok {
+				t.Errorf("got %v, want success %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+// sendWebhook posts a payment event signed with the server's webhook secret
+func (ts *testServer) sendWebhook(id, eventType string, object interface{}) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	data, err := json.Marshal(object)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	event := map[string]interface{}{"id": id, "type": eventType, "data": map[string]json.RawMessage{"object": data}}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/webhooks/payments", strings.NewReader(string(payload)))
+	req.Header.Set(webhookSignatureHeader, webhookSignature(ts.config.WebhookSecret, time.Now(), payload))
+	recorder := httptest.NewRecorder()
+	ts.router.ServeHTTP(recorder, req)
+	return recorder
+}
+
+// hold stores a pending hold of slot on testDate for email that expires
+// after ttl, and returns it
+func (ts *testServer) hold(email, slot string, ttl time.Duration) Booking {
+	ts.t.Helper()
+	expiresAt := time.Now().Add(ttl)
+	booking := Booking{
+		AppointmentDate: testDate,
+		Treatment:       "Teeth Cleaning",
+		Slot:            slot,
+		Email:           email,
+		Price:           20,
+		Status:          StatusPending,
+		HoldExpiresAt:   &expiresAt,
+	}
+	if err := booking.setTimes(ts.config.ClinicLocation); err != nil {
+		ts.t.Fatal(err)
+	}
+	if err := ts.Bookings.Insert(context.Background(), &booking); err != nil {
+		ts.t.Fatal(err)
+	}
+	return booking
+}
+
+// charge creates an intent for booking at the fake provider and pays it
+func (ts *testServer) charge(booking Booking) PaymentIntent {
+	ts.t.Helper()
+	ctx := context.Background()
+	intent, err := ts.provider.CreateIntent(ctx, IntentParams{
+		Amount:   toMinorUnits(booking.Price, "usd"),
+		Currency: "usd",
+		Metadata: map[string]string{"bookingId": booking.ID.Hex()},
+	})
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	if intent, err = ts.provider.Confirm(ctx, intent.ID, fakeMethodSucceeds); err != nil {
+		ts.t.Fatal(err)
+	}
+	return intent
+}
+
+// intentObject is intent as carried by payment_intent.* events
+func intentObject(intent PaymentIntent) map[string]interface{} {
+	return map[string]interface{}{
+		"id":             intent.ID,
+		"amount":         intent.Amount,
+		"currency":       intent.Currency,
+		"payment_method": fakeMethodSucceeds,
+		"metadata":       intent.Metadata,
+	}
+}
+
+func TestPaymentWebhookRejectsUnsignedEvents(t *testing.T) {
+	ts := newTestServer(t)
+	expectStatus(t, ts.do("POST", "/webhooks/payments", "", `{"id":"evt_1","type":"payment_intent.succeeded"}`), http.StatusBadRequest)
+
+	ts.config.WebhookSecret = ""
+	expectStatus(t, ts.sendWebhook("evt_1", "payment_intent.succeeded", nil), http.StatusServiceUnavailable)
+}
+
+func TestPaymentWebhookSucceeded(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	booking := ts.hold("p@x.com", testSlots[0], time.Minute)
+	intent := ts.charge(booking)
+
+	rec := ts.sendWebhook("evt_1", "payment_intent.succeeded", intentObject(intent))
+	expectStatus(t, rec, http.StatusOK)
+	paid, _ := ts.Bookings.FindByID(ctx, booking.ID)
+	if !paid.Paid || paid.Status != StatusPaid || paid.HoldExpiresAt != nil || paid.TransactionID != intent.ID {
+		t.Fatalf("booking was not paid: %+v", paid)
+	}
+
+	// Redeliveries are acknowledged without recording a second payment
+	rec = ts.sendWebhook("evt_1", "payment_intent.succeeded", intentObject(intent))
+	expectStatus(t, rec, http.StatusOK)
+	if body := decodeJSON[map[string]interface{}](t, rec); body["duplicate"] != true {
+		t.Errorf("redelivery was not recognised: %v", body)
+	}
+	if payments, _ := ts.Payments.List(ctx); len(payments) != 1 {
+		t.Errorf("got %d payments, want 1", len(payments))
+	}
+}
+
+func TestPaymentWebhookFailedAndRefunded(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	booking := ts.hold("p@x.com", testSlots[0], time.Minute)
+	intent := ts.charge(booking)
+
+	failed := intentObject(intent)
+	failed["last_payment_error"] = map[string]string{"message": "Your card was declined."}
+	expectStatus(t, ts.sendWebhook("evt_1", "payment_intent.payment_failed", failed), http.StatusOK)
+	if got, _ := ts.Bookings.FindByID(ctx, booking.ID); got.PaymentError != "Your card was declined." {
+		t.Errorf("got payment error %q", got.PaymentError)
+	}
+
+	expectStatus(t, ts.sendWebhook("evt_2", "payment_intent.succeeded", intentObject(intent)), http.StatusOK)
+	refund := map[string]interface{}{"payment_intent": intent.ID, "amount_refunded": intent.Amount}
+	expectStatus(t, ts.sendWebhook("evt_3", "charge.refunded", refund), http.StatusOK)
+
+	payment, err := ts.Payments.FindByTransaction(ctx, intent.ID)
+	if err != nil || payment.Status != PaymentRefunded || payment.netAmount() != 0 {
+		t.Errorf("payment was not refunded: %+v, %v", payment, err)
+	}
+	if got, _ := ts.Bookings.FindByID(ctx, booking.ID); got.Paid {
+		t.Errorf("a fully refunded booking is still paid")
+	}
+}
+
+func TestPaymentWebhookIgnoresUnknownEvents(t *testing.T) {
+	ts := newTestServer(t)
+	expectStatus(t, ts.sendWebhook("evt_1", "customer.created", map[string]string{}), http.StatusOK)
+
+	event, err := ts.WebhookEvents.FindByID(context.Background(), "evt_1")
+	if err != nil || event.ProcessedAt == nil || event.Error == "" {
+		t.Errorf("unhandled event was not stored as rejected: %+v, %v", event, err)
+	}
+}
+
+func TestPaymentWebhookLateCharge(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(ts *testServer, booking Booking)
+		paid     bool // whether the booking ends up paid
+		refunded bool // whether the charge is refunded
+	}{
+		{"a free slot is reserved again", func(ts *testServer, booking Booking) {}, true, false},
+		{"a slot booked by someone else is refunded", func(ts *testServer, booking Booking) {
+			ts.book("q@x.com", testSlots[0])
+		}, false, true},
+		{"a swept hold is refunded", func(ts *testServer, booking Booking) {
+			ts.Bookings.DeleteExpiredHolds(context.Background(), time.Now())
+		}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestServer(t)
+			ctx := context.Background()
+			booking := ts.hold("p@x.com", testSlots[0], -time.Minute)
+			intent := ts.charge(booking)
+			tt.setup(ts, booking)
+
+			expectStatus(t, ts.sendWebhook("evt_1", "payment_intent.succeeded", intentObject(intent)), http.StatusOK)
+			if got, _ := ts.Bookings.FindByID(ctx, booking.ID); got.Paid != tt.paid {
+				t.Errorf("got paid %v, want %v", got.Paid, tt.paid)
+			}
+			intent, _ = ts.provider.Retrieve(ctx, intent.ID)
+			if refunded := intent.AmountRefunded == intent.Amount; refunded != tt.refunded {
+				t.Errorf("got refunded %v, want %v", refunded, tt.refunded)
+			}
+		})
+	}
+}